@@ -1,8 +1,17 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/radovskyb/services/user"
@@ -10,28 +19,153 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var emailRegexp = regexp.MustCompile("[A-Z0-9a-z._%+-]+@[A-Za-z0-9.-]+\\.[A-Za-z]{2,6}")
+// maxPasswordLen is the maximum length of a password in bytes. bcrypt
+// only uses the first 72 bytes of a password, so longer passwords that
+// share them would otherwise be interchangeable.
+const maxPasswordLen = 72
+
+// defaultMinPasswordLen is the minimum length of a password in bytes,
+// unless it's changed with WithPasswordLength.
+const defaultMinPasswordLen = 6
+
+// defaultMinUsernameLen and defaultMaxUsernameLen are the range of
+// username lengths in bytes, unless it's changed with WithUsernameLength.
+const (
+	defaultMinUsernameLen = 3
+	defaultMaxUsernameLen = 25
+)
+
+// emailRegexp is anchored so the whole string must be a valid email,
+// rather than just containing one.
+var emailRegexp = regexp.MustCompile("^[A-Z0-9a-z._%+-]+@[A-Za-z0-9.-]+\\.[A-Za-z]{2,6}$")
 
 var (
-	ErrEmptyRequiredField    = errors.New("error: required field is empty")
-	ErrInvalidUsernameLength = errors.New("error: username must be between 3 - 25 characters")
-	ErrInvalidEmail          = errors.New("error: email is invalid")
-	ErrPasswordTooShort      = errors.New("error: password is too short (must be at least 6 characters)")
-	ErrInvalidUsername       = errors.New("error: username is invalid (can only contain numbers and letters)")
-	ErrWrongPassword         = errors.New("error: incorrect password")
+	ErrEmptyRequiredField     = errors.New("error: required field is empty")
+	ErrInvalidUsernameLength  = errors.New("error: username must be between 3 - 25 characters")
+	ErrInvalidEmail           = errors.New("error: email is invalid")
+	ErrPasswordTooShort       = errors.New("error: password is too short (must be at least 6 characters)")
+	ErrInvalidUsername        = errors.New("error: username is invalid (can only contain numbers and letters)")
+	ErrWrongPassword          = errors.New("error: incorrect password")
+	ErrAccountLocked          = errors.New("error: account is locked due to too many failed login attempts")
+	ErrAccountDisabled        = errors.New("error: account is disabled")
+	ErrInvalidReservation     = errors.New("error: username reservation is invalid or has expired")
+	ErrInvalidToken           = errors.New("error: token is invalid")
+	ErrTokenExpired           = errors.New("error: token has expired")
+	ErrResetPending           = errors.New("error: a password reset has already been requested")
+	ErrEmailNotVerified       = errors.New("error: email has not been verified")
+	ErrPasswordEqualsIdentity = errors.New("error: password can't be the same as the email or username")
+	ErrPasswordTooLong        = errors.New("error: password is too long (must be at most 72 bytes)")
 )
 
 type Auth interface {
 	// CreateUser hashes a user's password and then stores
 	// the user in a user repository.
+	//
+	// If u's username is reserved, ErrDuplicateUsername is returned.
 	CreateUser(u *user.User) error
 
+	// ReserveUsername reserves a username for ttl so it can't be taken
+	// by anyone else, returning a token for the reservation.
+	//
+	// If the username already exists or is reserved,
+	// ErrDuplicateUsername is returned.
+	ReserveUsername(username string, ttl time.Duration) (string, error)
+
+	// ReleaseUsername releases the username reservation for token.
+	ReleaseUsername(token string)
+
+	// CreateUserWithReservation creates a user whose username was reserved
+	// with ReserveUsername and then releases the reservation.
+	//
+	// If token isn't a reservation for u's username or the reservation
+	// has expired, ErrInvalidReservation is returned.
+	CreateUserWithReservation(u *user.User, token string) error
+
+	// CreateResetToken creates a single use password reset token for the
+	// user with the specified email, which expires after the reset token
+	// ttl. Any of the user's previous reset tokens are invalidated.
+	//
+	// The token is also emailed to the user if a Mailer is set with
+	// WithMailer.
+	CreateResetToken(email string) (string, error)
+
+	// RequestPasswordReset is like CreateResetToken, except that only one
+	// reset can be requested for an email per reset token ttl, until it's
+	// used. Otherwise a *ResetPendingError is returned.
+	//
+	// Requests for emails without a user are limited the same way, so
+	// the error doesn't reveal which emails are registered, but then
+	// return datastore.ErrUserNotFound.
+	RequestPasswordReset(email string) (string, error)
+
+	// ResetPassword sets the password of the user that token was created
+	// for to newPassword and then invalidates token, along with all of
+	// the user's sessions.
+	//
+	// If token doesn't exist or has already been used, ErrInvalidToken is
+	// returned. If token has expired, ErrTokenExpired is returned. If
+	// newPassword is invalid, including when it equals the user's email
+	// or username, a *ValidationError is returned and token can still be
+	// used.
+	ResetPassword(token, newPassword string) error
+
+	// ChangePassword sets the password of the user with the specified id
+	// to newPassword, once oldPassword has been checked against their
+	// current password.
+	//
+	// The user's session version is incremented, logging them out of
+	// all of their sessions.
+	//
+	// If oldPassword is wrong, ErrWrongPassword is returned. If
+	// newPassword is invalid, a *ValidationError is returned.
+	ChangePassword(userId int64, oldPassword, newPassword string) error
+
+	// HasPendingReset returns whether the user with the specified id has
+	// an unexpired password reset token and, if so, when it expires.
+	HasPendingReset(userId int64) (bool, time.Time, error)
+
+	// RecordLogin records that the user with the specified id has just
+	// logged in, by setting their LastLoginAt.
+	RecordLogin(userId int64) error
+
+	// InvalidateAllSessions logs the user with the specified id out of
+	// all of their sessions by bumping their session version.
+	InvalidateAllSessions(userId int64) error
+
+	// GenerateVerificationToken creates a single use token that verifies
+	// the current email of the user with the specified id when passed to
+	// VerifyEmail. Tokens expire after the verification token ttl.
+	//
+	// The token is also emailed to the user if a Mailer is set with
+	// WithMailer.
+	GenerateVerificationToken(userId int64) (string, error)
+
+	// VerifyEmail marks the email of the user that token was generated
+	// for as verified and then invalidates token.
+	//
+	// If token doesn't exist, has already been used or was generated for
+	// an email the user has since changed, ErrInvalidToken is returned.
+	// If token has expired, ErrTokenExpired is returned.
+	VerifyEmail(token string) error
+
 	// ValidateUser checks to see if the fields of a user are
-	// valid to be used with the user's repository.
+	// valid to be used with the user's repository, returning a
+	// *ValidationError for the first invalid field. The whitespace around
+	// u's email and username is trimmed first, and usernames containing
+	// whitespace are rejected with ErrInvalidUsername.
 	ValidateUser(u *user.User) error
 
+	// ValidateUserUpdate is like ValidateUser, except that the password
+	// may be blank, meaning the user's current password is being kept.
+	ValidateUserUpdate(u *user.User) error
+
+	// ValidateUsers validates each user in users without touching the
+	// user repository. The returned errors are index aligned with users
+	// and are nil where a user is valid.
+	ValidateUsers(users []*user.User) []error
+
 	// IsValidationErr checks if the specified error is a
-	// validation error.
+	// validation error, including a *ValidationError.
 	IsValidationErr(err error) bool
 
 	// AuthenticateUser authenticates a user from a user's
@@ -40,109 +174,1121 @@ type Auth interface {
 	// Password is hashed and then compared to the user's
 	// hashed password.
 	//
+	// If lockouts are enabled and the user's account is locked,
+	// ErrAccountLocked is returned without checking the password.
+	//
+	// If email verification is required and the user's email hasn't
+	// been verified, ErrEmailNotVerified is returned.
+	//
+	// If the user's account is disabled, ErrAccountDisabled is returned
+	// once the password has been checked.
+	//
+	// If the user's password was hashed with outdated settings and the
+	// configured Hasher is a Rehasher, it's rehashed and stored.
+	//
+	// If the user has enabled one-time passwords, the user is returned
+	// along with ErrTOTPRequired, and they shouldn't be logged in until
+	// they've passed VerifyTOTP.
+	//
 	// If there's no errors, a *user.User will be returned.
 	AuthenticateUser(email, password string) (*user.User, error)
 
+	// AuthenticateUserByIdentifier is like AuthenticateUser, except that
+	// the user is looked up by identifier, which can be either their
+	// email or their username.
+	AuthenticateUserByIdentifier(identifier, password string) (*user.User, error)
+
+	// AuthenticateTenantUser is like AuthenticateUser, except that the
+	// user is looked up by email within the tenant with tenantId.
+	AuthenticateTenantUser(tenantId, email, password string) (*user.User, error)
+
+	// EnableTOTP generates a new secret for time-based one-time passwords
+	// for the user with the specified id, and returns it along with an
+	// otpauth URL that authenticator apps can scan as a QR code. They
+	// aren't required to log in until the user confirms their app works
+	// by passing VerifyTOTP.
+	//
+	// If the user has already enabled one-time passwords,
+	// ErrTOTPAlreadyEnabled is returned.
+	EnableTOTP(userId int64) (secret, qrURL string, err error)
+
+	// VerifyTOTP checks code against the one-time password of the user
+	// with the specified id. The first valid code enables one-time
+	// passwords for the user.
+	//
+	// If code is wrong, or it or a later code has already been used,
+	// ErrInvalidTOTPCode is returned. If the user hasn't called
+	// EnableTOTP, ErrTOTPNotSetUp is returned.
+	VerifyTOTP(userId int64, code string) error
+
+	// StartTOTPLogin starts the second step of logging in the user with
+	// the specified id, once AuthenticateUser has returned
+	// ErrTOTPRequired, and returns a single use nonce for
+	// FinishTOTPLogin. The nonce expires after five minutes.
+	StartTOTPLogin(userId int64) (string, error)
+
+	// FinishTOTPLogin checks code with VerifyTOTP for the user that nonce
+	// was started for and returns them if it's right, invalidating nonce.
+	// After five codes nonce is invalidated whether they're right or not,
+	// so codes can't be guessed without authenticating again.
+	//
+	// If nonce doesn't exist or has been invalidated, ErrInvalidToken
+	// is returned. If nonce has expired, ErrTokenExpired is returned.
+	FinishTOTPLogin(nonce, code string) (*user.User, error)
+
+	// MustChangePassword checks whether u's password is older than the
+	// max password age and so must be changed. It's always false when
+	// the max password age is disabled.
+	MustChangePassword(u *user.User) bool
+
 	// CompareHashAndPassword compares to see whether a password is
-	// comparable to a hashed password when it is itself hashed.
+	// comparable to a hashed password when it is itself hashed, using
+	// the algorithm identified by the hash.
 	CompareHashAndPassword(hash, password string) error
 
-	// HashPassword hashes a password.
+	// HashPassword hashes a password with the configured Hasher.
+	//
+	// If password is longer than 72 bytes, ErrPasswordTooLong is
+	// returned, rather than bcrypt silently truncating it.
 	HashPassword(password string) (string, error)
+
+	// SetPassword hashes password with HashPassword and sets it as u's
+	// password, stamping u's PasswordChangedAt with the current time.
+	// u isn't stored.
+	SetPassword(u *user.User, password string) error
 }
 
 // auth is the default implementation for Auth.
 type auth struct {
 	r datastore.UserRepository
+
+	// lockoutThreshold is the number of consecutive failed login
+	// attempts within lockoutWindow before an account is locked for
+	// lockoutDuration.
+	lockoutThreshold int
+	lockoutWindow    time.Duration
+	lockoutDuration  time.Duration
+
+	now func() time.Time
+
+	// hasher hashes new passwords.
+	hasher Hasher
+
+	// pepper is the key passwords are HMACed with before they're hashed,
+	// or nil if they're hashed as they are.
+	pepper []byte
+
+	// usernameMinLen and usernameMaxLen are the allowed range of
+	// username lengths, in bytes, and usernameChar reports whether a
+	// username can contain a character. customUsernameChars is set when
+	// usernameChar was changed with WithUsernameChars.
+	usernameMinLen      int
+	usernameMaxLen      int
+	usernameChar        func(r rune) bool
+	customUsernameChars bool
+
+	// passwordMinLen and passwordMaxLen are the allowed range of
+	// password lengths, in bytes.
+	passwordMinLen int
+	passwordMaxLen int
+
+	// passwordPolicy is the strength policy that passwords must meet,
+	// or nil if only their length is checked.
+	passwordPolicy *PasswordPolicy
+
+	// precheckDuplicates checks whether created users' emails and
+	// usernames are taken before hashing their passwords.
+	precheckDuplicates bool
+
+	// resetTokenTTL is how long password reset tokens are valid for.
+	resetTokenTTL time.Duration
+
+	// verificationTokenTTL is how long email verification tokens are
+	// valid for.
+	verificationTokenTTL time.Duration
+
+	// canonicalizeEmails sets the canonical email of created users, so
+	// that different addresses for the same inbox are duplicates.
+	canonicalizeEmails bool
+
+	// emailDomainChecker checks that created users' email domains can
+	// receive email. Domains aren't checked when it's nil.
+	emailDomainChecker *EmailDomainChecker
+
+	// passwordMaxAge is how long a password can be used before it must
+	// be changed, or 0 if passwords don't expire.
+	passwordMaxAge time.Duration
+
+	// totpIssuer is the issuer in otpauth URLs, which authenticator
+	// apps show next to users' accounts.
+	totpIssuer string
+
+	// mailer emails reset and verification tokens to users as links to
+	// resetURL and verifyURL.
+	mailer    Mailer
+	resetURL  string
+	verifyURL string
+
+	// requireVerifiedEmail rejects users who haven't verified their
+	// email when they authenticate.
+	requireVerifiedEmail bool
+
+	mu           sync.Mutex              // Protects the following.
+	reservations map[string]*reservation // Username to reservation.
+	resetTokens  map[string]*resetToken  // Hashed token to reset token.
+
+	resetRequests map[string]time.Time  // Email to when it can request a reset again.
+	totpLogins    map[string]*totpLogin // Hashed nonce to pending login.
+
+	verificationTokens map[string]*verificationToken // Hashed token to verification token.
+}
+
+// reservation is a reserved username.
+type reservation struct {
+	username string
+	token    string
+	expires  time.Time
+}
+
+// resetToken is a password reset token for a user. Only the token's hash
+// is stored, so a leaked map doesn't leak usable tokens.
+type resetToken struct {
+	userId  int64
+	expires time.Time
+}
+
+// verificationToken is an email verification token for a user's email.
+// Like resetTokens, only the token's hash is stored.
+type verificationToken struct {
+	userId  int64
+	email   string
+	expires time.Time
+}
+
+// ResetPendingError is returned by RequestPasswordReset when a reset has
+// already been requested for an email. It wraps ErrResetPending.
+type ResetPendingError struct {
+	// Wait is how long until another reset can be requested.
+	Wait time.Duration
+}
+
+func (e *ResetPendingError) Error() string { return ErrResetPending.Error() }
+
+func (e *ResetPendingError) Unwrap() error { return ErrResetPending }
+
+// Option configures an Auth implementation created with NewAuth.
+type Option func(*auth)
+
+// WithLockout locks a user's account for duration once they have made
+// threshold consecutive failed login attempts within window of the first
+// one. Attempts from before the window aren't counted, and a window <= 0
+// counts attempts until a successful login, which also resets the count.
+// Lockouts are disabled by default.
+func WithLockout(threshold int, window, duration time.Duration) Option {
+	return func(a *auth) {
+		a.lockoutThreshold = threshold
+		a.lockoutWindow = window
+		a.lockoutDuration = duration
+	}
+}
+
+// WithResetTokenTTL sets how long password reset tokens are valid for.
+// The default is 1 hour.
+func WithResetTokenTTL(ttl time.Duration) Option {
+	return func(a *auth) {
+		a.resetTokenTTL = ttl
+	}
+}
+
+// WithVerificationTokenTTL sets how long email verification tokens are
+// valid for. The default is 24 hours.
+func WithVerificationTokenTTL(ttl time.Duration) Option {
+	return func(a *auth) {
+		a.verificationTokenTTL = ttl
+	}
+}
+
+// WithEmailVerification requires users to verify their email before
+// they can authenticate.
+func WithEmailVerification() Option {
+	return func(a *auth) {
+		a.requireVerifiedEmail = true
+	}
+}
+
+// WithEmailCanonicalization sets the canonical email of users when
+// they're created using CanonicalizeEmail, so that addresses such as
+// a+1@gmail.com and a@gmail.com can't both be registered. Users keep
+// their original email for delivery. It's disabled by default.
+func WithEmailCanonicalization() Option {
+	return func(a *auth) {
+		a.canonicalizeEmails = true
+	}
+}
+
+// WithEmailDomainChecker rejects created users whose email domain can't
+// receive email, according to c, with ErrEmailDomainUndeliverable.
+// Domains aren't checked by default, so that creating users doesn't
+// depend on DNS.
+func WithEmailDomainChecker(c *EmailDomainChecker) Option {
+	return func(a *auth) {
+		a.emailDomainChecker = c
+	}
+}
+
+// WithPasswordMaxAge requires users to change their password once it's
+// older than maxAge, which is reported by MustChangePassword. Passwords
+// don't expire by default.
+func WithPasswordMaxAge(maxAge time.Duration) Option {
+	return func(a *auth) {
+		a.passwordMaxAge = maxAge
+	}
+}
+
+// WithUsernameLength sets the minimum and maximum length of usernames,
+// in bytes. The default is 3 to 25. The sql backed repositories store
+// usernames of up to 25 characters, so their users tables must be
+// altered to allow longer usernames.
+func WithUsernameLength(min, max int) Option {
+	return func(a *auth) {
+		a.usernameMinLen = min
+		a.usernameMaxLen = max
+	}
+}
+
+// WithPasswordLength sets the minimum and maximum length of passwords,
+// in bytes. The default is 6 to 72. A max <= 0 or above 72 is 72, since
+// bcrypt ignores everything after a password's first 72 bytes.
+func WithPasswordLength(min, max int) Option {
+	return func(a *auth) {
+		if max <= 0 || max > maxPasswordLen {
+			max = maxPasswordLen
+		}
+		a.passwordMinLen = min
+		a.passwordMaxLen = max
+	}
+}
+
+// WithUsernameChars sets which characters usernames can contain. By
+// default usernames can only contain letters and numbers.
+func WithUsernameChars(allowed func(r rune) bool) Option {
+	return func(a *auth) {
+		a.usernameChar = allowed
+		a.customUsernameChars = true
+	}
+}
+
+// WithPasswordPolicy rejects passwords that don't meet p with
+// ErrWeakPassword. By default only the password's length is checked.
+func WithPasswordPolicy(p PasswordPolicy) Option {
+	return func(a *auth) {
+		a.passwordPolicy = &p
+	}
+}
+
+// WithHasher hashes new passwords with h, such as one returned by
+// NewArgon2idHasher. Existing bcrypt and argon2id hashes can still be
+// compared, so users can be migrated to h gradually, which happens as
+// they log in if h is a Rehasher. The default is
+// bcrypt with bcrypt.DefaultCost.
+func WithHasher(h Hasher) Option {
+	return func(a *auth) {
+		a.hasher = h
+	}
+}
+
+// WithPepper HMACs passwords with key, using SHA-256, before they're
+// hashed or compared, so that hashes can't be cracked offline without
+// key, which should be kept out of the database, such as in an
+// environment variable. Passwords aren't peppered by default.
+//
+// Hashes made without a pepper, or with a different one, don't match
+// once it's set, so existing users' passwords must be reset.
+func WithPepper(key []byte) Option {
+	return func(a *auth) {
+		a.pepper = key
+	}
+}
+
+// WithTOTPIssuer sets the issuer in the otpauth URLs returned by
+// EnableTOTP, such as the app's name, which authenticator apps show next
+// to users' accounts. There's no issuer by default.
+func WithTOTPIssuer(issuer string) Option {
+	return func(a *auth) {
+		a.totpIssuer = issuer
+	}
+}
+
+// WithDuplicatePrecheck checks whether a user's email or username is
+// already taken before hashing their password when they're created, so
+// that attempts to create duplicate users don't pay the cost of hashing.
+// The repository still rejects duplicates that are created between the
+// check and storing the user. It's disabled by default, since it costs
+// extra repository lookups for every created user.
+func WithDuplicatePrecheck() Option {
+	return func(a *auth) {
+		a.precheckDuplicates = true
+	}
 }
 
 // NewAuth creates a new Auth implementation for the specified
 // user repository.
-func NewAuth(userRepo datastore.UserRepository) Auth {
-	return &auth{r: userRepo}
+func NewAuth(userRepo datastore.UserRepository, opts ...Option) Auth {
+	a := &auth{
+		r:      userRepo,
+		now:    time.Now,
+		hasher: NewBcryptHasher(bcrypt.DefaultCost),
+		mailer: nopMailer{},
+
+		usernameMinLen: defaultMinUsernameLen,
+		usernameMaxLen: defaultMaxUsernameLen,
+		usernameChar:   isAlphanumericRune,
+
+		passwordMinLen: defaultMinPasswordLen,
+		passwordMaxLen: maxPasswordLen,
+
+		resetTokenTTL: time.Hour,
+		reservations:  make(map[string]*reservation),
+		resetTokens:   make(map[string]*resetToken),
+		resetRequests: make(map[string]time.Time),
+		totpLogins:    make(map[string]*totpLogin),
+
+		verificationTokenTTL: 24 * time.Hour,
+		verificationTokens:   make(map[string]*verificationToken),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// validationErrs are the errors that IsValidationErr reports.
+var validationErrs = []error{
+	ErrEmptyRequiredField,
+	ErrInvalidUsernameLength,
+	ErrInvalidEmail,
+	ErrPasswordTooShort,
+	ErrInvalidUsername,
+	ErrPasswordEqualsIdentity,
+	ErrPasswordTooLong,
+	ErrWeakPassword,
+	ErrEmailDomainUndeliverable,
+}
+
+// ValidationError is returned when one of a user's fields is invalid.
+// It wraps one of the validation errors, such as ErrInvalidEmail, so
+// it can still be checked for with errors.Is.
+type ValidationError struct {
+	// Field is the invalid field: "email", "username" or "password".
+	Field string `json:"field"`
+
+	// Message describes why Field is invalid.
+	Message string `json:"error"`
+
+	// Err is the validation error.
+	Err error `json:"-"`
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// invalid returns a *ValidationError for field failing with err.
+func invalid(field string, err error) error {
+	return &ValidationError{Field: field, Message: err.Error(), Err: err}
 }
 
 func (a *auth) IsValidationErr(err error) bool {
-	switch err {
-	case ErrEmptyRequiredField,
-		ErrInvalidUsernameLength,
-		ErrInvalidEmail,
-		ErrPasswordTooShort,
-		ErrInvalidUsername:
+	return IsValidationErr(err)
+}
+
+// IsValidationErr checks if err is a validation error, either one of
+// the validation errors, such as ErrInvalidEmail, or a *ValidationError,
+// including when it's wrapped. It's what Auth's IsValidationErr method
+// uses, for callers that don't have an Auth.
+func IsValidationErr(err error) bool {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
 		return true
 	}
+	for _, validationErr := range validationErrs {
+		if errors.Is(err, validationErr) {
+			return true
+		}
+	}
 	return false
 }
 
 func (a *auth) ValidateUser(u *user.User) error {
-	if u.Email == "" || u.Username == "" || u.Password == "" {
-		return ErrEmptyRequiredField
+	if u.Password == "" {
+		trimUser(u)
+		// Report the first empty field, in the order they're checked.
+		switch {
+		case u.Email == "":
+			return invalid("email", ErrEmptyRequiredField)
+		case u.Username == "":
+			return invalid("username", ErrEmptyRequiredField)
+		}
+		return invalid("password", ErrEmptyRequiredField)
+	}
+	return a.ValidateUserUpdate(u)
+}
+
+func (a *auth) ValidateUserUpdate(u *user.User) error {
+	trimUser(u)
+	if u.Email == "" {
+		return invalid("email", ErrEmptyRequiredField)
+	}
+	if u.Username == "" {
+		return invalid("username", ErrEmptyRequiredField)
 	}
 	if !emailRegexp.MatchString(u.Email) {
-		return ErrInvalidEmail
+		return invalid("email", ErrInvalidEmail)
+	}
+	if err := a.validateUsername(u.Username); err != nil {
+		return invalid("username", err)
+	}
+	if u.Password == "" {
+		return nil
+	}
+	if err := a.validatePassword(u, u.Password); err != nil {
+		return invalid("password", err)
 	}
-	if !isAlphanumeric(u.Username) {
-		return ErrInvalidUsername
+	return nil
+}
+
+// validatePassword checks password's length and strength, and that it
+// isn't u's email or username.
+func (a *auth) validatePassword(u *user.User, password string) error {
+	if err := a.validatePasswordLength(password); err != nil {
+		return err
 	}
-	if len(u.Username) < 3 || len(u.Username) > 25 {
-		return ErrInvalidUsernameLength
+	if a.passwordPolicy != nil {
+		if err := a.passwordPolicy.check(password); err != nil {
+			return err
+		}
 	}
-	if len(u.Password) < 6 {
-		return ErrPasswordTooShort
+	if strings.EqualFold(password, u.Email) ||
+		strings.EqualFold(password, u.Username) {
+		return ErrPasswordEqualsIdentity
 	}
 	return nil
 }
 
-// isAlphanumeric checks whether a string contains only alphanumeric
-// unicode characters.
-func isAlphanumeric(str string) bool {
-	for _, r := range str {
-		if !(unicode.IsLetter(r) || unicode.IsNumber(r)) {
-			return false
+func (a *auth) ValidateUsers(users []*user.User) []error {
+	errs := make([]error, len(users))
+	for i, u := range users {
+		errs[i] = a.ValidateUser(u)
+	}
+	return errs
+}
+
+// trimUser trims the whitespace around u's email and username, which
+// would otherwise make them look like duplicates of other users'.
+func trimUser(u *user.User) {
+	u.Email = strings.TrimSpace(u.Email)
+	u.Username = strings.TrimSpace(u.Username)
+}
+
+// validateUsername checks username's characters and length. Whitespace
+// is never allowed, even by WithUsernameChars.
+func (a *auth) validateUsername(username string) error {
+	for _, r := range username {
+		if unicode.IsSpace(r) || !a.usernameChar(r) {
+			if !a.customUsernameChars {
+				return ErrInvalidUsername
+			}
+			return &ruleError{fmt.Sprintf(
+				"error: username is invalid (can't contain %q)", r), ErrInvalidUsername}
 		}
 	}
-	return true
+	if len(username) < a.usernameMinLen || len(username) > a.usernameMaxLen {
+		if a.usernameMinLen == defaultMinUsernameLen && a.usernameMaxLen == defaultMaxUsernameLen {
+			return ErrInvalidUsernameLength
+		}
+		return &ruleError{fmt.Sprintf(
+			"error: username must be between %d - %d characters",
+			a.usernameMinLen, a.usernameMaxLen), ErrInvalidUsernameLength}
+	}
+	return nil
+}
+
+// validatePasswordLength checks that password's length is within the
+// configured range. The errors wrap ErrPasswordTooShort and
+// ErrPasswordTooLong, but state the configured limit when it isn't the
+// default.
+func (a *auth) validatePasswordLength(password string) error {
+	if len(password) < a.passwordMinLen {
+		if a.passwordMinLen == defaultMinPasswordLen {
+			return ErrPasswordTooShort
+		}
+		return &ruleError{fmt.Sprintf(
+			"error: password is too short (must be at least %d characters)",
+			a.passwordMinLen), ErrPasswordTooShort}
+	}
+	if len(password) > a.passwordMaxLen {
+		if a.passwordMaxLen == maxPasswordLen {
+			return ErrPasswordTooLong
+		}
+		return &ruleError{fmt.Sprintf(
+			"error: password is too long (must be at most %d bytes)",
+			a.passwordMaxLen), ErrPasswordTooLong}
+	}
+	return nil
+}
+
+// ruleError is a validation error whose message states a configured
+// limit or rule, rather than the default one in err's message.
+type ruleError struct {
+	msg string
+	err error
+}
+
+func (e *ruleError) Error() string { return e.msg }
+
+func (e *ruleError) Unwrap() error { return e.err }
+
+// isAlphanumericRune checks whether r is an alphanumeric unicode
+// character.
+func isAlphanumericRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
 }
 
 func (a *auth) CreateUser(u *user.User) error {
+	trimUser(u)
+	if a.reserved(u.Username) != nil {
+		return datastore.ErrDuplicateUsername
+	}
+	return a.createUser(u)
+}
+
+func (a *auth) CreateUserWithReservation(u *user.User, token string) error {
+	trimUser(u)
+	res := a.reserved(u.Username)
+	if res == nil || res.token != token {
+		return ErrInvalidReservation
+	}
+	if err := a.createUser(u); err != nil {
+		return err
+	}
+	a.ReleaseUsername(token)
+	return nil
+}
+
+// NormalizeEmail trims the whitespace around email and lowercases it, so
+// differently cased versions of the same email are treated as one. It's
+// user.NormalizeEmail.
+func NormalizeEmail(email string) string {
+	return user.NormalizeEmail(email)
+}
+
+// CanonicalizeEmail returns the canonical form of email, which is the
+// same for addresses that deliver to the same inbox. It's
+// user.CanonicalizeEmail.
+func CanonicalizeEmail(email string) string {
+	return user.CanonicalizeEmail(email)
+}
+
+// createUser validates u, hashes u's password and then stores u.
+func (a *auth) createUser(u *user.User) error {
+	u.Email = NormalizeEmail(u.Email)
 	if err := a.ValidateUser(u); err != nil {
 		return err
 	}
-	hashedPassword, err := a.HashPassword(u.Password)
-	if err != nil {
+	if a.emailDomainChecker != nil {
+		if err := a.emailDomainChecker.Check(u.Email); err != nil {
+			return err
+		}
+	}
+	if a.canonicalizeEmails {
+		u.CanonicalEmail = CanonicalizeEmail(u.Email)
+	}
+	if u.Role == "" {
+		u.Role = user.RoleUser
+	}
+	if u.Status == "" {
+		u.Status = user.StatusActive
+	}
+	if a.precheckDuplicates {
+		if err := a.checkDuplicates(u); err != nil {
+			return err
+		}
+	}
+	if err := a.SetPassword(u, u.Password); err != nil {
 		return err
 	}
-	u.Password = string(hashedPassword)
 	return a.r.Create(u)
 }
 
+// checkDuplicates checks whether u's email or username is already taken
+// in u's tenant.
+func (a *auth) checkDuplicates(u *user.User) error {
+	_, err := a.r.GetByTenantEmail(u.TenantId, u.Email)
+	if err == nil {
+		return datastore.ErrDuplicateEmail
+	}
+	if !errors.Is(err, datastore.ErrUserNotFound) {
+		return err
+	}
+	_, err = a.r.GetByTenantUsername(u.TenantId, u.Username)
+	if err == nil {
+		return datastore.ErrDuplicateUsername
+	}
+	if !errors.Is(err, datastore.ErrUserNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (a *auth) ReserveUsername(username string, ttl time.Duration) (string, error) {
+	if err := a.validateUsername(username); err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Make sure the username isn't taken or already reserved.
+	_, err := a.r.GetByUsername(username)
+	if err == nil {
+		return "", datastore.ErrDuplicateUsername
+	}
+	if !errors.Is(err, datastore.ErrUserNotFound) {
+		return "", err
+	}
+	if res, found := a.reservations[username]; found && a.now().Before(res.expires) {
+		return "", datastore.ErrDuplicateUsername
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	a.reservations[username] = &reservation{
+		username: username,
+		token:    token,
+		expires:  a.now().Add(ttl),
+	}
+	return token, nil
+}
+
+func (a *auth) ReleaseUsername(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for username, res := range a.reservations {
+		if res.token == token {
+			delete(a.reservations, username)
+			return
+		}
+	}
+}
+
+// reserved returns the reservation for username, or nil if username
+// isn't reserved. Expired reservations are removed.
+func (a *auth) reserved(username string) *reservation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res, found := a.reservations[username]
+	if !found {
+		return nil
+	}
+	if !a.now().Before(res.expires) {
+		delete(a.reservations, username)
+		return nil
+	}
+	return res
+}
+
+// generateToken generates a random, url safe base64 encoded token.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *auth) CreateResetToken(email string) (string, error) {
+	u, err := a.r.GetByEmail(NormalizeEmail(email))
+	if err != nil {
+		return "", err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	// Remove expired tokens and u's previous tokens.
+	for hash, rt := range a.resetTokens {
+		if rt.userId == u.Id || !a.now().Before(rt.expires) {
+			delete(a.resetTokens, hash)
+		}
+	}
+	a.resetTokens[hashToken(token)] = &resetToken{
+		userId:  u.Id,
+		expires: a.now().Add(a.resetTokenTTL),
+	}
+	a.mu.Unlock()
+
+	if err := a.sendResetLink(u.Email, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *auth) RequestPasswordReset(email string) (string, error) {
+	email = NormalizeEmail(email)
+
+	a.mu.Lock()
+	now := a.now()
+	// Remove expired requests.
+	for e, until := range a.resetRequests {
+		if !now.Before(until) {
+			delete(a.resetRequests, e)
+		}
+	}
+	if until, found := a.resetRequests[email]; found {
+		a.mu.Unlock()
+		return "", &ResetPendingError{Wait: until.Sub(now)}
+	}
+	a.resetRequests[email] = now.Add(a.resetTokenTTL)
+	a.mu.Unlock()
+
+	token, err := a.CreateResetToken(email)
+	if err != nil && !errors.Is(err, datastore.ErrUserNotFound) {
+		// Let the request be retried.
+		a.mu.Lock()
+		delete(a.resetRequests, email)
+		a.mu.Unlock()
+	}
+	return token, err
+}
+
+func (a *auth) ResetPassword(token, newPassword string) error {
+	if newPassword == "" {
+		return invalid("password", ErrEmptyRequiredField)
+	}
+	if err := a.validatePasswordLength(newPassword); err != nil {
+		return invalid("password", err)
+	}
+	if a.passwordPolicy != nil {
+		if err := a.passwordPolicy.check(newPassword); err != nil {
+			return invalid("password", err)
+		}
+	}
+
+	// Use up the token if it's expired.
+	a.mu.Lock()
+	hash := hashToken(token)
+	rt, found := a.resetTokens[hash]
+	expired := found && !a.now().Before(rt.expires)
+	if expired {
+		delete(a.resetTokens, hash)
+	}
+	a.mu.Unlock()
+
+	if !found {
+		return ErrInvalidToken
+	}
+	if expired {
+		return ErrTokenExpired
+	}
+
+	u, err := a.r.Get(rt.userId)
+	if err != nil {
+		return err
+	}
+	// The password can't be the user's email or username either, which
+	// can only be checked once they've been looked up.
+	if err := a.validatePassword(u, newPassword); err != nil {
+		return invalid("password", err)
+	}
+
+	// Use up the token, unless a concurrent reset already has.
+	a.mu.Lock()
+	if a.resetTokens[hash] != rt {
+		a.mu.Unlock()
+		return ErrInvalidToken
+	}
+	delete(a.resetTokens, hash)
+	a.mu.Unlock()
+
+	if err := a.SetPassword(u, newPassword); err != nil {
+		return err
+	}
+	// Resetting the password also unlocks the user's account.
+	u.FailedAttempts = 0
+	u.LockedUntil = nil
+	// And logs the user out everywhere, in case someone else had access.
+	u.SessionVersion++
+	if err := a.r.Update(u); err != nil {
+		return err
+	}
+
+	// Another reset can be requested now that this one's been used.
+	a.mu.Lock()
+	delete(a.resetRequests, NormalizeEmail(u.Email))
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *auth) ChangePassword(userId int64, oldPassword, newPassword string) error {
+	u, err := a.r.Get(userId)
+	if err != nil {
+		return err
+	}
+	if err := a.CompareHashAndPassword(u.Password, oldPassword); err != nil {
+		return err
+	}
+	if newPassword == "" {
+		return invalid("password", ErrEmptyRequiredField)
+	}
+	if err := a.validatePassword(u, newPassword); err != nil {
+		return invalid("password", err)
+	}
+
+	if err := a.SetPassword(u, newPassword); err != nil {
+		return err
+	}
+	// Log the user out of their other sessions, in case someone else had
+	// access. The caller can refresh the current one.
+	u.SessionVersion++
+	return a.r.Update(u)
+}
+
+func (a *auth) HasPendingReset(userId int64) (bool, time.Time, error) {
+	// Make sure the user exists.
+	if _, err := a.r.Get(userId); err != nil {
+		return false, time.Time{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Users only have one reset token at a time.
+	for _, rt := range a.resetTokens {
+		if rt.userId == userId && a.now().Before(rt.expires) {
+			return true, rt.expires, nil
+		}
+	}
+	return false, time.Time{}, nil
+}
+
+func (a *auth) RecordLogin(userId int64) error {
+	return a.r.SetLastLogin(userId, a.now())
+}
+
+func (a *auth) InvalidateAllSessions(userId int64) error {
+	u, err := a.r.Get(userId)
+	if err != nil {
+		return err
+	}
+	u.SessionVersion++
+	return a.r.Update(u)
+}
+
+func (a *auth) GenerateVerificationToken(userId int64) (string, error) {
+	// Make sure the user exists.
+	u, err := a.r.Get(userId)
+	if err != nil {
+		return "", err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	// Remove expired tokens.
+	for hash, vt := range a.verificationTokens {
+		if !a.now().Before(vt.expires) {
+			delete(a.verificationTokens, hash)
+		}
+	}
+	a.verificationTokens[hashToken(token)] = &verificationToken{
+		userId:  u.Id,
+		email:   u.Email,
+		expires: a.now().Add(a.verificationTokenTTL),
+	}
+	a.mu.Unlock()
+
+	if err := a.sendVerificationLink(u.Email, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *auth) VerifyEmail(token string) error {
+	a.mu.Lock()
+	hash := hashToken(token)
+	vt, found := a.verificationTokens[hash]
+	delete(a.verificationTokens, hash)
+	a.mu.Unlock()
+
+	if !found {
+		return ErrInvalidToken
+	}
+	if !a.now().Before(vt.expires) {
+		return ErrTokenExpired
+	}
+
+	u, err := a.r.Get(vt.userId)
+	if err != nil {
+		return err
+	}
+	// The token only verifies the email it was sent to.
+	if u.Email != vt.email {
+		return ErrInvalidToken
+	}
+	u.EmailVerified = true
+	return a.r.Update(u)
+}
+
 func (a *auth) AuthenticateUser(email, password string) (*user.User, error) {
-	u, err := a.r.GetByEmail(email)
+	u, err := a.r.GetByEmail(NormalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	return a.authenticate(u, password)
+}
+
+func (a *auth) AuthenticateUserByIdentifier(identifier, password string) (*user.User, error) {
+	identifier = strings.TrimSpace(identifier)
+	if strings.Contains(identifier, "@") {
+		identifier = NormalizeEmail(identifier)
+	}
+	u, err := a.r.GetByEmailOrUsername(identifier)
+	if err != nil {
+		return nil, err
+	}
+	return a.authenticate(u, password)
+}
+
+func (a *auth) AuthenticateTenantUser(tenantId, email, password string) (*user.User, error) {
+	u, err := a.r.GetByTenantEmail(tenantId, NormalizeEmail(email))
 	if err != nil {
 		return nil, err
 	}
-	err = a.CompareHashAndPassword(u.Password, password)
+	return a.authenticate(u, password)
+}
+
+// authenticate checks password against u's password, as described by
+// AuthenticateUser.
+func (a *auth) authenticate(u *user.User, password string) (*user.User, error) {
+	if a.lockoutThreshold > 0 && a.isLocked(u) {
+		return nil, ErrAccountLocked
+	}
+	err := a.CompareHashAndPassword(u.Password, password)
+	if errors.Is(err, ErrWrongPassword) && a.lockoutThreshold > 0 {
+		if err := a.recordFailedAttempt(u); err != nil {
+			return nil, err
+		}
+		return nil, ErrWrongPassword
+	}
 	if err != nil {
 		return nil, err
 	}
+	// Reset the user's failed attempts after a successful login.
+	if u.FailedAttempts != 0 || u.LockedUntil != nil {
+		if err := a.r.ResetFailedLogins(u.Id); err != nil {
+			return nil, err
+		}
+		u.FailedAttempts = 0
+		u.LockedUntil = nil
+	}
+	// Upgrade the user's hash if it was made with outdated settings,
+	// while the plaintext password is known.
+	if r, ok := a.hasher.(Rehasher); ok && r.NeedsRehash(u.Password) {
+		hash, err := a.hasher.Hash(a.peppered(password))
+		if err != nil {
+			return nil, err
+		}
+		if err := a.r.Patch(u.Id, datastore.UserUpdate{Password: &hash}); err != nil {
+			return nil, err
+		}
+		u.Password = hash
+	}
+	if u.Status == user.StatusDisabled {
+		return nil, ErrAccountDisabled
+	}
+	if a.requireVerifiedEmail && !u.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	if u.TOTPEnabled {
+		return u, ErrTOTPRequired
+	}
 	return u, nil
 }
 
-func (a *auth) CompareHashAndPassword(hash, password string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err == nil {
-		return nil
+func (a *auth) MustChangePassword(u *user.User) bool {
+	if a.passwordMaxAge <= 0 {
+		return false
+	}
+	// A password that was set at an unknown time is treated as expired.
+	if u.PasswordChangedAt == nil {
+		return true
 	}
-	// If the compared passwords don't match, return an ErrWrongPassword.
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return ErrWrongPassword
+	return a.now().Sub(*u.PasswordChangedAt) > a.passwordMaxAge
+}
+
+// isLocked checks whether u's account is currently locked.
+func (a *auth) isLocked(u *user.User) bool {
+	return u.LockedUntil != nil && a.now().Before(*u.LockedUntil)
+}
+
+// recordFailedAttempt increments u's failed login attempts and locks
+// u's account once the lockout threshold has been reached.
+func (a *auth) recordFailedAttempt(u *user.User) error {
+	// The repository counts the attempt itself, so that concurrent
+	// attempts aren't lost. It also starts counting again if a previous
+	// lockout has expired or the first attempt is outside the window.
+	now := a.now()
+	var windowStart time.Time
+	if a.lockoutWindow > 0 {
+		windowStart = now.Add(-a.lockoutWindow)
 	}
-	return err
+	return a.r.RecordFailedLogin(u.Id, now, windowStart, a.lockoutThreshold,
+		now.Add(a.lockoutDuration))
+}
+
+// peppered returns password HMACed with the pepper, if there is one.
+// The MAC is base64 encoded, since bcrypt only uses the first 72 bytes.
+func (a *auth) peppered(password string) string {
+	if a.pepper == nil {
+		return password
+	}
+	mac := hmac.New(sha256.New, a.pepper)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *auth) CompareHashAndPassword(hash, password string) error {
+	return a.hasherFor(hash).Compare(hash, a.peppered(password))
 }
 
 func (a *auth) HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword(
-		[]byte(password), bcrypt.DefaultCost,
-	)
-	return string(hashedPassword), err
+	if len(password) > maxPasswordLen {
+		return "", ErrPasswordTooLong
+	}
+	return a.hasher.Hash(a.peppered(password))
+}
+
+func (a *auth) SetPassword(u *user.User, password string) error {
+	hashedPassword, err := a.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.Password = hashedPassword
+	now := a.now()
+	u.PasswordChangedAt = &now
+	return nil
 }
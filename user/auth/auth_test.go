@@ -1,11 +1,19 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/radovskyb/services/user"
 	"github.com/radovskyb/services/user/datastore"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -24,6 +32,45 @@ func TestIsValidationErr(t *testing.T) {
 	if isValErr {
 		t.Error("expected err to not be a validation error")
 	}
+
+	// Wrapped validation errors are still validation errors.
+	isValErr = a.IsValidationErr(fmt.Errorf("creating %s: %w", testEmail, ErrInvalidEmail))
+	if !isValErr {
+		t.Error("expected wrapped err to be a validation error")
+	}
+}
+
+func TestIsValidationErrFunc(t *testing.T) {
+	a := NewAuth(nil)
+
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{ErrEmptyRequiredField, true},
+		{ErrInvalidUsernameLength, true},
+		{ErrInvalidEmail, true},
+		{ErrPasswordTooShort, true},
+		{ErrInvalidUsername, true},
+		{ErrPasswordEqualsIdentity, true},
+		{ErrPasswordTooLong, true},
+		{ErrWeakPassword, true},
+		{ErrEmailDomainUndeliverable, true},
+		{invalid("email", ErrInvalidEmail), true},
+		{fmt.Errorf("creating %s: %w", testEmail, invalid("email", ErrInvalidEmail)), true},
+		{ErrWrongPassword, false},
+		{datastore.ErrDuplicateUsername, false},
+		{nil, false},
+	}
+	for _, tc := range testCases {
+		// The package function and the method always agree.
+		if got := IsValidationErr(tc.err); got != tc.want {
+			t.Errorf("IsValidationErr(%v): expected %t, got %t", tc.err, tc.want, got)
+		}
+		if got := a.IsValidationErr(tc.err); got != tc.want {
+			t.Errorf("a.IsValidationErr(%v): expected %t, got %t", tc.err, tc.want, got)
+		}
+	}
 }
 
 func TestValidateUser(t *testing.T) {
@@ -39,7 +86,7 @@ func TestValidateUser(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		err := auth.ValidateUser(tc.u)
-		if err != ErrEmptyRequiredField {
+		if !errors.Is(err, ErrEmptyRequiredField) {
 			t.Errorf("expected err to be ErrEmptyRequiredField, got %v", err)
 		}
 	}
@@ -74,7 +121,7 @@ func TestValidateUser(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		err = auth.ValidateUser(tc.u)
-		if err != ErrInvalidEmail {
+		if !errors.Is(err, ErrInvalidEmail) {
 			t.Errorf("expected err to be ErrInvalidEmail, got %v", err)
 		}
 	}
@@ -94,7 +141,7 @@ func TestValidateUser(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		err = auth.ValidateUser(tc.u)
-		if err != ErrInvalidUsername {
+		if !errors.Is(err, ErrInvalidUsername) {
 			t.Errorf("expected err to be ErrInvalidUsername, got %v", err)
 		}
 	}
@@ -116,7 +163,7 @@ func TestValidateUser(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		err = auth.ValidateUser(tc.u)
-		if err != ErrInvalidUsernameLength {
+		if !errors.Is(err, ErrInvalidUsernameLength) {
 			t.Errorf("expected err to be ErrInvalidUsernameLength, got %v", err)
 		}
 	}
@@ -128,11 +175,69 @@ func TestValidateUser(t *testing.T) {
 		Password: "12345",
 	}
 	err = auth.ValidateUser(u)
-	if err != ErrPasswordTooShort {
+	if !errors.Is(err, ErrPasswordTooShort) {
 		t.Errorf("expected err to be ErrInvalidPasswordLength, got %v", err)
 	}
 }
 
+func TestValidateUserUpdate(t *testing.T) {
+	auth := NewAuth(datastore.NewMockRepo())
+
+	// A blank password is allowed for an update.
+	err := auth.ValidateUserUpdate(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+	})
+	if err != nil {
+		t.Errorf("expected err to be nil, got %v", err)
+	}
+
+	// But the email and username are still required.
+	err = auth.ValidateUserUpdate(&user.User{Email: testEmail})
+	if !errors.Is(err, ErrEmptyRequiredField) {
+		t.Errorf("expected err to be ErrEmptyRequiredField, got %v", err)
+	}
+
+	// A password that's set must still be valid.
+	err = auth.ValidateUserUpdate(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: "12345",
+	})
+	if !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("expected err to be ErrPasswordTooShort, got %v", err)
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	auth := NewAuth(datastore.NewMockRepo())
+
+	users := []*user.User{
+		{Email: testEmail, Username: testUsername, Password: testPassword},
+		{Email: "invalid", Username: testUsername, Password: testPassword},
+		{Email: testEmail, Username: testUsername},
+		{Email: "example_user@gmail.com", Username: "exampleuser", Password: testPassword},
+		{Email: testEmail, Username: testUsername, Password: "12345"},
+	}
+	expected := []error{
+		nil,
+		ErrInvalidEmail,
+		ErrEmptyRequiredField,
+		nil,
+		ErrPasswordTooShort,
+	}
+
+	errs := auth.ValidateUsers(users)
+	if len(errs) != len(users) {
+		t.Fatalf("expected %d errors, got %d", len(users), len(errs))
+	}
+	for i, err := range errs {
+		if !errors.Is(err, expected[i]) {
+			t.Errorf("user %d: expected err to be %v, got %v", i, expected[i], err)
+		}
+	}
+}
+
 func TestCreateUser(t *testing.T) {
 	repo := datastore.NewMockRepo()
 	auth := NewAuth(repo)
@@ -167,6 +272,48 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestCreateUserNormalizesEmail(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	auth := NewAuth(repo)
+
+	err := auth.CreateUser(&user.User{
+		Email:    " Radovskyb@Gmail.com ",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The email should be stored trimmed and lowercased.
+	u, err := repo.GetByUsername(testUsername)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != testEmail {
+		t.Errorf("expected email to be %s, got %s", testEmail, u.Email)
+	}
+
+	// A differently cased version of the email is a duplicate.
+	err = auth.CreateUser(&user.User{
+		Email:    "RADOVSKYB@gmail.com",
+		Username: "exampleuser",
+		Password: testPassword,
+	})
+	if err != datastore.ErrDuplicateEmail {
+		t.Errorf("expected err to be ErrDuplicateEmail, got %v", err)
+	}
+
+	// And can be used to authenticate.
+	u, err = auth.AuthenticateUser(" RadovskyB@gmail.COM", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != testUsername {
+		t.Errorf("expected username to be %s, got %s", testUsername, u.Username)
+	}
+}
+
 func TestAuthenticateUser(t *testing.T) {
 	repo := datastore.NewMockRepo()
 	auth := NewAuth(repo)
@@ -195,7 +342,7 @@ func TestAuthenticateUser(t *testing.T) {
 	// Try to authenticate a user with an email that doesn't exist.
 	u, err = auth.AuthenticateUser("notfound@example.com", testPassword)
 	if err != datastore.ErrUserNotFound {
-		t.Error("expected err to be ErrUserNotFound, got %v", err)
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
 	}
 
 	// Try to authenticate a user with an incorrect password.
@@ -225,3 +372,1908 @@ func TestAuthenticateUser(t *testing.T) {
 		t.Errorf("expected err not to be ErrWrongPassword")
 	}
 }
+
+func TestValidateUserEmailIsAnchored(t *testing.T) {
+	auth := NewAuth(datastore.NewMockRepo())
+
+	testCases := []struct {
+		email string
+		err   error
+	}{
+		{"a@a.com", nil},
+		{"first.last+tag@mail.example.com", nil},
+		{"hello a@a.com world", ErrInvalidEmail},
+		// Whitespace around an email is trimmed rather than rejected.
+		{" a@a.com", nil},
+		{"a@a.com ", nil},
+		{"a@a.com\n", nil},
+		{"a@a.com world", ErrInvalidEmail},
+		{"a@a.com!", ErrInvalidEmail},
+		{"a@a.com/evil", ErrInvalidEmail},
+		{"a@a.comevilevil", ErrInvalidEmail},
+		{"<a@a.com>", ErrInvalidEmail},
+	}
+	for _, tc := range testCases {
+		err := auth.ValidateUser(&user.User{
+			Email:    tc.email,
+			Username: testUsername,
+			Password: testPassword,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("email %q: expected err to be %v, got %v", tc.email, tc.err, err)
+		}
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo, WithLockout(3, time.Hour, 15*time.Minute))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A successful login resets the failed attempts.
+	for i := 0; i < 2; i++ {
+		_, err = a.AuthenticateUser(testEmail, "wrongpassword")
+		if err != ErrWrongPassword {
+			t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+		}
+	}
+	if _, err = a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	u, err := repo.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FailedAttempts != 0 {
+		t.Errorf("expected failed attempts to be 0, got %d", u.FailedAttempts)
+	}
+
+	// Fail enough times to lock the account.
+	for i := 0; i < 3; i++ {
+		_, err = a.AuthenticateUser(testEmail, "wrongpassword")
+		if err != ErrWrongPassword {
+			t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+		}
+	}
+
+	// Even the correct password should now be rejected.
+	_, err = a.AuthenticateUser(testEmail, testPassword)
+	if err != ErrAccountLocked {
+		t.Errorf("expected err to be ErrAccountLocked, got %v", err)
+	}
+
+	// Move the clock past the lockout duration.
+	now = now.Add(16 * time.Minute)
+
+	if _, err = a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Errorf("expected user to be unlocked, got %v", err)
+	}
+	u, err = repo.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FailedAttempts != 0 || u.LockedUntil != nil {
+		t.Errorf("expected lockout to be reset, got %d attempts and locked until %v",
+			u.FailedAttempts, u.LockedUntil)
+	}
+
+	// Failed attempts spread out beyond the window don't lock the account.
+	for i := 0; i < 6; i++ {
+		_, err = a.AuthenticateUser(testEmail, "wrongpassword")
+		if err != ErrWrongPassword {
+			t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+		}
+		now = now.Add(40 * time.Minute)
+	}
+	if _, err = a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Errorf("expected user not to be locked, got %v", err)
+	}
+}
+
+func TestAccountLockoutConcurrent(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo, WithLockout(100, time.Hour, 15*time.Minute),
+		WithHasher(NewBcryptHasher(bcrypt.MinCost)))
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent failed attempts are all counted.
+	const attempts = 20
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.AuthenticateUser(testEmail, "wrongpassword"); err != ErrWrongPassword {
+				t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	u, err := repo.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FailedAttempts != attempts {
+		t.Errorf("expected %d failed attempts, got %d", attempts, u.FailedAttempts)
+	}
+}
+
+func TestAccountLockoutDisabled(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = a.AuthenticateUser(testEmail, "wrongpassword")
+		if err != ErrWrongPassword {
+			t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+		}
+	}
+	if _, err = a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Errorf("expected user to authenticate, got %v", err)
+	}
+}
+
+func TestReserveUsername(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo)
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	token, err := a.ReserveUsername(testUsername, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" {
+		t.Fatal("expected token to not be blank")
+	}
+
+	// The username can't be reserved again while reserved.
+	_, err = a.ReserveUsername(testUsername, time.Minute)
+	if err != datastore.ErrDuplicateUsername {
+		t.Errorf("expected err to be ErrDuplicateUsername, got %v", err)
+	}
+
+	// Or be used to create a different user.
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	err = a.CreateUser(u)
+	if err != datastore.ErrDuplicateUsername {
+		t.Errorf("expected err to be ErrDuplicateUsername, got %v", err)
+	}
+
+	// An invalid token can't be used to create the user.
+	err = a.CreateUserWithReservation(u, "invalid")
+	if err != ErrInvalidReservation {
+		t.Errorf("expected err to be ErrInvalidReservation, got %v", err)
+	}
+
+	// Create the user with the reservation.
+	err = a.CreateUserWithReservation(u, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetByUsername(testUsername); err != nil {
+		t.Error(err)
+	}
+
+	// Now that the username exists it can't be reserved.
+	_, err = a.ReserveUsername(testUsername, time.Minute)
+	if err != datastore.ErrDuplicateUsername {
+		t.Errorf("expected err to be ErrDuplicateUsername, got %v", err)
+	}
+
+	// Invalid usernames can't be reserved.
+	_, err = a.ReserveUsername("a-b-c", time.Minute)
+	if err != ErrInvalidUsername {
+		t.Errorf("expected err to be ErrInvalidUsername, got %v", err)
+	}
+}
+
+func TestReserveUsernameExpiry(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	token, err := a.ReserveUsername(testUsername, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the clock past the reservation's ttl.
+	now = now.Add(2 * time.Minute)
+
+	// The expired reservation can't be used to create the user.
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	err = a.CreateUserWithReservation(u, token)
+	if err != ErrInvalidReservation {
+		t.Errorf("expected err to be ErrInvalidReservation, got %v", err)
+	}
+
+	// But the username can be reserved again.
+	if _, err := a.ReserveUsername(testUsername, time.Minute); err != nil {
+		t.Errorf("expected username to be reserved, got %v", err)
+	}
+}
+
+func TestReleaseUsername(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	token, err := a.ReserveUsername(testUsername, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.ReleaseUsername(token)
+
+	// The username can now be used by anyone.
+	err = a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Errorf("expected user to be created, got %v", err)
+	}
+}
+
+// fakeHashCostGauge is a HashCostGauge that records the costs set.
+type fakeHashCostGauge struct {
+	mu    sync.Mutex
+	costs map[int]int
+}
+
+func (g *fakeHashCostGauge) SetHashCost(cost, users int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.costs[cost] = users
+}
+
+func (g *fakeHashCostGauge) get(cost int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	users, found := g.costs[cost]
+	return users, found
+}
+
+func TestExportHashCosts(t *testing.T) {
+	repo := datastore.NewMockRepo()
+
+	// Create users with passwords hashed with different costs.
+	costs := []int{bcrypt.MinCost, bcrypt.MinCost, bcrypt.MinCost + 1}
+	for i, cost := range costs {
+		hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.Create(&user.User{
+			Email:    string(rune('a'+i)) + testEmail,
+			Username: string(rune('a'+i)) + testUsername,
+			Password: string(hash),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g := &fakeHashCostGauge{costs: make(map[int]int)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ExportHashCosts(ctx, repo, g, 10*time.Millisecond)
+	}()
+
+	// Wait for the gauges to be populated.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, found := g.get(bcrypt.MinCost + 1)
+		if found || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if users, _ := g.get(bcrypt.MinCost); users != 2 {
+		t.Errorf("expected 2 users with cost %d, got %d", bcrypt.MinCost, users)
+	}
+	if users, _ := g.get(bcrypt.MinCost + 1); users != 1 {
+		t.Errorf("expected 1 user with cost %d, got %d", bcrypt.MinCost+1, users)
+	}
+
+	// Delete the only user with the higher cost, which should set
+	// its gauge back to 0.
+	if err := repo.Delete(3); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(time.Second)
+	for {
+		users, _ := g.get(bcrypt.MinCost + 1)
+		if users == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if users, _ := g.get(bcrypt.MinCost + 1); users != 0 {
+		t.Errorf("expected 0 users with cost %d, got %d", bcrypt.MinCost+1, users)
+	}
+
+	// Stop the exporter.
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected err to be context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected exporter to stop after context was cancelled")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo)
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.CreateResetToken("unknown@gmail.com"); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+
+	// Creating a new token invalidates the previous one.
+	oldToken, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ResetPassword(oldToken, "newpassword"); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+
+	// An invalid password doesn't use up the token.
+	if err := a.ResetPassword(token, "short"); !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("expected err to be ErrPasswordTooShort, got %v", err)
+	}
+
+	// Neither does a password that equals the user's username.
+	err = a.ResetPassword(token, testUsername)
+	if !errors.Is(err, ErrPasswordEqualsIdentity) || !a.IsValidationErr(err) {
+		t.Errorf("expected err to be ErrPasswordEqualsIdentity, got %v", err)
+	}
+
+	if err := a.ResetPassword(token, "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, "newpassword"); err != nil {
+		t.Errorf("expected user to authenticate with new password, got %v", err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != ErrWrongPassword {
+		t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+	}
+
+	// The token can only be used once.
+	if err := a.ResetPassword(token, "anotherpassword"); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestResetPasswordExpiry(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithResetTokenTTL(30*time.Minute))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the clock past the token's ttl.
+	now = now.Add(31 * time.Minute)
+
+	if err := a.ResetPassword(token, "newpassword"); err != ErrTokenExpired {
+		t.Errorf("expected err to be ErrTokenExpired, got %v", err)
+	}
+	// An expired token is invalidated.
+	if err := a.ResetPassword(token, "newpassword"); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Errorf("expected password to be unchanged, got %v", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo, WithEmailVerification())
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GenerateVerificationToken(u.Id + 1); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+
+	token, err := a.GenerateVerificationToken(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unverified users can't authenticate.
+	_, err = a.AuthenticateUser(testEmail, testPassword)
+	if err != ErrEmailNotVerified {
+		t.Errorf("expected err to be ErrEmailNotVerified, got %v", err)
+	}
+
+	if err := a.VerifyEmail("invalidtoken"); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+	if err := a.VerifyEmail(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Errorf("expected verified user to authenticate, got %v", err)
+	}
+
+	// The token can only be used once.
+	if err := a.VerifyEmail(token); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestVerifyEmailExpiry(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo, WithVerificationTokenTTL(30*time.Minute))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.GenerateVerificationToken(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the clock past the token's ttl.
+	now = now.Add(31 * time.Minute)
+
+	if err := a.VerifyEmail(token); err != ErrTokenExpired {
+		t.Errorf("expected err to be ErrTokenExpired, got %v", err)
+	}
+	// An expired token is invalidated.
+	if err := a.VerifyEmail(token); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+
+	// Expired tokens are pruned when new ones are generated.
+	if _, err := a.GenerateVerificationToken(u.Id); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(31 * time.Minute)
+	if _, err := a.GenerateVerificationToken(u.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.(*auth).verificationTokens); n != 1 {
+		t.Errorf("expected 1 verification token, got %d", n)
+	}
+}
+
+func TestVerifyEmailChanged(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo)
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.GenerateVerificationToken(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token sent to the old email doesn't verify the new one.
+	if err := repo.UpdateEmail(u.Id, "other@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.VerifyEmail(token); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+	u, err = repo.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.EmailVerified {
+		t.Error("expected new email not to be verified")
+	}
+}
+
+// fakeMailer is a Mailer that captures the emails it's sent.
+type fakeMailer struct {
+	to, subject, body string
+	err               error
+}
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return m.err
+}
+
+func TestMailer(t *testing.T) {
+	m := new(fakeMailer)
+	a := NewAuth(datastore.NewMockRepo(), WithMailer(m,
+		"https://example.com/reset?lang=en", "https://example.com/verify"))
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := "https://example.com/reset?lang=en&token=" + url.QueryEscape(token)
+	if m.to != testEmail || m.subject != resetSubject || !strings.Contains(m.body, link) {
+		t.Errorf("expected reset email to %s with %s, got %q to %s: %q",
+			testEmail, link, m.subject, m.to, m.body)
+	}
+
+	token, err = a.GenerateVerificationToken(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link = "https://example.com/verify?token=" + url.QueryEscape(token)
+	if m.to != testEmail || m.subject != verificationSubject || !strings.Contains(m.body, link) {
+		t.Errorf("expected verification email to %s with %s, got %q to %s: %q",
+			testEmail, link, m.subject, m.to, m.body)
+	}
+
+	// Errors sending email are returned.
+	m.err = errors.New("error: mail server is down")
+	if _, err := a.CreateResetToken(testEmail); err != m.err {
+		t.Errorf("expected err to be %v, got %v", m.err, err)
+	}
+	if _, err := a.GenerateVerificationToken(u.Id); err != m.err {
+		t.Errorf("expected err to be %v, got %v", m.err, err)
+	}
+}
+
+func TestCanonicalizeEmail(t *testing.T) {
+	testCases := []struct {
+		email, canonical string
+	}{
+		{"a@gmail.com", "a@gmail.com"},
+		{" A+1@Gmail.com ", "a@gmail.com"},
+		{"a.b.c+tag+more@gmail.com", "abc@gmail.com"},
+		{"a.b@googlemail.com", "ab@gmail.com"},
+		{"a@gmail.com.", "a@gmail.com"},
+		{"a.b+tag@example.com", "a.b@example.com"},
+		{"invalid", "invalid"},
+	}
+	for _, tc := range testCases {
+		if canonical := CanonicalizeEmail(tc.email); canonical != tc.canonical {
+			t.Errorf("expected %q to canonicalize to %q, got %q",
+				tc.email, tc.canonical, canonical)
+		}
+	}
+}
+
+func TestCreateUserWithEmailCanonicalization(t *testing.T) {
+	testCases := []struct {
+		opts []Option
+		err  error
+	}{
+		{nil, nil},
+		{[]Option{WithEmailCanonicalization()}, datastore.ErrDuplicateEmail},
+	}
+	for _, tc := range testCases {
+		repo := datastore.NewMockRepo()
+		a := NewAuth(repo, tc.opts...)
+
+		err := a.CreateUser(&user.User{
+			Email:    "a+1@gmail.com",
+			Username: "user1",
+			Password: testPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = a.CreateUser(&user.User{
+			Email:    "a@gmail.com",
+			Username: "user2",
+			Password: testPassword,
+		})
+		if err != tc.err {
+			t.Errorf("expected err to be %v, got %v", tc.err, err)
+		}
+
+		// The original email is kept for delivery.
+		u, err := repo.GetByUsername("user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Email != "a+1@gmail.com" {
+			t.Errorf("expected email to be a+1@gmail.com, got %s", u.Email)
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	r := datastore.NewMockRepo()
+	a := NewAuth(r)
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		oldPassword, newPassword string
+		err                      error
+	}{
+		{"wrongpassword", "newpassword", ErrWrongPassword},
+		{testPassword, "", ErrEmptyRequiredField},
+		{testPassword, "short", ErrPasswordTooShort},
+		{testPassword, testUsername, ErrPasswordEqualsIdentity},
+		{testPassword, "newpassword", nil},
+	}
+	for _, tc := range testCases {
+		err := a.ChangePassword(u.Id, tc.oldPassword, tc.newPassword)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%q to %q: expected err to be %v, got %v",
+				tc.oldPassword, tc.newPassword, tc.err, err)
+		}
+	}
+
+	if _, err := a.AuthenticateUser(testEmail, "newpassword"); err != nil {
+		t.Errorf("expected user to authenticate with new password, got %v", err)
+	}
+	if got, err := r.Get(u.Id); err != nil || got.SessionVersion != u.SessionVersion+1 {
+		t.Errorf("expected session version to be incremented, got %+v, %v", got, err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != ErrWrongPassword {
+		t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+	}
+	if err := a.ChangePassword(u.Id+1, testPassword, "newpassword"); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestHasPendingReset(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithResetTokenTTL(30*time.Minute))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.HasPendingReset(u.Id + 1); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+
+	pending, _, err := a.HasPendingReset(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending {
+		t.Error("expected no reset to be pending")
+	}
+
+	// A fresh token is pending.
+	if _, err := a.CreateResetToken(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	pending, expires, err := a.HasPendingReset(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending {
+		t.Error("expected a reset to be pending")
+	}
+	if want := now.Add(30 * time.Minute); !expires.Equal(want) {
+		t.Errorf("expected reset to expire at %v, got %v", want, expires)
+	}
+
+	// An expired token isn't pending.
+	now = now.Add(31 * time.Minute)
+
+	pending, _, err = a.HasPendingReset(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending {
+		t.Error("expected expired reset not to be pending")
+	}
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithResetTokenTTL(30*time.Minute))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{testEmail, "unknown@gmail.com"} {
+		_, err := a.RequestPasswordReset(email)
+		if email == testEmail && err != nil {
+			t.Fatal(err)
+		}
+		if email != testEmail && err != datastore.ErrUserNotFound {
+			t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+		}
+
+		// Another reset can't be requested until the first expires,
+		// whether or not the email is registered.
+		now = now.Add(10 * time.Minute)
+		var pending *ResetPendingError
+		_, err = a.RequestPasswordReset(email)
+		if !errors.As(err, &pending) || !errors.Is(err, ErrResetPending) {
+			t.Fatalf("expected a *ResetPendingError, got %v", err)
+		}
+		if pending.Wait != 20*time.Minute {
+			t.Errorf("expected to wait 20m, got %v", pending.Wait)
+		}
+
+		now = now.Add(20 * time.Minute)
+	}
+
+	// Using a reset lets another be requested straight away.
+	token, err := a.RequestPasswordReset(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ResetPassword(token, "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RequestPasswordReset(testEmail); err != nil {
+		t.Errorf("expected another reset to be requested, got %v", err)
+	}
+}
+
+// fakeResolver is a Resolver that returns fixed records for any domain.
+type fakeResolver struct {
+	mxs   []*net.MX
+	hosts []string
+	err   error
+	block bool // Block until the lookup's context is done.
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if len(r.mxs) == 0 && r.err == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return r.mxs, r.err
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if len(r.hosts) == 0 && r.err == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return r.hosts, r.err
+}
+
+func TestEmailDomainChecker(t *testing.T) {
+	dnsErr := errors.New("dns is down")
+
+	testCases := []struct {
+		resolver *fakeResolver
+		err      error
+	}{
+		{&fakeResolver{mxs: []*net.MX{{Host: "mx.gmail.com.", Pref: 10}}}, nil},
+		{&fakeResolver{hosts: []string{"127.0.0.1"}}, nil},
+		{&fakeResolver{}, ErrEmailDomainUndeliverable},
+		{&fakeResolver{err: dnsErr}, dnsErr},
+		{&fakeResolver{block: true}, context.DeadlineExceeded},
+	}
+	for i, tc := range testCases {
+		c := NewEmailDomainChecker(tc.resolver, 10*time.Millisecond)
+		if err := c.Check(testEmail); err != tc.err {
+			t.Errorf("case %d: expected err to be %v, got %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestCreateUserWithEmailDomainChecker(t *testing.T) {
+	resolver := &fakeResolver{}
+	a := NewAuth(
+		datastore.NewMockRepo(),
+		WithEmailDomainChecker(NewEmailDomainChecker(resolver, time.Second)),
+	)
+
+	// The domain has no records.
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != ErrEmailDomainUndeliverable {
+		t.Errorf("expected err to be ErrEmailDomainUndeliverable, got %v", err)
+	}
+	if !a.IsValidationErr(err) {
+		t.Error("expected err to be a validation error")
+	}
+
+	// The domain has MX records.
+	resolver.mxs = []*net.MX{{Host: "mx.gmail.com.", Pref: 10}}
+	err = a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Errorf("expected user to be created, got %v", err)
+	}
+}
+
+func TestMustChangePassword(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	a := NewAuth(repo, WithPasswordMaxAge(90*24*time.Hour))
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh password doesn't need to be changed.
+	u, err := a.AuthenticateUser(testEmail, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MustChangePassword(u) {
+		t.Error("expected fresh password not to need changing")
+	}
+
+	// An aged password does.
+	now = now.Add(91 * 24 * time.Hour)
+
+	u, err = a.AuthenticateUser(testEmail, testPassword)
+	if err != nil {
+		t.Fatalf("expected login to succeed, got %v", err)
+	}
+	if !a.MustChangePassword(u) {
+		t.Error("expected aged password to need changing")
+	}
+
+	// Resetting the password makes it fresh again.
+	token, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ResetPassword(token, "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	u, err = repo.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MustChangePassword(u) {
+		t.Error("expected reset password not to need changing")
+	}
+
+	// As does setting it directly, stamped with the same clock.
+	now = now.Add(91 * 24 * time.Hour)
+	if err := a.SetPassword(u, "otherpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if u.PasswordChangedAt == nil || !u.PasswordChangedAt.Equal(now) {
+		t.Errorf("expected PasswordChangedAt to be %v, got %v", now, u.PasswordChangedAt)
+	}
+	if a.MustChangePassword(u) {
+		t.Error("expected set password not to need changing")
+	}
+
+	// Passwords don't expire by default.
+	if NewAuth(repo).MustChangePassword(&user.User{}) {
+		t.Error("expected password expiry to be disabled by default")
+	}
+}
+
+// countingHasher is a Hasher that counts how many passwords it hashes,
+// without actually hashing them.
+type countingHasher struct{ hashes int }
+
+func (h *countingHasher) Hash(password string) (string, error) {
+	h.hashes++
+	return password, nil
+}
+
+func (h *countingHasher) Compare(hash, password string) error {
+	if hash != password {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+func TestCreateUserWithDuplicatePrecheck(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithDuplicatePrecheck())
+
+	h := new(countingHasher)
+	a.(*auth).hasher = h
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.hashes != 1 {
+		t.Fatalf("expected password to be hashed once, got %d", h.hashes)
+	}
+
+	// Duplicate users are rejected without hashing their password.
+	testCases := []struct {
+		u   *user.User
+		err error
+	}{
+		{&user.User{Email: testEmail, Username: "another", Password: testPassword},
+			datastore.ErrDuplicateEmail},
+		{&user.User{Email: "another@gmail.com", Username: testUsername, Password: testPassword},
+			datastore.ErrDuplicateUsername},
+	}
+	for _, tc := range testCases {
+		if err := a.CreateUser(tc.u); err != tc.err {
+			t.Errorf("expected err to be %v, got %v", tc.err, err)
+		}
+	}
+	if h.hashes != 1 {
+		t.Errorf("expected password to be hashed once, got %d", h.hashes)
+	}
+}
+
+func TestUsernameRules(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(),
+		WithUsernameLength(2, 40),
+		WithUsernameChars(func(r rune) bool {
+			return r == '_' || isAlphanumericRune(r)
+		}),
+	)
+	defaults := NewAuth(datastore.NewMockRepo())
+
+	testCases := []struct {
+		username    string
+		err         error
+		defaultsErr error
+	}{
+		{"radovsky_b", nil, ErrInvalidUsername},
+		{"rb", nil, ErrInvalidUsernameLength},
+		{"a_username_that_is_longer_than_25", nil, ErrInvalidUsername},
+		{"ausernamethatislongerthan25", nil, ErrInvalidUsernameLength},
+		{"r", ErrInvalidUsernameLength, ErrInvalidUsernameLength},
+		{"radovsky-b", ErrInvalidUsername, ErrInvalidUsername},
+	}
+	for _, tc := range testCases {
+		u := &user.User{
+			Email:    testEmail,
+			Username: tc.username,
+			Password: testPassword,
+		}
+		if err := a.ValidateUser(u); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err to be %v, got %v", tc.username, tc.err, err)
+		}
+		if err := defaults.ValidateUser(u); !errors.Is(err, tc.defaultsErr) {
+			t.Errorf("%s: expected default err to be %v, got %v",
+				tc.username, tc.defaultsErr, err)
+		}
+	}
+
+	// The messages state the configured rules rather than the defaults.
+	u := &user.User{Email: testEmail, Username: "r", Password: testPassword}
+	want := "error: username must be between 2 - 40 characters"
+	if err := a.ValidateUser(u); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected err to contain %q, got %v", want, err)
+	}
+	u.Username = "radovsky-b"
+	want = `error: username is invalid (can't contain '-')`
+	if err := a.ValidateUser(u); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected err to contain %q, got %v", want, err)
+	}
+
+	// Reservations use the same rules.
+	if _, err := a.ReserveUsername("radovsky_b", time.Minute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPasswordEqualsIdentity(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	testCases := []struct {
+		password string
+		err      error
+	}{
+		{testUsername, ErrPasswordEqualsIdentity},
+		{"RadovskyB", ErrPasswordEqualsIdentity},
+		{testEmail, ErrPasswordEqualsIdentity},
+		{"RADOVSKYB@GMAIL.COM", ErrPasswordEqualsIdentity},
+		{testPassword, nil},
+	}
+	for _, tc := range testCases {
+		err := a.ValidateUser(&user.User{
+			Email:    testEmail,
+			Username: testUsername,
+			Password: tc.password,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err to be %v, got %v", tc.password, tc.err, err)
+		}
+	}
+	if !a.IsValidationErr(ErrPasswordEqualsIdentity) {
+		t.Error("expected ErrPasswordEqualsIdentity to be a validation error")
+	}
+}
+
+func TestPasswordTooLong(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	testCases := []struct {
+		password string
+		err      error
+	}{
+		{strings.Repeat("a", 72), nil},
+		{strings.Repeat("a", 73), ErrPasswordTooLong},
+		// 37 runes, but 74 bytes.
+		{strings.Repeat("é", 37), ErrPasswordTooLong},
+		{strings.Repeat("é", 36), nil},
+	}
+	for _, tc := range testCases {
+		err := a.ValidateUser(&user.User{
+			Email:    testEmail,
+			Username: testUsername,
+			Password: tc.password,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%d bytes: expected err to be %v, got %v", len(tc.password), tc.err, err)
+		}
+		if _, err := a.HashPassword(tc.password); err != tc.err {
+			t.Errorf("%d bytes: expected hash err to be %v, got %v", len(tc.password), tc.err, err)
+		}
+	}
+}
+
+func TestPasswordLength(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithPasswordLength(12, 64))
+
+	testCases := []struct {
+		password string
+		err      error
+	}{
+		{"password", ErrPasswordTooShort},
+		{"password1234", nil},
+		{strings.Repeat("a", 64), nil},
+		{strings.Repeat("a", 65), ErrPasswordTooLong},
+	}
+	for _, tc := range testCases {
+		err := a.ValidateUser(&user.User{
+			Email:    testEmail,
+			Username: testUsername,
+			Password: tc.password,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%d bytes: expected err to be %v, got %v", len(tc.password), tc.err, err)
+		}
+	}
+
+	err := a.ValidateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: "password",
+	})
+	want := "error: password is too short (must be at least 12 characters)"
+	if err == nil || err.Error() != want {
+		t.Errorf("expected err to be %q, got %v", want, err)
+	}
+	if !a.IsValidationErr(err) {
+		t.Error("expected err to be a validation error")
+	}
+
+	// The length is checked before the token.
+	if err := a.ResetPassword("token", "password"); !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("expected err to be ErrPasswordTooShort, got %v", err)
+	}
+
+	// The maximum can't be raised above bcrypt's limit.
+	a = NewAuth(datastore.NewMockRepo(), WithPasswordLength(6, 100))
+	err = a.ValidateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: strings.Repeat("a", 73),
+	})
+	if err == nil || err.Error() != ErrPasswordTooLong.Error() {
+		t.Errorf("expected err to be ErrPasswordTooLong, got %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	testCases := []struct {
+		policy   PasswordPolicy
+		password string
+		err      error
+	}{
+		{PasswordPolicy{RequireUpper: true}, "lowercase1", ErrWeakPassword},
+		{PasswordPolicy{RequireUpper: true}, "Uppercase1", nil},
+		{PasswordPolicy{RequireLower: true}, "UPPERCASE1", ErrWeakPassword},
+		{PasswordPolicy{RequireLower: true}, "UPPERCASEa", nil},
+		{PasswordPolicy{RequireDigit: true}, "nodigits", ErrWeakPassword},
+		{PasswordPolicy{RequireDigit: true}, "onedigit1", nil},
+		{PasswordPolicy{RequireSymbol: true}, "nosymbols1", ErrWeakPassword},
+		{PasswordPolicy{RequireSymbol: true}, "symbol!s1", nil},
+		{PasswordPolicy{RejectCommon: true}, "qwerty123", ErrWeakPassword},
+		{PasswordPolicy{RejectCommon: true}, "LetMeIn", ErrWeakPassword},
+		{PasswordPolicy{RejectCommon: true}, "uncommon-horse", nil},
+		{PasswordPolicy{}, "aaaaaa", nil},
+	}
+	for _, tc := range testCases {
+		a := NewAuth(datastore.NewMockRepo(), WithPasswordPolicy(tc.policy))
+		err := a.ValidateUser(&user.User{
+			Email:    testEmail,
+			Username: testUsername,
+			Password: tc.password,
+		})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%+v %s: expected err to be %v, got %v", tc.policy, tc.password, tc.err, err)
+		}
+	}
+
+	// Passwords aren't checked by default.
+	a := NewAuth(datastore.NewMockRepo())
+	err := a.ValidateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: "qwerty123",
+	})
+	if err != nil {
+		t.Errorf("expected err to be nil, got %v", err)
+	}
+	if !a.IsValidationErr(ErrWeakPassword) {
+		t.Error("expected ErrWeakPassword to be a validation error")
+	}
+}
+
+// fakeMetrics records the metrics it's given.
+type fakeMetrics struct {
+	latencies []string
+	counters  map[string]int
+}
+
+func (m *fakeMetrics) ObserveLatency(name string, d time.Duration) {
+	m.latencies = append(m.latencies, name)
+}
+
+func (m *fakeMetrics) IncCounter(name string) {
+	if m.counters == nil {
+		m.counters = make(map[string]int)
+	}
+	m.counters[name]++
+}
+
+func TestInstrumentedAuth(t *testing.T) {
+	m := new(fakeMetrics)
+	a := NewInstrumentedAuth(NewAuth(datastore.NewMockRepo()), m)
+
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, "wrongpassword"); err != ErrWrongPassword {
+		t.Fatalf("expected ErrWrongPassword, got %v", err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ChangePassword(1, testPassword, "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.EnableTOTP(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.VerifyTOTP(1, "000000x"); err != ErrInvalidTOTPCode {
+		t.Fatalf("expected ErrInvalidTOTPCode, got %v", err)
+	}
+
+	want := []string{"auth.CreateUser", "auth.AuthenticateUser", "auth.AuthenticateUser",
+		"auth.ChangePassword", "auth.EnableTOTP", "auth.VerifyTOTP"}
+	if fmt.Sprint(m.latencies) != fmt.Sprint(want) {
+		t.Errorf("expected latencies for %v, got %v", want, m.latencies)
+	}
+	if len(m.counters) != 2 || m.counters["auth.AuthenticateUser.errors"] != 1 ||
+		m.counters["auth.VerifyTOTP.errors"] != 1 {
+		t.Errorf("expected only auth.AuthenticateUser.errors and auth.VerifyTOTP.errors to be 1, got %v",
+			m.counters)
+	}
+
+	// Methods that aren't instrumented are passed through.
+	if !a.IsValidationErr(ErrInvalidEmail) {
+		t.Error("expected err to be a validation error")
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to 6 digits. The secret is
+	// the ASCII string "12345678901234567890".
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range testCases {
+		code, err := TOTPCode(secret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("%d: expected code to be %s, got %s", tc.unix, tc.code, code)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := NewAuth(datastore.NewMockRepo(), WithTOTPIssuer("Services"))
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.VerifyTOTP(u.Id, "123456"); err != ErrTOTPNotSetUp {
+		t.Errorf("expected err to be ErrTOTPNotSetUp, got %v", err)
+	}
+
+	secret, qrURL, err := a.EnableTOTP(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "otpauth://totp/Services:" + testEmail + "?issuer=Services&secret=" + secret
+	if qrURL != want {
+		t.Errorf("expected url to be %s, got %s", want, qrURL)
+	}
+
+	// One-time passwords aren't required until they're confirmed.
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatalf("expected no error before confirming, got %v", err)
+	}
+
+	code := func(t0 time.Time) string {
+		code, err := TOTPCode(secret, t0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	// Codes from more than one period away are rejected.
+	for _, d := range []time.Duration{-time.Minute, time.Minute} {
+		if err := a.VerifyTOTP(u.Id, code(now.Add(d))); err != ErrInvalidTOTPCode {
+			t.Errorf("%s: expected err to be ErrInvalidTOTPCode, got %v", d, err)
+		}
+	}
+
+	// A code from the previous period is accepted and confirms them.
+	if err := a.VerifyTOTP(u.Id, code(now.Add(-30*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	authed, err := a.AuthenticateUser(testEmail, testPassword)
+	if err != ErrTOTPRequired {
+		t.Fatalf("expected err to be ErrTOTPRequired, got %v", err)
+	}
+	if authed == nil || authed.Id != u.Id {
+		t.Errorf("expected user %d to be returned with ErrTOTPRequired, got %v", u.Id, authed)
+	}
+	if err := a.VerifyTOTP(u.Id, code(now)); err != nil {
+		t.Error(err)
+	}
+
+	// Codes can't be replayed, and neither can older ones.
+	for _, d := range []time.Duration{0, -30 * time.Second} {
+		if err := a.VerifyTOTP(u.Id, code(now.Add(d))); err != ErrInvalidTOTPCode {
+			t.Errorf("%s: expected a used code to be rejected, got %v", d, err)
+		}
+	}
+
+	if _, _, err := a.EnableTOTP(u.Id); err != ErrTOTPAlreadyEnabled {
+		t.Errorf("expected err to be ErrTOTPAlreadyEnabled, got %v", err)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := NewAuth(datastore.NewMockRepo())
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := a.EnableTOTP(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(t0 time.Time) string {
+		code, err := TOTPCode(secret, t0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	if _, err := a.FinishTOTPLogin("invalidnonce", code(now)); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+
+	// The right code finishes the login, after which its nonce is used up.
+	nonce, err := a.StartTOTPLogin(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.FinishTOTPLogin(nonce, "000000x"); err != ErrInvalidTOTPCode {
+		t.Errorf("expected err to be ErrInvalidTOTPCode, got %v", err)
+	}
+	got, err := a.FinishTOTPLogin(nonce, code(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != u.Id {
+		t.Errorf("expected user %d, got %d", u.Id, got.Id)
+	}
+	if _, err := a.FinishTOTPLogin(nonce, code(now)); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+
+	// A login ends after too many codes, even if the last one is right.
+	nonce, err = a.StartTOTPLogin(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxTOTPAttempts; i++ {
+		if _, err := a.FinishTOTPLogin(nonce, "000000x"); err != ErrInvalidTOTPCode {
+			t.Errorf("%d: expected err to be ErrInvalidTOTPCode, got %v", i, err)
+		}
+	}
+	if _, err := a.FinishTOTPLogin(nonce, code(now.Add(30*time.Second))); err != ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+
+	// Logins expire.
+	nonce, err = a.StartTOTPLogin(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(totpLoginTTL)
+	if _, err := a.FinishTOTPLogin(nonce, code(now)); err != ErrTokenExpired {
+		t.Errorf("expected err to be ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestPepper(t *testing.T) {
+	peppered := NewAuth(nil, WithPepper([]byte("pepper")))
+	hash, err := peppered.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peppered.CompareHashAndPassword(hash, testPassword); err != nil {
+		t.Errorf("expected password to match with the pepper, got %v", err)
+	}
+	if err := peppered.CompareHashAndPassword(hash, "wrongpassword"); err != ErrWrongPassword {
+		t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+	}
+
+	// The hash doesn't match without the pepper or with a different one.
+	testCases := []Auth{
+		NewAuth(nil),
+		NewAuth(nil, WithPepper([]byte("other pepper"))),
+	}
+	for i, a := range testCases {
+		if err := a.CompareHashAndPassword(hash, testPassword); err != ErrWrongPassword {
+			t.Errorf("%d: expected err to be ErrWrongPassword, got %v", i, err)
+		}
+	}
+
+	// Hashes made without a pepper still work without one.
+	plain := NewAuth(nil)
+	hash, err = plain.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.CompareHashAndPassword(hash, testPassword); err != nil {
+		t.Errorf("expected password to match without a pepper, got %v", err)
+	}
+}
+
+func TestHashers(t *testing.T) {
+	// Use cheap parameters, since the hashes' strength isn't tested.
+	argon2id := &argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16}
+	testCases := []struct {
+		name   string
+		h      Hasher
+		prefix string
+	}{
+		{"bcrypt", NewBcryptHasher(bcrypt.MinCost), "$2a$04$"},
+		{"argon2id", argon2id, "$argon2id$v=19$m=1024,t=1,p=1$"},
+	}
+	for _, tc := range testCases {
+		hash, err := tc.h.Hash(testPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, tc.prefix) {
+			t.Errorf("%s: expected hash to start with %s, got %s", tc.name, tc.prefix, hash)
+		}
+		if err := tc.h.Compare(hash, testPassword); err != nil {
+			t.Errorf("%s: expected password to match, got %v", tc.name, err)
+		}
+		if err := tc.h.Compare(hash, "wrongpassword"); err != ErrWrongPassword {
+			t.Errorf("%s: expected err to be ErrWrongPassword, got %v", tc.name, err)
+		}
+	}
+
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+	} {
+		if err := argon2id.Compare(hash, testPassword); err != ErrInvalidHash {
+			t.Errorf("%s: expected err to be ErrInvalidHash, got %v", hash, err)
+		}
+	}
+}
+
+func TestHasherMigration(t *testing.T) {
+	bcryptAuth := NewAuth(nil, WithHasher(NewBcryptHasher(bcrypt.MinCost)))
+	bcryptHash, err := bcryptAuth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon2id := &argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16}
+	argon2idAuth := NewAuth(nil, WithHasher(argon2id))
+	argon2idHash, err := argon2idAuth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argon2idHash, argon2idPrefix) {
+		t.Fatalf("expected an argon2id hash, got %s", argon2idHash)
+	}
+
+	// Both hashes can be compared, whichever hasher is the default.
+	for _, a := range []Auth{argon2idAuth, bcryptAuth} {
+		for _, hash := range []string{bcryptHash, argon2idHash} {
+			if err := a.CompareHashAndPassword(hash, testPassword); err != nil {
+				t.Errorf("%s: expected password to match, got %v", hash, err)
+			}
+			if err := a.CompareHashAndPassword(hash, "wrongpassword"); err != ErrWrongPassword {
+				t.Errorf("%s: expected err to be ErrWrongPassword, got %v", hash, err)
+			}
+		}
+	}
+}
+
+func TestAuthenticateUserUpgradesHash(t *testing.T) {
+	repo := datastore.NewMockRepo()
+	hash, err := NewBcryptHasher(bcrypt.MinCost).Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{Email: testEmail, Username: testUsername, Password: hash}
+	if err := repo.Create(u); err != nil {
+		t.Fatal(err)
+	}
+
+	storedHash := func() string {
+		u, err := repo.Get(u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Password
+	}
+
+	// Raising the cost rehashes the password on the next login.
+	a := NewAuth(repo, WithHasher(NewBcryptHasher(bcrypt.MinCost+1)))
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	cost, err := bcrypt.Cost([]byte(storedHash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.MinCost+1 {
+		t.Errorf("expected cost to be %d, got %d", bcrypt.MinCost+1, cost)
+	}
+
+	// Current hashes and wrong passwords don't change the hash.
+	hash = storedHash()
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, "wrongpassword"); err != ErrWrongPassword {
+		t.Fatalf("expected err to be ErrWrongPassword, got %v", err)
+	}
+	if storedHash() != hash {
+		t.Error("expected current hash not to change")
+	}
+
+	// Switching hashers migrates the password to the new algorithm.
+	argon2id := &argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16}
+	a = NewAuth(repo, WithHasher(argon2id))
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if hash := storedHash(); !strings.HasPrefix(hash, argon2idPrefix) {
+		t.Errorf("expected an argon2id hash, got %s", hash)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateUserByIdentifier(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+	err := a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identifier := range []string{testEmail, " " + strings.ToUpper(testEmail), testUsername} {
+		u, err := a.AuthenticateUserByIdentifier(identifier, testPassword)
+		if err != nil {
+			t.Fatalf("%q: %v", identifier, err)
+		}
+		if u.Username != testUsername {
+			t.Errorf("%q: expected user %s, got %s", identifier, testUsername, u.Username)
+		}
+		if _, err := a.AuthenticateUserByIdentifier(identifier, "wrongpassword"); err != ErrWrongPassword {
+			t.Errorf("%q: expected err to be ErrWrongPassword, got %v", identifier, err)
+		}
+	}
+
+	if _, err := a.AuthenticateUserByIdentifier("unknown", testPassword); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestAuthenticateTenantUser(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+	for _, u := range []*user.User{
+		{Email: testEmail, Username: testUsername, Password: testPassword},
+		{Email: testEmail, Username: "acmeuser", Password: "acmepassword", TenantId: "acme"},
+	} {
+		if err := a.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := a.AuthenticateTenantUser("acme", strings.ToUpper(testEmail), "acmepassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "acmeuser" {
+		t.Errorf("expected user acmeuser, got %s", u.Username)
+	}
+
+	// The password of the user in another tenant doesn't work.
+	if _, err := a.AuthenticateTenantUser("acme", testEmail, testPassword); err != ErrWrongPassword {
+		t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+	}
+	if _, err := a.AuthenticateTenantUser("other", testEmail, testPassword); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestInvalidateAllSessions(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.InvalidateAllSessions(u.Id + 1); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+
+	if err := a.InvalidateAllSessions(u.Id); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := a.(*auth).r.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionVersion != 1 {
+		t.Errorf("expected session version 1, got %d", stored.SessionVersion)
+	}
+
+	// Resetting the password also invalidates the user's sessions.
+	token, err := a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ResetPassword(token, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = a.(*auth).r.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionVersion != 2 {
+		t.Errorf("expected session version 2, got %d", stored.SessionVersion)
+	}
+}
+
+func TestAuthenticateDisabledUser(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Status != user.StatusActive {
+		t.Errorf("expected new user to be %s, got %s", user.StatusActive, u.Status)
+	}
+
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.(*auth).r.SetStatus(u.Id, user.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthenticateUser(testEmail, testPassword); err != ErrAccountDisabled {
+		t.Errorf("expected err to be ErrAccountDisabled, got %v", err)
+	}
+	// The password is still checked first.
+	if _, err := a.AuthenticateUser(testEmail, "wrong-password"); err != ErrWrongPassword {
+		t.Errorf("expected err to be ErrWrongPassword, got %v", err)
+	}
+}
+
+func TestTrimsWhitespace(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	// Padded emails and usernames are trimmed before they're stored.
+	u := &user.User{
+		Email:    "  " + testEmail + "\t",
+		Username: " " + testUsername + "\n",
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := a.(*auth).r.Get(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != testEmail || stored.Username != testUsername {
+		t.Errorf("expected %q (%q), got %q (%q)",
+			testUsername, testEmail, stored.Username, stored.Email)
+	}
+
+	// So the user can log in without the padding.
+	if _, err := a.AuthenticateUserByIdentifier(testUsername, testPassword); err != nil {
+		t.Errorf("expected to log in by username, got %v", err)
+	}
+
+	// A padded username is a duplicate of the trimmed one.
+	err = a.CreateUser(&user.User{
+		Email:    "other@example.com",
+		Username: testUsername + " ",
+		Password: testPassword,
+	})
+	if err != datastore.ErrDuplicateUsername {
+		t.Errorf("expected err to be ErrDuplicateUsername, got %v", err)
+	}
+
+	// Whitespace inside a username is never allowed.
+	allowSpaces := NewAuth(datastore.NewMockRepo(), WithUsernameChars(func(r rune) bool {
+		return isAlphanumericRune(r) || r == ' '
+	}))
+	for _, username := range []string{"bob smith", "bob\tsmith", "bob smith"} {
+		err := allowSpaces.ValidateUser(&user.User{
+			Email:    testEmail,
+			Username: username,
+			Password: testPassword,
+		})
+		if !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("%q: expected err to be ErrInvalidUsername, got %v", username, err)
+		}
+	}
+}
+
+func TestRecordLogin(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo())
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.(*auth).now = func() time.Time { return now }
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if u.LastLoginAt != nil {
+		t.Errorf("expected new user not to have logged in, got %v", u.LastLoginAt)
+	}
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		if err := a.RecordLogin(u.Id); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := a.(*auth).r.Get(u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.LastLoginAt == nil || !stored.LastLoginAt.Equal(now) {
+			t.Errorf("expected last login at %v, got %v", now, stored.LastLoginAt)
+		}
+		// The rest of the user is left as it was.
+		if stored.Password != u.Password || stored.Email != u.Email {
+			t.Errorf("expected other fields to be unchanged, got %+v", stored)
+		}
+	}
+
+	if err := a.RecordLogin(u.Id + 1); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	a := NewAuth(datastore.NewMockRepo(), WithPasswordPolicy(PasswordPolicy{RequireDigit: true}))
+
+	testCases := []struct {
+		u     *user.User
+		field string
+		err   error
+	}{
+		{&user.User{Username: testUsername, Password: testPassword}, "email", ErrEmptyRequiredField},
+		{&user.User{Email: testEmail, Password: testPassword}, "username", ErrEmptyRequiredField},
+		{&user.User{Email: testEmail, Username: testUsername}, "password", ErrEmptyRequiredField},
+		{&user.User{Email: "invalid", Username: testUsername, Password: testPassword}, "email", ErrInvalidEmail},
+		{&user.User{Email: testEmail, Username: "r_b", Password: testPassword}, "username", ErrInvalidUsername},
+		{&user.User{Email: testEmail, Username: "rb", Password: testPassword}, "username", ErrInvalidUsernameLength},
+		{&user.User{Email: testEmail, Username: testUsername, Password: "abc1"}, "password", ErrPasswordTooShort},
+		{&user.User{Email: testEmail, Username: testUsername, Password: strings.Repeat("a1", 37)}, "password", ErrPasswordTooLong},
+		{&user.User{Email: testEmail, Username: testUsername, Password: "nodigits"}, "password", ErrWeakPassword},
+		{&user.User{Email: testEmail, Username: "radovskyb1", Password: "radovskyb1"}, "password", ErrPasswordEqualsIdentity},
+	}
+	for _, tc := range testCases {
+		err := a.ValidateUser(tc.u)
+		var ve *ValidationError
+		if !errors.As(err, &ve) {
+			t.Errorf("%+v: expected a *ValidationError, got %v", tc.u, err)
+			continue
+		}
+		if ve.Field != tc.field || !errors.Is(err, tc.err) {
+			t.Errorf("%+v: expected %s: %v, got %s: %v", tc.u, tc.field, tc.err, ve.Field, err)
+		}
+		if !a.IsValidationErr(err) {
+			t.Errorf("%+v: expected %v to be a validation error", tc.u, err)
+		}
+	}
+}
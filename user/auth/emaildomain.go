@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrEmailDomainUndeliverable = errors.New("error: email domain can't receive email")
+
+// Resolver looks up DNS records. It's implemented by *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// EmailDomainChecker checks that an email's domain can receive email,
+// which is when it has either MX or A/AAAA records.
+type EmailDomainChecker struct {
+	resolver Resolver
+	timeout  time.Duration
+}
+
+// NewEmailDomainChecker creates an EmailDomainChecker that looks up
+// domains with resolver, giving up after timeout. If resolver is nil,
+// net.DefaultResolver is used.
+func NewEmailDomainChecker(resolver Resolver, timeout time.Duration) *EmailDomainChecker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &EmailDomainChecker{resolver: resolver, timeout: timeout}
+}
+
+// Check returns ErrEmailDomainUndeliverable if email's domain has no
+// MX or A/AAAA records. Any other lookup error, such as a timeout, is
+// returned as is.
+func (c *EmailDomainChecker) Check(email string) error {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ErrInvalidEmail
+	}
+	domain := email[at+1:]
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	mxs, err := c.resolver.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if len(mxs) > 0 {
+		return nil
+	}
+
+	// Without MX records, mail is delivered to the domain's A/AAAA records.
+	hosts, err := c.resolver.LookupHost(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if len(hosts) > 0 {
+		return nil
+	}
+	return ErrEmailDomainUndeliverable
+}
+
+// isNotFound checks whether err is a DNS error for a domain or record
+// that doesn't exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
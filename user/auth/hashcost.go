@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/radovskyb/services/user/datastore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashCostPageSize is the number of users listed at a time when
+// sampling hash costs.
+const hashCostPageSize = 100
+
+// HashCostGauge records how many users have a password hashed with each
+// bcrypt cost. It can be implemented by wrapping a Prometheus GaugeVec
+// with a cost label, for example:
+//
+//	func (g costGauge) SetHashCost(cost, users int) {
+//		g.WithLabelValues(strconv.Itoa(cost)).Set(float64(users))
+//	}
+type HashCostGauge interface {
+	SetHashCost(cost, users int)
+}
+
+// HashCosts returns the number of users in r with a password hashed with
+// each bcrypt cost. Passwords that aren't valid bcrypt hashes are skipped.
+func HashCosts(r datastore.UserRepository) (map[int]int, error) {
+	costs := make(map[int]int)
+	for offset := 0; ; offset += hashCostPageSize {
+		users, err := r.List(hashCostPageSize, offset, datastore.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			cost, err := bcrypt.Cost([]byte(u.Password))
+			if err != nil {
+				continue
+			}
+			costs[cost]++
+		}
+		if len(users) < hashCostPageSize {
+			return costs, nil
+		}
+	}
+}
+
+// ExportHashCosts samples the hash costs of the users in r and sets them
+// on g, and then does so again every interval until ctx is done, when it
+// returns ctx.Err().
+//
+// If sampling fails, g keeps its previous values until the next sample.
+// Costs that are no longer used by any users are set to 0.
+func ExportHashCosts(ctx context.Context, r datastore.UserRepository,
+	g HashCostGauge, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := make(map[int]int)
+	for {
+		if costs, err := HashCosts(r); err == nil {
+			for cost := range prev {
+				if _, found := costs[cost]; !found {
+					g.SetHashCost(cost, 0)
+				}
+			}
+			for cost, users := range costs {
+				g.SetHashCost(cost, users)
+			}
+			prev = costs
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
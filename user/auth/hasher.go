@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHash = errors.New("error: password hash is invalid")
+
+// Hasher hashes passwords and compares them to hashes. Hashes must start
+// with an identifier of the algorithm that made them, such as bcrypt's
+// $2a$ or $argon2id$, so that hashes made by different hashers can be
+// told apart while users are migrated between them.
+type Hasher interface {
+	// Hash hashes password.
+	Hash(password string) (string, error)
+
+	// Compare compares password to hash, returning ErrWrongPassword if
+	// they don't match.
+	Compare(hash, password string) error
+}
+
+// Rehasher is implemented by Hashers that can tell when a hash is
+// outdated, such as when it was made by a different algorithm or with
+// weaker parameters, so that it's rehashed when its user logs in.
+type Rehasher interface {
+	NeedsRehash(hash string) bool
+}
+
+// bcryptHasher is a Hasher that uses bcrypt.
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a Hasher that hashes passwords with bcrypt at
+// cost, which is the default Hasher with bcrypt.DefaultCost.
+func NewBcryptHasher(cost int) Hasher {
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h *bcryptHasher) Compare(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	// If the compared passwords don't match, return an ErrWrongPassword.
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+	return err
+}
+
+// NeedsRehash checks whether hash isn't a bcrypt hash with h's cost.
+func (h *bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
+
+// argon2idPrefix is the identifier that argon2id hashes start with.
+const argon2idPrefix = "$argon2id$"
+
+// argon2idHasher is a Hasher that uses argon2id.
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32 // In KiB.
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+// NewArgon2idHasher returns a Hasher that hashes passwords with argon2id,
+// using the parameters recommended by RFC 9106 for memory constrained
+// environments: 3 passes over 64 MiB of memory with 4 threads. Hashes
+// are encoded in the PHC string format, like:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func NewArgon2idHasher() Hasher {
+	return &argon2idHasher{
+		time:    3,
+		memory:  64 * 1024,
+		threads: 4,
+		keyLen:  32,
+		saltLen: 16,
+	}
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2idHasher) Compare(hash, password string) error {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt,
+		params.time, params.memory, params.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// NeedsRehash checks whether hash isn't an argon2id hash with h's
+// parameters.
+func (h *argon2idHasher) NeedsRehash(hash string) bool {
+	params, salt, _, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.time != h.time || params.memory != h.memory ||
+		params.threads != h.threads || params.keyLen != h.keyLen ||
+		len(salt) != h.saltLen
+}
+
+// parseArgon2id parses an argon2id hash into the parameters, salt and
+// key it was made with.
+func parseArgon2id(hash string) (*argon2idHasher, []byte, []byte, error) {
+	// The hash's parts are "", "argon2id", version, params, salt and key.
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || "$"+parts[1]+"$" != argon2idPrefix {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil ||
+		version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	h := new(argon2idHasher)
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	h.saltLen, h.keyLen = len(salt), uint32(len(key))
+	return h, salt, key, nil
+}
+
+// hasherFor returns the hasher that can compare passwords to hash, which
+// is picked by hash's identifier. Hashes that aren't bcrypt or argon2id
+// are compared by the configured hasher.
+func (a *auth) hasherFor(hash string) Hasher {
+	switch {
+	case strings.HasPrefix(hash, argon2idPrefix):
+		return new(argon2idHasher)
+	case strings.HasPrefix(hash, "$2"):
+		return new(bcryptHasher)
+	}
+	return a.hasher
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Mailer sends emails, such as password reset and email verification
+// links. The smtpmailer package has a Mailer that sends them over SMTP.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// nopMailer is a Mailer that doesn't send anything. It's the default, so
+// that tokens are only delivered by whoever they're returned to.
+type nopMailer struct{}
+
+func (nopMailer) Send(to, subject, body string) error { return nil }
+
+// Subjects of the emails sent by an Auth's Mailer.
+const (
+	resetSubject        = "Reset your password"
+	verificationSubject = "Verify your email"
+)
+
+// WithMailer sends password reset tokens created by CreateResetToken and
+// verification tokens created by GenerateVerificationToken to their
+// users with m, as links to resetURL and verifyURL with the token added
+// as the token query parameter, which is where the handler package's
+// ResetPassword and VerifyEmail read it from. Nothing is sent by default.
+func WithMailer(m Mailer, resetURL, verifyURL string) Option {
+	return func(a *auth) {
+		a.mailer = m
+		a.resetURL = resetURL
+		a.verifyURL = verifyURL
+	}
+}
+
+// tokenLink returns link with token added as its token query parameter.
+func tokenLink(link, token string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// sendResetLink emails a link to reset their password with token to to.
+func (a *auth) sendResetLink(to, token string) error {
+	link, err := tokenLink(a.resetURL, token)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("To reset your password, visit the link below. "+
+		"It expires in %s.\n\n%s\n\n"+
+		"If you didn't ask to reset your password, you can ignore this email.\n",
+		a.resetTokenTTL.Round(time.Minute), link)
+	return a.mailer.Send(to, resetSubject, body)
+}
+
+// sendVerificationLink emails a link to verify their email with token
+// to to.
+func (a *auth) sendVerificationLink(to, token string) error {
+	link, err := tokenLink(a.verifyURL, token)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("To verify your email, visit the link below.\n\n%s\n", link)
+	return a.mailer.Send(to, verificationSubject, body)
+}
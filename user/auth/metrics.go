@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/radovskyb/services/user"
+	"github.com/radovskyb/services/user/datastore"
+)
+
+// instrumentedAuth is an Auth that records metrics for the operations of
+// the Auth it wraps that hash passwords or touch the user repository.
+type instrumentedAuth struct {
+	Auth
+	metrics datastore.Metrics
+}
+
+// NewInstrumentedAuth returns an Auth that records the latency of
+// next's CreateUser, CreateUserWithReservation, AuthenticateUser,
+// AuthenticateUserByIdentifier, AuthenticateTenantUser, ResetPassword,
+// ChangePassword, VerifyEmail, EnableTOTP, VerifyTOTP, FinishTOTPLogin
+// and HashPassword in metrics as "auth.<Method>", and increments
+// "auth.<Method>.errors" whenever one fails. If metrics is nil,
+// datastore.NoopMetrics is used.
+func NewInstrumentedAuth(next Auth, metrics datastore.Metrics) Auth {
+	if metrics == nil {
+		metrics = datastore.NoopMetrics
+	}
+	return &instrumentedAuth{Auth: next, metrics: metrics}
+}
+
+func (a *instrumentedAuth) observe(method string, start time.Time, err error) {
+	datastore.Observe(a.metrics, "auth."+method, start, err)
+}
+
+func (a *instrumentedAuth) CreateUser(u *user.User) (err error) {
+	defer func(start time.Time) { a.observe("CreateUser", start, err) }(time.Now())
+	return a.Auth.CreateUser(u)
+}
+
+func (a *instrumentedAuth) CreateUserWithReservation(u *user.User, token string) (err error) {
+	defer func(start time.Time) {
+		a.observe("CreateUserWithReservation", start, err)
+	}(time.Now())
+	return a.Auth.CreateUserWithReservation(u, token)
+}
+
+func (a *instrumentedAuth) AuthenticateUser(email, password string) (u *user.User, err error) {
+	defer func(start time.Time) { a.observe("AuthenticateUser", start, err) }(time.Now())
+	return a.Auth.AuthenticateUser(email, password)
+}
+
+func (a *instrumentedAuth) AuthenticateUserByIdentifier(identifier, password string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		a.observe("AuthenticateUserByIdentifier", start, err)
+	}(time.Now())
+	return a.Auth.AuthenticateUserByIdentifier(identifier, password)
+}
+
+func (a *instrumentedAuth) AuthenticateTenantUser(tenantId, email, password string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		a.observe("AuthenticateTenantUser", start, err)
+	}(time.Now())
+	return a.Auth.AuthenticateTenantUser(tenantId, email, password)
+}
+
+func (a *instrumentedAuth) ResetPassword(token, newPassword string) (err error) {
+	defer func(start time.Time) { a.observe("ResetPassword", start, err) }(time.Now())
+	return a.Auth.ResetPassword(token, newPassword)
+}
+
+func (a *instrumentedAuth) ChangePassword(userId int64, oldPassword, newPassword string) (err error) {
+	defer func(start time.Time) { a.observe("ChangePassword", start, err) }(time.Now())
+	return a.Auth.ChangePassword(userId, oldPassword, newPassword)
+}
+
+func (a *instrumentedAuth) VerifyEmail(token string) (err error) {
+	defer func(start time.Time) { a.observe("VerifyEmail", start, err) }(time.Now())
+	return a.Auth.VerifyEmail(token)
+}
+
+func (a *instrumentedAuth) EnableTOTP(userId int64) (secret, qrURL string, err error) {
+	defer func(start time.Time) { a.observe("EnableTOTP", start, err) }(time.Now())
+	return a.Auth.EnableTOTP(userId)
+}
+
+func (a *instrumentedAuth) VerifyTOTP(userId int64, code string) (err error) {
+	defer func(start time.Time) { a.observe("VerifyTOTP", start, err) }(time.Now())
+	return a.Auth.VerifyTOTP(userId, code)
+}
+
+func (a *instrumentedAuth) FinishTOTPLogin(nonce, code string) (u *user.User, err error) {
+	defer func(start time.Time) { a.observe("FinishTOTPLogin", start, err) }(time.Now())
+	return a.Auth.FinishTOTPLogin(nonce, code)
+}
+
+func (a *instrumentedAuth) HashPassword(password string) (hash string, err error) {
+	defer func(start time.Time) { a.observe("HashPassword", start, err) }(time.Now())
+	return a.Auth.HashPassword(password)
+}
@@ -0,0 +1,59 @@
+// Package smtpmailer implements an auth.Mailer that sends emails over
+// SMTP, so that the auth package doesn't depend on SMTP itself.
+package smtpmailer
+
+import (
+	"errors"
+	"net/smtp"
+	"strings"
+)
+
+var ErrInvalidHeader = errors.New("error: email header contains a newline")
+
+// Mailer is an auth.Mailer that sends plain text emails through an SMTP
+// server.
+type Mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+
+	// sendMail is smtp.SendMail, which tests replace.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// New creates a Mailer that sends emails from the address from through
+// the SMTP server at addr, which must include a port, such as
+// "smtp.example.com:587". auth authenticates with the server, such as
+// smtp.PlainAuth, or is nil if it doesn't need authentication.
+func New(addr, from string, auth smtp.Auth) *Mailer {
+	return &Mailer{addr: addr, from: from, auth: auth, sendMail: smtp.SendMail}
+}
+
+// Send sends an email with subject and body to the address to. If to or
+// subject contain a newline, which could be used to add headers,
+// ErrInvalidHeader is returned.
+func (m *Mailer) Send(to, subject, body string) error {
+	msg, err := message(m.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+	return m.sendMail(m.addr, m.auth, m.from, []string{to}, msg)
+}
+
+// message formats an email's headers and body.
+func message(from, to, subject, body string) ([]byte, error) {
+	for _, header := range []string{from, to, subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return []byte(b.String()), nil
+}
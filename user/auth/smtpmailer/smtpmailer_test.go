@@ -0,0 +1,62 @@
+package smtpmailer
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/radovskyb/services/user/auth"
+)
+
+var _ auth.Mailer = (*Mailer)(nil)
+
+func TestSend(t *testing.T) {
+	m := New("smtp.example.com:587", "noreply@example.com", nil)
+
+	var (
+		gotAddr, gotFrom string
+		gotTo            []string
+		gotMsg           string
+	)
+	m.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, string(msg)
+		return nil
+	}
+
+	err := m.Send("radovskyb@gmail.com", "Verify your email", "Hello\nthere\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotAddr != "smtp.example.com:587" || gotFrom != "noreply@example.com" {
+		t.Errorf("expected to send from noreply@example.com through smtp.example.com:587, got %s through %s",
+			gotFrom, gotAddr)
+	}
+	if len(gotTo) != 1 || gotTo[0] != "radovskyb@gmail.com" {
+		t.Errorf("expected to send to radovskyb@gmail.com, got %v", gotTo)
+	}
+	for _, want := range []string{
+		"From: noreply@example.com\r\n",
+		"To: radovskyb@gmail.com\r\n",
+		"Subject: Verify your email\r\n",
+		"\r\n\r\nHello\r\nthere\r\n",
+	} {
+		if !strings.Contains(gotMsg, want) {
+			t.Errorf("expected message to contain %q, got %q", want, gotMsg)
+		}
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	m := New("smtp.example.com:587", "noreply@example.com", nil)
+	m.sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+		t.Error("expected no email to be sent")
+		return nil
+	}
+
+	if err := m.Send("a@example.com\r\nBcc: b@example.com", "Hi", ""); err != ErrInvalidHeader {
+		t.Errorf("expected err to be ErrInvalidHeader, got %v", err)
+	}
+	if err := m.Send("a@example.com", "Hi\nBcc: b@example.com", ""); err != ErrInvalidHeader {
+		t.Errorf("expected err to be ErrInvalidHeader, got %v", err)
+	}
+}
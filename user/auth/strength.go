@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var ErrWeakPassword = errors.New("error: password is too weak")
+
+// PasswordPolicy is a password strength policy, which is checked in
+// addition to the minimum password length.
+type PasswordPolicy struct {
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol require
+	// passwords to contain at least one character of each class.
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// RejectCommon rejects passwords that are on a list of the most
+	// commonly used passwords, ignoring case.
+	RejectCommon bool
+}
+
+// commonPasswords are some of the most commonly used passwords that are
+// long enough to pass the minimum password length.
+var commonPasswords = map[string]bool{
+	"123456":      true,
+	"1234567":     true,
+	"12345678":    true,
+	"123456789":   true,
+	"1234567890":  true,
+	"111111":      true,
+	"000000":      true,
+	"123123":      true,
+	"654321":      true,
+	"666666":      true,
+	"121212":      true,
+	"abc123":      true,
+	"qwerty":      true,
+	"qwerty123":   true,
+	"qwertyuiop":  true,
+	"asdfgh":      true,
+	"password":    true,
+	"password1":   true,
+	"password123": true,
+	"passw0rd":    true,
+	"iloveyou":    true,
+	"letmein":     true,
+	"welcome":     true,
+	"monkey":      true,
+	"dragon":      true,
+	"master":      true,
+	"sunshine":    true,
+	"princess":    true,
+	"football":    true,
+	"baseball":    true,
+	"superman":    true,
+	"trustno1":    true,
+	"starwars":    true,
+	"shadow":      true,
+	"michael":     true,
+	"admin123":    true,
+	"changeme":    true,
+	"zaq12wsx":    true,
+	"1q2w3e4r":    true,
+}
+
+// check checks password against p, returning ErrWeakPassword if it
+// doesn't meet it.
+func (p *PasswordPolicy) check(password string) error {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if (p.RequireUpper && !upper) || (p.RequireLower && !lower) ||
+		(p.RequireDigit && !digit) || (p.RequireSymbol && !symbol) {
+		return ErrWeakPassword
+	}
+	if p.RejectCommon && commonPasswords[strings.ToLower(password)] {
+		return ErrWeakPassword
+	}
+	return nil
+}
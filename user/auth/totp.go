@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/radovskyb/services/user"
+)
+
+var (
+	ErrTOTPRequired       = errors.New("error: a one-time password is required")
+	ErrInvalidTOTPCode    = errors.New("error: one-time password is invalid")
+	ErrTOTPNotSetUp       = errors.New("error: one-time passwords haven't been set up")
+	ErrTOTPAlreadyEnabled = errors.New("error: one-time passwords are already enabled")
+)
+
+const (
+	// totpPeriod is how long each one-time password is valid for.
+	totpPeriod = 30 * time.Second
+
+	// totpDigits is the number of digits in a one-time password.
+	totpDigits = 6
+
+	// totpSkew is the number of periods before and after the current
+	// one whose one-time passwords are also accepted, to allow for clock
+	// drift and slow typing.
+	totpSkew = 1
+
+	// totpLoginTTL is how long a user has to enter a one-time password
+	// after StartTOTPLogin, and maxTOTPAttempts is how many codes they
+	// can enter before the pending login ends.
+	totpLoginTTL    = 5 * time.Minute
+	maxTOTPAttempts = 5
+)
+
+// totpLogin is a login that's waiting for a one-time password. Like
+// reset tokens, it's stored by the hash of its nonce.
+type totpLogin struct {
+	userId   int64
+	expires  time.Time
+	attempts int
+}
+
+// totpEncoding is the base32 encoding of TOTP secrets, which
+// authenticator apps expect without padding.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (a *auth) EnableTOTP(userId int64) (string, string, error) {
+	u, err := a.r.Get(userId)
+	if err != nil {
+		return "", "", err
+	}
+	if u.TOTPEnabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	u.TOTPSecret = totpEncoding.EncodeToString(b)
+	if err := a.r.Update(u); err != nil {
+		return "", "", err
+	}
+	return u.TOTPSecret, a.totpURL(u.Email, u.TOTPSecret), nil
+}
+
+// totpURL returns the otpauth URL for account's secret, which
+// authenticator apps can scan as a QR code.
+func (a *auth) totpURL(account, secret string) string {
+	label := url.PathEscape(account)
+	v := url.Values{"secret": {secret}}
+	if a.totpIssuer != "" {
+		label = url.PathEscape(a.totpIssuer) + ":" + label
+		v.Set("issuer", a.totpIssuer)
+	}
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func (a *auth) VerifyTOTP(userId int64, code string) error {
+	u, err := a.r.Get(userId)
+	if err != nil {
+		return err
+	}
+	if u.TOTPSecret == "" {
+		return ErrTOTPNotSetUp
+	}
+	secret, err := decodeTOTPSecret(u.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	now := totpCounter(a.now())
+	counter := int64(-1)
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		want := totpCode(secret, uint64(now+i))
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			counter = now + i
+		}
+	}
+	if counter < 0 {
+		return ErrInvalidTOTPCode
+	}
+	// Each code can only be used once, and neither can older ones.
+	advanced, err := a.r.AdvanceTOTPCounter(u.Id, counter)
+	if err != nil {
+		return err
+	}
+	if !advanced {
+		return ErrInvalidTOTPCode
+	}
+	// The first valid code confirms the user's authenticator app works.
+	if !u.TOTPEnabled {
+		u.TOTPEnabled = true
+		return a.r.Update(u)
+	}
+	return nil
+}
+
+func (a *auth) StartTOTPLogin(userId int64) (string, error) {
+	nonce, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Remove expired logins.
+	for hash, tl := range a.totpLogins {
+		if !a.now().Before(tl.expires) {
+			delete(a.totpLogins, hash)
+		}
+	}
+	a.totpLogins[hashToken(nonce)] = &totpLogin{
+		userId:  userId,
+		expires: a.now().Add(totpLoginTTL),
+	}
+	return nonce, nil
+}
+
+func (a *auth) FinishTOTPLogin(nonce, code string) (*user.User, error) {
+	a.mu.Lock()
+	hash := hashToken(nonce)
+	tl, found := a.totpLogins[hash]
+	if !found {
+		a.mu.Unlock()
+		return nil, ErrInvalidToken
+	}
+	if !a.now().Before(tl.expires) {
+		delete(a.totpLogins, hash)
+		a.mu.Unlock()
+		return nil, ErrTokenExpired
+	}
+	// Count the attempt before checking it, so concurrent guesses can't
+	// get past the limit.
+	tl.attempts++
+	if tl.attempts >= maxTOTPAttempts {
+		delete(a.totpLogins, hash)
+	}
+	a.mu.Unlock()
+
+	if err := a.VerifyTOTP(tl.userId, code); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	delete(a.totpLogins, hash)
+	a.mu.Unlock()
+
+	return a.r.Get(tl.userId)
+}
+
+// TOTPCode returns the one-time password for the base32 encoded secret
+// at t, as an authenticator app would show it, such as for testing.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	b, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(b, uint64(totpCounter(t))), nil
+}
+
+// decodeTOTPSecret decodes a base32 encoded secret, ignoring case and
+// padding.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+}
+
+// totpCounter returns the number of TOTP periods between the Unix epoch
+// and t.
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode returns the one-time password for secret and counter, as
+// specified by RFC 4226.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, bin%mod)
+}
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/radovskyb/services/user"
+)
+
+// fileRepo is a mockRepo that's loaded from a gob encoded file and
+// snapshotted back to it, so its users survive restarts.
+type fileRepo struct {
+	*mockRepo
+	path string
+
+	mu    sync.Mutex // Protects dirty and writes to path.
+	dirty bool       // Whether there are changes that aren't saved.
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// fileData is what a fileRepo saves to its file.
+type fileData struct {
+	IdCnt      int64
+	Users      []*user.User
+	Identities map[string]map[string]int64
+}
+
+// NewFileRepo returns an in-memory UserRepository that behaves like the
+// mock repository, but is loaded from the file at path, if it exists,
+// and snapshotted to it every interval if there have been changes. It's
+// also saved when it's closed. An interval <= 0 only saves it on Close.
+//
+// It's meant for local development, not production. Changes made since
+// the last snapshot are lost if the process exits without calling Close.
+func NewFileRepo(path string, interval time.Duration) (UserRepository, error) {
+	r := &fileRepo{
+		mockRepo: NewMockRepo().(*mockRepo),
+		path:     path,
+		stop:     make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		r.wg.Add(1)
+		go r.snapshotEvery(interval)
+	}
+	return r, nil
+}
+
+// load loads the users saved in r's file, if it exists.
+func (r *fileRepo) load() error {
+	b, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var data fileData
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data); err != nil {
+		return err
+	}
+	r.idCnt = data.IdCnt
+	for _, u := range data.Users {
+		r.users[u.Id] = u
+		r.addKeys(u)
+	}
+	if data.Identities != nil {
+		r.identities = data.Identities
+	}
+	return nil
+}
+
+// snapshotEvery saves r every interval until r is closed.
+func (r *fileRepo) snapshotEvery(interval time.Duration) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// There's nowhere to report the error, so the changes are
+			// kept dirty and saved again on the next tick or Close.
+			r.save()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// save writes r's users to its file if they've changed since they were
+// last saved. The file is replaced atomically, so it's never left half
+// written.
+func (r *fileRepo) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.dirty {
+		return nil
+	}
+	// Clear dirty before encoding the users, so changes made while
+	// they're being written are saved next time.
+	r.dirty = false
+
+	b, err := r.encode()
+	if err == nil {
+		err = writeFile(r.path, b)
+	}
+	if err != nil {
+		r.dirty = true
+	}
+	return err
+}
+
+// encode gob encodes r's users, ordered by id.
+func (r *fileRepo) encode() ([]byte, error) {
+	r.mockRepo.mu.Lock()
+	defer r.mockRepo.mu.Unlock()
+
+	if r.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	data := fileData{
+		IdCnt:      r.idCnt,
+		Users:      make([]*user.User, 0, len(r.users)),
+		Identities: r.identities,
+	}
+	for _, u := range r.users {
+		data.Users = append(data.Users, u)
+	}
+	sort.Slice(data.Users, func(i, j int) bool {
+		return data.Users[i].Id < data.Users[j].Id
+	})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeFile writes b to a temporary file next to path and then renames
+// it to path.
+func writeFile(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// changed marks r as having changes to save if err is nil.
+func (r *fileRepo) changed(err error) error {
+	if err == nil {
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops r's snapshots, saves its users and then closes it.
+func (r *fileRepo) Close() error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	r.wg.Wait()
+
+	if err := r.save(); err != nil {
+		return err
+	}
+	return r.mockRepo.Close()
+}
+
+func (r *fileRepo) Reset() error {
+	return r.changed(r.mockRepo.Reset())
+}
+
+// WithTx marks r as changed even if fn fails, since fn's changes are
+// only undone after they were made.
+func (r *fileRepo) WithTx(fn func(r UserRepository) error) error {
+	err := r.mockRepo.WithTx(fn)
+	r.changed(nil)
+	return err
+}
+
+func (r *fileRepo) CreateTx(ctx context.Context, u *user.User,
+	fn func(tx *sql.Tx) error) error {
+	return r.changed(r.mockRepo.CreateTx(ctx, u, fn))
+}
+
+func (r *fileRepo) Create(u *user.User) error {
+	return r.changed(r.mockRepo.Create(u))
+}
+
+func (r *fileRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	u, created, err := r.mockRepo.FindOrCreate(u)
+	if created {
+		r.changed(nil)
+	}
+	return u, created, err
+}
+
+func (r *fileRepo) CreateBatch(users []*user.User) error {
+	return r.changed(r.mockRepo.CreateBatch(users))
+}
+
+func (r *fileRepo) Update(u *user.User) error {
+	return r.changed(r.mockRepo.Update(u))
+}
+
+func (r *fileRepo) UpdateEmail(id int64, email string) error {
+	return r.changed(r.mockRepo.UpdateEmail(id, email))
+}
+
+func (r *fileRepo) UpdateUsername(id int64, username string) error {
+	return r.changed(r.mockRepo.UpdateUsername(id, username))
+}
+
+func (r *fileRepo) Patch(id int64, update UserUpdate) error {
+	return r.changed(r.mockRepo.Patch(id, update))
+}
+
+func (r *fileRepo) LinkProvider(id int64, provider, subject string) error {
+	return r.changed(r.mockRepo.LinkProvider(id, provider, subject))
+}
+
+func (r *fileRepo) SetStatus(id int64, status string) error {
+	return r.changed(r.mockRepo.SetStatus(id, status))
+}
+
+func (r *fileRepo) SetLastLogin(id int64, at time.Time) error {
+	return r.changed(r.mockRepo.SetLastLogin(id, at))
+}
+
+func (r *fileRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	advanced, err := r.mockRepo.AdvanceTOTPCounter(id, counter)
+	return advanced, r.changed(err)
+}
+
+func (r *fileRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	return r.changed(r.mockRepo.RecordFailedLogin(id, at, windowStart, threshold, lockedUntil))
+}
+
+func (r *fileRepo) ResetFailedLogins(id int64) error {
+	return r.changed(r.mockRepo.ResetFailedLogins(id))
+}
+
+func (r *fileRepo) Delete(id int64) error {
+	return r.changed(r.mockRepo.Delete(id))
+}
+
+func (r *fileRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	n, err := r.mockRepo.AssignTenant(ids, tenantId)
+	return n, r.changed(err)
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"errors"
+
+	"github.com/radovskyb/services/user"
+)
+
+// FixturePassword is the password of every fixture user.
+const FixturePassword = "password123"
+
+// Fixtures returns a fixed set of users for integration tests:
+//
+//	Id  Email              Username  Tenant  Role   Verified
+//	1   admin@example.com  admin             admin  yes
+//	2   alice@example.com  alice             user   yes
+//	3   bob@example.com    bob               user   no
+//	4   carol@example.com  carol     acme    user   yes
+//
+// Each user's password is FixturePassword, hashed with bcrypt. The ids
+// are the ids the users get when they're loaded into an empty repository
+// with LoadFixtures. A new copy of the users is returned by every call.
+func Fixtures() []*user.User {
+	return []*user.User{
+		{
+			Id:            1,
+			Email:         "admin@example.com",
+			Username:      "admin",
+			Password:      "$2a$10$3oOw4Y7eGynBE/75HrG/bu3vbA7HBgXMAYguL0LPsvKSo4Qd3jlvG",
+			Role:          user.RoleAdmin,
+			EmailVerified: true,
+		},
+		{
+			Id:            2,
+			Email:         "alice@example.com",
+			Username:      "alice",
+			Password:      "$2a$10$txGrF1sEkITxq2nVjuZ7W.hmOQQdc9M2Te2Mo6fwcdUMh3WO3OhPq",
+			Role:          user.RoleUser,
+			EmailVerified: true,
+		},
+		{
+			Id:       3,
+			Email:    "bob@example.com",
+			Username: "bob",
+			Password: "$2a$10$1A/Fg2JnHqdCAaWuG5HZceXc3uhE7ggV56R.GCJ.KoNl532Bj8TD6",
+			Role:     user.RoleUser,
+		},
+		{
+			Id:            4,
+			Email:         "carol@example.com",
+			Username:      "carol",
+			Password:      "$2a$10$k7dprIq0Pb7PSXvepu2KEuCE4FEQ6lnigmwPqyQNg68bo5YwON3we",
+			TenantId:      "acme",
+			Role:          user.RoleUser,
+			EmailVerified: true,
+		},
+	}
+}
+
+// LoadFixtures creates the users returned by Fixtures in r. Fixtures
+// that already exist in r are skipped, so it can be called more than
+// once.
+func LoadFixtures(r UserRepository) error {
+	for _, u := range Fixtures() {
+		_, err := r.GetByTenantEmail(u.TenantId, u.Email)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return err
+		}
+		u.Id = 0
+		if err := r.Create(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
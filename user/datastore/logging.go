@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/radovskyb/services/user"
+)
+
+// loggingRepo is a UserRepository that logs every operation of the
+// UserRepository it wraps.
+type loggingRepo struct {
+	next   UserRepository
+	logger *log.Logger
+}
+
+// NewLoggingRepo returns a UserRepository that logs the method name,
+// arguments, duration and error of every operation on next to logger.
+// Users' passwords are never logged.
+//
+// The returned UserRepository only implements UserRepository, even if
+// next also implements interfaces such as TxCreator.
+func NewLoggingRepo(next UserRepository, logger *log.Logger) UserRepository {
+	return &loggingRepo{next: next, logger: logger}
+}
+
+// log logs a call to method with args that started at start and
+// returned err.
+func (r *loggingRepo) log(method, args string, start time.Time, err error) {
+	r.logger.Printf("datastore: %s(%s) took %s, err: %v",
+		method, args, time.Since(start), err)
+}
+
+// userArgs formats u's fields for logging, leaving out its password.
+func userArgs(u *user.User) string {
+	return fmt.Sprintf("id=%d email=%q username=%q tenantId=%q",
+		u.Id, u.Email, u.Username, u.TenantId)
+}
+
+func (r *loggingRepo) Create(u *user.User) (err error) {
+	defer func(start time.Time) { r.log("Create", userArgs(u), start, err) }(time.Now())
+	return r.next.Create(u)
+}
+
+func (r *loggingRepo) FindOrCreate(u *user.User) (stored *user.User, created bool, err error) {
+	defer func(start time.Time) {
+		r.log("FindOrCreate", fmt.Sprintf("%s created=%t", userArgs(u), created), start, err)
+	}(time.Now())
+	return r.next.FindOrCreate(u)
+}
+
+func (r *loggingRepo) Get(id int64) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("Get", fmt.Sprintf("id=%d", id), start, err)
+	}(time.Now())
+	return r.next.Get(id)
+}
+
+func (r *loggingRepo) GetMany(ids []int64) (users map[int64]*user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetMany", fmt.Sprintf("ids=%v", ids), start, err)
+	}(time.Now())
+	return r.next.GetMany(ids)
+}
+
+func (r *loggingRepo) GetByEmail(email string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByEmail", fmt.Sprintf("email=%q", email), start, err)
+	}(time.Now())
+	return r.next.GetByEmail(email)
+}
+
+func (r *loggingRepo) GetByUsername(username string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByUsername", fmt.Sprintf("username=%q", username), start, err)
+	}(time.Now())
+	return r.next.GetByUsername(username)
+}
+
+func (r *loggingRepo) GetByTenantEmail(tenantId, email string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByTenantEmail",
+			fmt.Sprintf("tenantId=%q email=%q", tenantId, email), start, err)
+	}(time.Now())
+	return r.next.GetByTenantEmail(tenantId, email)
+}
+
+func (r *loggingRepo) GetByTenantUsername(tenantId, username string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByTenantUsername",
+			fmt.Sprintf("tenantId=%q username=%q", tenantId, username), start, err)
+	}(time.Now())
+	return r.next.GetByTenantUsername(tenantId, username)
+}
+
+func (r *loggingRepo) GetByEmailOrUsername(identifier string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByEmailOrUsername", fmt.Sprintf("identifier=%q", identifier), start, err)
+	}(time.Now())
+	return r.next.GetByEmailOrUsername(identifier)
+}
+
+func (r *loggingRepo) Update(u *user.User) (err error) {
+	defer func(start time.Time) { r.log("Update", userArgs(u), start, err) }(time.Now())
+	return r.next.Update(u)
+}
+
+func (r *loggingRepo) Delete(id int64) (err error) {
+	defer func(start time.Time) {
+		r.log("Delete", fmt.Sprintf("id=%d", id), start, err)
+	}(time.Now())
+	return r.next.Delete(id)
+}
+
+func (r *loggingRepo) UpdateEmail(id int64, email string) (err error) {
+	defer func(start time.Time) {
+		r.log("UpdateEmail", fmt.Sprintf("id=%d email=%q", id, email), start, err)
+	}(time.Now())
+	return r.next.UpdateEmail(id, email)
+}
+
+func (r *loggingRepo) UpdateUsername(id int64, username string) (err error) {
+	defer func(start time.Time) {
+		r.log("UpdateUsername", fmt.Sprintf("id=%d username=%q", id, username), start, err)
+	}(time.Now())
+	return r.next.UpdateUsername(id, username)
+}
+
+func (r *loggingRepo) Patch(id int64, update UserUpdate) (err error) {
+	defer func(start time.Time) {
+		columns, _ := update.columns()
+		r.log("Patch", fmt.Sprintf("id=%d fields=%v", id, columns), start, err)
+	}(time.Now())
+	return r.next.Patch(id, update)
+}
+
+func (r *loggingRepo) SetStatus(id int64, status string) (err error) {
+	defer func(start time.Time) {
+		r.log("SetStatus", fmt.Sprintf("id=%d status=%q", id, status), start, err)
+	}(time.Now())
+	return r.next.SetStatus(id, status)
+}
+
+func (r *loggingRepo) SetLastLogin(id int64, at time.Time) (err error) {
+	defer func(start time.Time) {
+		r.log("SetLastLogin", fmt.Sprintf("id=%d at=%s", id, at), start, err)
+	}(time.Now())
+	return r.next.SetLastLogin(id, at)
+}
+
+func (r *loggingRepo) AdvanceTOTPCounter(id, counter int64) (advanced bool, err error) {
+	defer func(start time.Time) {
+		r.log("AdvanceTOTPCounter", fmt.Sprintf("id=%d counter=%d", id, counter), start, err)
+	}(time.Now())
+	return r.next.AdvanceTOTPCounter(id, counter)
+}
+
+func (r *loggingRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) (err error) {
+	defer func(start time.Time) {
+		r.log("RecordFailedLogin", fmt.Sprintf(
+			"id=%d at=%s windowStart=%s threshold=%d lockedUntil=%s",
+			id, at, windowStart, threshold, lockedUntil), start, err)
+	}(time.Now())
+	return r.next.RecordFailedLogin(id, at, windowStart, threshold, lockedUntil)
+}
+
+func (r *loggingRepo) ResetFailedLogins(id int64) (err error) {
+	defer func(start time.Time) {
+		r.log("ResetFailedLogins", fmt.Sprintf("id=%d", id), start, err)
+	}(time.Now())
+	return r.next.ResetFailedLogins(id)
+}
+
+func (r *loggingRepo) LinkProvider(id int64, provider, subject string) (err error) {
+	defer func(start time.Time) {
+		r.log("LinkProvider",
+			fmt.Sprintf("id=%d provider=%q subject=%q", id, provider, subject), start, err)
+	}(time.Now())
+	return r.next.LinkProvider(id, provider, subject)
+}
+
+func (r *loggingRepo) GetByProvider(provider, subject string) (u *user.User, err error) {
+	defer func(start time.Time) {
+		r.log("GetByProvider",
+			fmt.Sprintf("provider=%q subject=%q", provider, subject), start, err)
+	}(time.Now())
+	return r.next.GetByProvider(provider, subject)
+}
+
+func (r *loggingRepo) List(limit, offset int, opts ListOptions) (users []*user.User, err error) {
+	defer func(start time.Time) {
+		r.log("List", fmt.Sprintf("limit=%d offset=%d orderBy=%q desc=%t",
+			limit, offset, opts.OrderBy, opts.Desc), start, err)
+	}(time.Now())
+	return r.next.List(limit, offset, opts)
+}
+
+func (r *loggingRepo) CreateBatch(users []*user.User) (err error) {
+	defer func(start time.Time) {
+		r.log("CreateBatch", fmt.Sprintf("users=%d", len(users)), start, err)
+	}(time.Now())
+	return r.next.CreateBatch(users)
+}
+
+func (r *loggingRepo) AssignTenant(ids []int64, tenantId string) (n int64, err error) {
+	defer func(start time.Time) {
+		r.log("AssignTenant", fmt.Sprintf("ids=%v tenantId=%q", ids, tenantId), start, err)
+	}(time.Now())
+	return r.next.AssignTenant(ids, tenantId)
+}
+
+func (r *loggingRepo) Count() (n int64, err error) {
+	defer func(start time.Time) { r.log("Count", "", start, err) }(time.Now())
+	return r.next.Count()
+}
+
+func (r *loggingRepo) Search(query string, limit int) (users []*user.User, err error) {
+	defer func(start time.Time) {
+		r.log("Search", fmt.Sprintf("query=%q limit=%d", query, limit), start, err)
+	}(time.Now())
+	return r.next.Search(query, limit)
+}
+
+func (r *loggingRepo) Close() (err error) {
+	defer func(start time.Time) { r.log("Close", "", start, err) }(time.Now())
+	return r.next.Close()
+}
+
+func (r *loggingRepo) DomainCounts(limit int) (counts []DomainCount, err error) {
+	defer func(start time.Time) {
+		r.log("DomainCounts", fmt.Sprintf("limit=%d", limit), start, err)
+	}(time.Now())
+	return r.next.DomainCounts(limit)
+}
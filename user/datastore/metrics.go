@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/radovskyb/services/user"
+)
+
+// Metrics records operation latencies and counts. It's small enough to
+// be implemented by wrapping a Prometheus HistogramVec and CounterVec
+// labelled by name, without this package depending on Prometheus.
+type Metrics interface {
+	// ObserveLatency records that the operation name took d.
+	ObserveLatency(name string, d time.Duration)
+
+	// IncCounter increments the counter name.
+	IncCounter(name string)
+}
+
+// NoopMetrics is a Metrics that discards everything.
+var NoopMetrics Metrics = noopMetrics{}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveLatency(string, time.Duration) {}
+func (noopMetrics) IncCounter(string)                    {}
+
+// Observe records the latency of the operation name that started at
+// start in m, and increments the counter name + ".errors" if err isn't
+// nil.
+func Observe(m Metrics, name string, start time.Time, err error) {
+	m.ObserveLatency(name, time.Since(start))
+	if err != nil {
+		m.IncCounter(name + ".errors")
+	}
+}
+
+// instrumentedRepo is a UserRepository that records metrics for every
+// operation of the UserRepository it wraps.
+type instrumentedRepo struct {
+	next    UserRepository
+	metrics Metrics
+}
+
+// NewInstrumentedRepo returns a UserRepository that records the latency
+// of every operation on next in metrics as "repo.<Method>", and
+// increments "repo.<Method>.errors" whenever an operation fails.
+// If metrics is nil, NoopMetrics is used.
+//
+// The returned UserRepository only implements UserRepository, even if
+// next also implements interfaces such as TxCreator.
+func NewInstrumentedRepo(next UserRepository, metrics Metrics) UserRepository {
+	if metrics == nil {
+		metrics = NoopMetrics
+	}
+	return &instrumentedRepo{next: next, metrics: metrics}
+}
+
+func (r *instrumentedRepo) observe(method string, start time.Time, err error) {
+	Observe(r.metrics, "repo."+method, start, err)
+}
+
+func (r *instrumentedRepo) Create(u *user.User) (err error) {
+	defer func(start time.Time) { r.observe("Create", start, err) }(time.Now())
+	return r.next.Create(u)
+}
+
+func (r *instrumentedRepo) FindOrCreate(u *user.User) (stored *user.User, created bool, err error) {
+	defer func(start time.Time) { r.observe("FindOrCreate", start, err) }(time.Now())
+	return r.next.FindOrCreate(u)
+}
+
+func (r *instrumentedRepo) Get(id int64) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("Get", start, err) }(time.Now())
+	return r.next.Get(id)
+}
+
+func (r *instrumentedRepo) GetMany(ids []int64) (users map[int64]*user.User, err error) {
+	defer func(start time.Time) { r.observe("GetMany", start, err) }(time.Now())
+	return r.next.GetMany(ids)
+}
+
+func (r *instrumentedRepo) GetByEmail(email string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByEmail", start, err) }(time.Now())
+	return r.next.GetByEmail(email)
+}
+
+func (r *instrumentedRepo) GetByUsername(username string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByUsername", start, err) }(time.Now())
+	return r.next.GetByUsername(username)
+}
+
+func (r *instrumentedRepo) GetByTenantEmail(tenantId, email string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByTenantEmail", start, err) }(time.Now())
+	return r.next.GetByTenantEmail(tenantId, email)
+}
+
+func (r *instrumentedRepo) GetByTenantUsername(tenantId, username string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByTenantUsername", start, err) }(time.Now())
+	return r.next.GetByTenantUsername(tenantId, username)
+}
+
+func (r *instrumentedRepo) GetByEmailOrUsername(identifier string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByEmailOrUsername", start, err) }(time.Now())
+	return r.next.GetByEmailOrUsername(identifier)
+}
+
+func (r *instrumentedRepo) Update(u *user.User) (err error) {
+	defer func(start time.Time) { r.observe("Update", start, err) }(time.Now())
+	return r.next.Update(u)
+}
+
+func (r *instrumentedRepo) Delete(id int64) (err error) {
+	defer func(start time.Time) { r.observe("Delete", start, err) }(time.Now())
+	return r.next.Delete(id)
+}
+
+func (r *instrumentedRepo) UpdateEmail(id int64, email string) (err error) {
+	defer func(start time.Time) { r.observe("UpdateEmail", start, err) }(time.Now())
+	return r.next.UpdateEmail(id, email)
+}
+
+func (r *instrumentedRepo) UpdateUsername(id int64, username string) (err error) {
+	defer func(start time.Time) { r.observe("UpdateUsername", start, err) }(time.Now())
+	return r.next.UpdateUsername(id, username)
+}
+
+func (r *instrumentedRepo) Patch(id int64, update UserUpdate) (err error) {
+	defer func(start time.Time) { r.observe("Patch", start, err) }(time.Now())
+	return r.next.Patch(id, update)
+}
+
+func (r *instrumentedRepo) SetStatus(id int64, status string) (err error) {
+	defer func(start time.Time) { r.observe("SetStatus", start, err) }(time.Now())
+	return r.next.SetStatus(id, status)
+}
+
+func (r *instrumentedRepo) SetLastLogin(id int64, at time.Time) (err error) {
+	defer func(start time.Time) { r.observe("SetLastLogin", start, err) }(time.Now())
+	return r.next.SetLastLogin(id, at)
+}
+
+func (r *instrumentedRepo) AdvanceTOTPCounter(id, counter int64) (advanced bool, err error) {
+	defer func(start time.Time) { r.observe("AdvanceTOTPCounter", start, err) }(time.Now())
+	return r.next.AdvanceTOTPCounter(id, counter)
+}
+
+func (r *instrumentedRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) (err error) {
+	defer func(start time.Time) { r.observe("RecordFailedLogin", start, err) }(time.Now())
+	return r.next.RecordFailedLogin(id, at, windowStart, threshold, lockedUntil)
+}
+
+func (r *instrumentedRepo) ResetFailedLogins(id int64) (err error) {
+	defer func(start time.Time) { r.observe("ResetFailedLogins", start, err) }(time.Now())
+	return r.next.ResetFailedLogins(id)
+}
+
+func (r *instrumentedRepo) LinkProvider(id int64, provider, subject string) (err error) {
+	defer func(start time.Time) { r.observe("LinkProvider", start, err) }(time.Now())
+	return r.next.LinkProvider(id, provider, subject)
+}
+
+func (r *instrumentedRepo) GetByProvider(provider, subject string) (u *user.User, err error) {
+	defer func(start time.Time) { r.observe("GetByProvider", start, err) }(time.Now())
+	return r.next.GetByProvider(provider, subject)
+}
+
+func (r *instrumentedRepo) List(limit, offset int, opts ListOptions) (users []*user.User, err error) {
+	defer func(start time.Time) { r.observe("List", start, err) }(time.Now())
+	return r.next.List(limit, offset, opts)
+}
+
+func (r *instrumentedRepo) CreateBatch(users []*user.User) (err error) {
+	defer func(start time.Time) { r.observe("CreateBatch", start, err) }(time.Now())
+	return r.next.CreateBatch(users)
+}
+
+func (r *instrumentedRepo) AssignTenant(ids []int64, tenantId string) (n int64, err error) {
+	defer func(start time.Time) { r.observe("AssignTenant", start, err) }(time.Now())
+	return r.next.AssignTenant(ids, tenantId)
+}
+
+func (r *instrumentedRepo) Count() (n int64, err error) {
+	defer func(start time.Time) { r.observe("Count", start, err) }(time.Now())
+	return r.next.Count()
+}
+
+func (r *instrumentedRepo) Search(query string, limit int) (users []*user.User, err error) {
+	defer func(start time.Time) { r.observe("Search", start, err) }(time.Now())
+	return r.next.Search(query, limit)
+}
+
+func (r *instrumentedRepo) Close() (err error) {
+	defer func(start time.Time) { r.observe("Close", start, err) }(time.Now())
+	return r.next.Close()
+}
+
+func (r *instrumentedRepo) DomainCounts(limit int) (counts []DomainCount, err error) {
+	defer func(start time.Time) { r.observe("DomainCounts", start, err) }(time.Now())
+	return r.next.DomainCounts(limit)
+}
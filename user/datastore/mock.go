@@ -1,84 +1,308 @@
 package datastore
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/radovskyb/services/user"
 )
 
-var ErrRepoClosed = errors.New("database is closed")
+var ErrStoreClosed = errors.New("database is closed")
+
+// Deprecated: use ErrStoreClosed.
+var ErrRepoClosed = ErrStoreClosed
 
 type mockRepo struct {
 	mu    *sync.Mutex          // Protects the following.
 	idCnt int64                // Auto incrementing id counter.
 	users map[int64]*user.User // Id to User.
 
-	// Mock user unique keys.
-	emails    map[string]*user.User
-	usernames map[string]*user.User
+	// Mock user unique keys, mapped by tenant id and then by key.
+	// Emails are keyed in lowercase so they're case insensitive.
+	emails          map[string]map[string]*user.User
+	usernames       map[string]map[string]*user.User
+	canonicalEmails map[string]map[string]*user.User
+
+	// identities maps linked provider identities to user ids, by
+	// provider and then by subject.
+	identities map[string]map[string]int64
 }
 
 func NewMockRepo() UserRepository {
 	return &mockRepo{
 		mu:        new(sync.Mutex),
 		users:     make(map[int64]*user.User),
-		emails:    make(map[string]*user.User),
-		usernames: make(map[string]*user.User),
+		emails:    make(map[string]map[string]*user.User),
+		usernames: make(map[string]map[string]*user.User),
+
+		canonicalEmails: make(map[string]map[string]*user.User),
+		identities:      make(map[string]map[string]int64),
 	}
 }
 
-// Close returns a nil error so it can implement the
-// io.Closer interface, which can be useful for testing
-// when wanting to `cut` the connection to the mockRepo.
+// Close `cuts` the connection to the mockRepo, which can be useful
+// for testing. Every method returns ErrStoreClosed after it's called,
+// including Close.
 func (s *mockRepo) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.users == nil {
+		return ErrStoreClosed
+	}
 	s.users = nil
 	s.emails = nil
 	s.usernames = nil
+	s.canonicalEmails = nil
+	s.identities = nil
 
 	return nil
 }
 
-func (s *mockRepo) Create(u *user.User) error {
+// copyUser returns a different user pointer so fields being modified
+// doesn't directly update the database.
+func copyUser(u *user.User) *user.User {
+	c := *u
+	return &c
+}
+
+// WithTx snapshots the repository and restores the snapshot if fn
+// fails. Unlike a real transaction, fn's changes are visible to other
+// callers before fn returns.
+func (s *mockRepo) WithTx(fn func(r UserRepository) error) error {
+	s.mu.Lock()
+	if s.users == nil {
+		s.mu.Unlock()
+		return ErrStoreClosed
+	}
+	snapshot := s.snapshot()
+	s.mu.Unlock()
+
+	if err := fn(s); err != nil {
+		s.mu.Lock()
+		if s.users != nil {
+			*s = *snapshot
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// snapshot returns a copy of s that shares s's mutex.
+func (s *mockRepo) snapshot() *mockRepo {
+	c := &mockRepo{
+		mu:        s.mu,
+		idCnt:     s.idCnt,
+		users:     make(map[int64]*user.User, len(s.users)),
+		emails:    copyKeys(s.emails),
+		usernames: copyKeys(s.usernames),
+
+		canonicalEmails: copyKeys(s.canonicalEmails),
+		identities:      make(map[string]map[string]int64, len(s.identities)),
+	}
+	for id, u := range s.users {
+		c.users[id] = u
+	}
+	for provider, subjects := range s.identities {
+		c.identities[provider] = make(map[string]int64, len(subjects))
+		for subject, id := range subjects {
+			c.identities[provider][subject] = id
+		}
+	}
+	return c
+}
+
+// copyKeys copies a map of tenants to unique keys.
+func copyKeys(keys map[string]map[string]*user.User) map[string]map[string]*user.User {
+	c := make(map[string]map[string]*user.User, len(keys))
+	for tenantId, tenantKeys := range keys {
+		c[tenantId] = make(map[string]*user.User, len(tenantKeys))
+		for key, u := range tenantKeys {
+			c[tenantId][key] = u
+		}
+	}
+	return c
+}
+
+// Reset deletes every user and restarts ids from 1.
+func (s *mockRepo) Reset() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return ErrRepoClosed
+		return ErrStoreClosed
 	}
 
-	s.idCnt++
+	s.idCnt = 0
+	s.users = make(map[int64]*user.User)
+	s.emails = make(map[string]map[string]*user.User)
+	s.usernames = make(map[string]map[string]*user.User)
+	s.canonicalEmails = make(map[string]map[string]*user.User)
+	s.identities = make(map[string]map[string]int64)
+	return nil
+}
+
+// addKeys stores u's unique keys (email, username and canonical email,
+// if it's set) for u's tenant.
+func (s *mockRepo) addKeys(u *user.User) {
+	if s.emails[u.TenantId] == nil {
+		s.emails[u.TenantId] = make(map[string]*user.User)
+		s.usernames[u.TenantId] = make(map[string]*user.User)
+		s.canonicalEmails[u.TenantId] = make(map[string]*user.User)
+	}
+	s.emails[u.TenantId][strings.ToLower(u.Email)] = u
+	s.usernames[u.TenantId][u.Username] = u
+	if u.CanonicalEmail != "" {
+		s.canonicalEmails[u.TenantId][u.CanonicalEmail] = u
+	}
+}
+
+// removeKeys removes u's unique keys from u's tenant.
+func (s *mockRepo) removeKeys(u *user.User) {
+	delete(s.emails[u.TenantId], strings.ToLower(u.Email))
+	delete(s.usernames[u.TenantId], u.Username)
+	delete(s.canonicalEmails[u.TenantId], u.CanonicalEmail)
+}
 
-	// Check if the username or email already exists.
-	if _, found := s.emails[u.Email]; found {
+func (s *mockRepo) Create(u *user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return ErrStoreClosed
+	}
+	return s.create(u)
+}
+
+// create stores u. s.mu must be held.
+func (s *mockRepo) create(u *user.User) error {
+	// Check if the username or email already exists for u's tenant.
+	if _, found := s.emails[u.TenantId][strings.ToLower(u.Email)]; found {
+		return ErrDuplicateEmail
+	}
+	if _, found := s.canonicalEmails[u.TenantId][u.CanonicalEmail]; found {
 		return ErrDuplicateEmail
 	}
-	if _, found := s.usernames[u.Username]; found {
+	if _, found := s.usernames[u.TenantId][u.Username]; found {
 		return ErrDuplicateUsername
 	}
 
+	// Only consume an id once u can be created, like AUTO_INCREMENT.
+	s.idCnt++
+
 	// Make sure u's id is set to idCnt.
 	u.Id = s.idCnt
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
 
 	// Store the user.
 	s.users[s.idCnt] = u
 
 	// Store the unique user keys (email and username).
-	s.emails[u.Email] = u
-	s.usernames[u.Username] = u
+	s.addKeys(u)
 
 	return nil
 }
 
+// FindOrCreate holds s.mu across looking u up and creating it, so that
+// concurrent calls can't both create it.
+func (s *mockRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, false, ErrStoreClosed
+	}
+
+	if existing, found := s.emails[u.TenantId][strings.ToLower(u.Email)]; found {
+		return copyUser(existing), false, nil
+	}
+	if err := s.create(u); err != nil {
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+// CreateTx simulates a transaction by deleting u again if fn fails.
+// There's no database, so fn is called with a nil *sql.Tx.
+func (s *mockRepo) CreateTx(ctx context.Context, u *user.User,
+	fn func(tx *sql.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id := u.Id
+	if err := s.Create(u); err != nil {
+		return err
+	}
+	if fn != nil {
+		if err := fn(nil); err != nil {
+			s.Delete(u.Id)
+			u.Id = id
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBatch checks every user in users before storing any of them,
+// so that either all of them are created or none are.
+func (s *mockRepo) CreateBatch(users []*user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return ErrStoreClosed
+	}
+
+	// Check each user against the stored users and the earlier users
+	// in the batch.
+	batch := NewMockRepo().(*mockRepo)
+	for i, u := range users {
+		email := strings.ToLower(u.Email)
+		if _, found := s.emails[u.TenantId][email]; found {
+			return &BatchError{i, u.Email, ErrDuplicateEmail}
+		}
+		if _, found := batch.emails[u.TenantId][email]; found {
+			return &BatchError{i, u.Email, ErrDuplicateEmail}
+		}
+		if _, found := s.canonicalEmails[u.TenantId][u.CanonicalEmail]; found {
+			return &BatchError{i, u.Email, ErrDuplicateEmail}
+		}
+		if _, found := batch.canonicalEmails[u.TenantId][u.CanonicalEmail]; found {
+			return &BatchError{i, u.Email, ErrDuplicateEmail}
+		}
+		if _, found := s.usernames[u.TenantId][u.Username]; found {
+			return &BatchError{i, u.Email, ErrDuplicateUsername}
+		}
+		if _, found := batch.usernames[u.TenantId][u.Username]; found {
+			return &BatchError{i, u.Email, ErrDuplicateUsername}
+		}
+		batch.addKeys(u)
+	}
+
+	now := timestamp()
+	for _, u := range users {
+		s.idCnt++
+		u.Id = s.idCnt
+		u.CreatedAt, u.UpdatedAt = now, now
+		s.users[u.Id] = u
+		s.addKeys(u)
+	}
+	return nil
+}
+
 func (s *mockRepo) Get(id int64) (*user.User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return nil, ErrRepoClosed
+		return nil, ErrStoreClosed
 	}
 
 	// Make sure the user exists.
@@ -86,64 +310,81 @@ func (s *mockRepo) Get(id int64) (*user.User, error) {
 	if !found {
 		return nil, ErrUserNotFound
 	}
+	return copyUser(u), nil
+}
+
+func (s *mockRepo) GetMany(ids []int64) (map[int64]*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Return a different user pointer so fields being modified
-	// doesn't directly update the database.
-	new := &user.User{
-		Id:       u.Id,
-		Email:    u.Email,
-		Username: u.Username,
-		Password: u.Password,
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	users := make(map[int64]*user.User)
+	for _, id := range ids {
+		if u, found := s.users[id]; found {
+			users[id] = copyUser(u)
+		}
 	}
-	return new, nil
+	return users, nil
 }
 
 func (s *mockRepo) GetByEmail(email string) (*user.User, error) {
+	return s.GetByTenantEmail("", email)
+}
+
+func (s *mockRepo) GetByUsername(username string) (*user.User, error) {
+	return s.GetByTenantUsername("", username)
+}
+
+func (s *mockRepo) GetByTenantEmail(tenantId, email string) (*user.User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return nil, ErrRepoClosed
+		return nil, ErrStoreClosed
 	}
 
 	// Make sure the user exists.
-	u, found := s.emails[email]
+	u, found := s.emails[tenantId][strings.ToLower(email)]
 	if !found {
 		return nil, ErrUserNotFound
 	}
-	// Return a different user pointer so fields being modified
-	// doesn't directly update the database.
-	new := &user.User{
-		Id:       u.Id,
-		Email:    u.Email,
-		Username: u.Username,
-		Password: u.Password,
-	}
-	return new, nil
+	return copyUser(u), nil
 }
 
-func (s *mockRepo) GetByUsername(username string) (*user.User, error) {
+func (s *mockRepo) GetByTenantUsername(tenantId, username string) (*user.User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return nil, ErrRepoClosed
+		return nil, ErrStoreClosed
 	}
 
 	// Make sure the user exists.
-	u, found := s.usernames[username]
+	u, found := s.usernames[tenantId][username]
 	if !found {
 		return nil, ErrUserNotFound
 	}
-	// Return a different user pointer so fields being modified
-	// doesn't directly update the database.
-	new := &user.User{
-		Id:       u.Id,
-		Email:    u.Email,
-		Username: u.Username,
-		Password: u.Password,
+	return copyUser(u), nil
+}
+
+func (s *mockRepo) GetByEmailOrUsername(identifier string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	if u, found := s.emails[""][strings.ToLower(identifier)]; found {
+		return copyUser(u), nil
+	}
+	if u, found := s.usernames[""][identifier]; found {
+		return copyUser(u), nil
 	}
-	return new, nil
+	return nil, ErrUserNotFound
 }
 
 func (s *mockRepo) Update(u *user.User) error {
@@ -151,7 +392,7 @@ func (s *mockRepo) Update(u *user.User) error {
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return ErrRepoClosed
+		return ErrStoreClosed
 	}
 
 	// Check if the user exists.
@@ -162,7 +403,12 @@ func (s *mockRepo) Update(u *user.User) error {
 	// Update the email's key.
 	//
 	// Make sure the new email doesn't already exist.
-	if u2, found := s.emails[u.Email]; found {
+	if u2, found := s.emails[u.TenantId][strings.ToLower(u.Email)]; found {
+		if u2.Id != old.Id {
+			return ErrDuplicateEmail
+		}
+	}
+	if u2, found := s.canonicalEmails[u.TenantId][u.CanonicalEmail]; found {
 		if u2.Id != old.Id {
 			return ErrDuplicateEmail
 		}
@@ -170,7 +416,7 @@ func (s *mockRepo) Update(u *user.User) error {
 	// Update the username's key.
 	//
 	// Make sure the new username doesn't already exist.
-	if u2, found := s.usernames[u.Username]; found {
+	if u2, found := s.usernames[u.TenantId][u.Username]; found {
 		if u2.Id != old.Id {
 			return ErrDuplicateUsername
 		}
@@ -180,25 +426,135 @@ func (s *mockRepo) Update(u *user.User) error {
 	//
 	// Replace u instead so pointers can't be directly modified
 	// from previously returned users from the Get methods.
-	updated := &user.User{
-		Id:       u.Id,
-		Email:    u.Email,
-		Username: u.Username,
-		Password: u.Password,
-	}
+	u.UpdatedAt = timestamp()
+	updated := copyUser(u)
+	updated.CreatedAt = old.CreatedAt
+	updated.TOTPCounter = old.TOTPCounter
+	updated.FirstFailedAt = old.FirstFailedAt
 
 	s.users[u.Id] = updated
 
-	// Delete the old email.
-	delete(s.emails, old.Email)
-	// Add the new email.
-	s.emails[u.Email] = updated
+	// Delete the old email and username.
+	s.removeKeys(old)
+	// Add the new email and username.
+	s.addKeys(updated)
+
+	return nil
+}
+
+func (s *mockRepo) UpdateEmail(id int64, email string) error {
+	return s.Patch(id, UserUpdate{Email: &email})
+}
+
+func (s *mockRepo) UpdateUsername(id int64, username string) error {
+	return s.updateUser(id, func(u *user.User) { u.Username = username })
+}
+
+func (s *mockRepo) Patch(id int64, update UserUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	return s.updateUser(id, func(u *user.User) {
+		if update.Email != nil {
+			u.Email = *update.Email
+			u.EmailVerified = false
+			if u.CanonicalEmail != "" {
+				u.CanonicalEmail = user.CanonicalizeEmail(u.Email)
+			}
+		}
+		if update.Username != nil {
+			u.Username = *update.Username
+		}
+		if update.Password != nil {
+			u.Password = *update.Password
+		}
+		if update.Role != nil {
+			u.Role = *update.Role
+		}
+		if update.Status != nil {
+			u.Status = *update.Status
+			if u.Status == user.StatusDisabled {
+				u.SessionVersion++
+			}
+		}
+	})
+}
+
+func (s *mockRepo) SetStatus(id int64, status string) error {
+	return s.Patch(id, UserUpdate{Status: &status})
+}
+
+func (s *mockRepo) SetLastLogin(id int64, at time.Time) error {
+	return s.updateUser(id, func(u *user.User) { u.LastLoginAt = &at })
+}
+
+func (s *mockRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	advanced := false
+	err := s.updateUser(id, func(u *user.User) {
+		if counter > u.TOTPCounter {
+			u.TOTPCounter = counter
+			advanced = true
+		}
+	})
+	return advanced, err
+}
 
-	// Delete the old username.
-	delete(s.usernames, old.Username)
-	// Add the new username.
-	s.usernames[u.Username] = updated
+func (s *mockRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	return s.updateUser(id, func(u *user.User) {
+		if u.LockedUntil != nil || u.FirstFailedAt == nil || u.FirstFailedAt.Before(windowStart) {
+			u.FailedAttempts = 0
+			u.LockedUntil = nil
+		}
+		u.FailedAttempts++
+		if u.FailedAttempts == 1 {
+			u.FirstFailedAt = &at
+		}
+		if u.FailedAttempts >= threshold {
+			u.LockedUntil = &lockedUntil
+		}
+	})
+}
+
+func (s *mockRepo) ResetFailedLogins(id int64) error {
+	return s.updateUser(id, func(u *user.User) {
+		u.FailedAttempts = 0
+		u.LockedUntil = nil
+		u.FirstFailedAt = nil
+	})
+}
 
+// updateUser updates a copy of the user with the specified id with
+// update, and then stores it if its unique keys aren't taken.
+func (s *mockRepo) updateUser(id int64, update func(u *user.User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return ErrStoreClosed
+	}
+
+	old, found := s.users[id]
+	if !found {
+		return ErrUserNotFound
+	}
+	updated := copyUser(old)
+	update(updated)
+
+	if u2, found := s.emails[updated.TenantId][strings.ToLower(updated.Email)]; found && u2.Id != id {
+		return ErrDuplicateEmail
+	}
+	if u2, found := s.canonicalEmails[updated.TenantId][updated.CanonicalEmail]; found && u2.Id != id {
+		return ErrDuplicateEmail
+	}
+	if u2, found := s.usernames[updated.TenantId][updated.Username]; found && u2.Id != id {
+		return ErrDuplicateUsername
+	}
+
+	updated.UpdatedAt = timestamp()
+	s.users[id] = updated
+	s.removeKeys(old)
+	s.addKeys(updated)
 	return nil
 }
 
@@ -207,7 +563,7 @@ func (s *mockRepo) Delete(id int64) error {
 	defer s.mu.Unlock()
 
 	if s.users == nil {
-		return ErrRepoClosed
+		return ErrStoreClosed
 	}
 
 	u, found := s.users[id]
@@ -215,8 +571,241 @@ func (s *mockRepo) Delete(id int64) error {
 		return ErrUserNotFound
 	}
 	delete(s.users, id)
-	delete(s.emails, u.Email)
-	delete(s.usernames, u.Username)
+	s.removeKeys(u)
+
+	// Delete the user's provider identities.
+	for _, subjects := range s.identities {
+		for subject, userId := range subjects {
+			if userId == id {
+				delete(subjects, subject)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *mockRepo) LinkProvider(id int64, provider, subject string) error {
+	if !validIdentity(provider, subject) {
+		return ErrInvalidIdentity
+	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return ErrStoreClosed
+	}
+
+	if _, found := s.users[id]; !found {
+		return ErrUserNotFound
+	}
+	if _, found := s.identities[provider][subject]; found {
+		return ErrProviderLinked
+	}
+	if s.identities[provider] == nil {
+		s.identities[provider] = make(map[string]int64)
+	}
+	s.identities[provider][subject] = id
 	return nil
 }
+
+func (s *mockRepo) GetByProvider(provider, subject string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	id, found := s.identities[provider][subject]
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(s.users[id]), nil
+}
+
+func (s *mockRepo) List(limit, offset int, opts ListOptions) ([]*user.User, error) {
+	if _, ok := orderByColumns[opts.OrderBy]; !ok {
+		return nil, ErrInvalidOrderBy
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	ids := make([]int64, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.users[ids[i]], s.users[ids[j]]
+		if opts.Desc {
+			a, b = b, a
+		}
+		return lessBy(opts.OrderBy, a, b)
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	users := []*user.User{}
+	for i := offset; i < len(ids) && len(users) < limit; i++ {
+		users = append(users, copyUser(s.users[ids[i]]))
+	}
+	return users, nil
+}
+
+// lessBy reports whether a is ordered before b by the field orderBy,
+// falling back to their ids.
+func lessBy(orderBy string, a, b *user.User) bool {
+	switch orderBy {
+	case OrderByUsername:
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+	case OrderByEmail:
+		if a.Email != b.Email {
+			return a.Email < b.Email
+		}
+	case OrderByCreatedAt:
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	}
+	return a.Id < b.Id
+}
+
+func (s *mockRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	if !validTenantId(tenantId) {
+		return 0, ErrInvalidTenantId
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return 0, ErrStoreClosed
+	}
+
+	// Check that none of the moved users are duplicates in tenantId,
+	// either of its users or of each other, before moving any of them.
+	moved := NewMockRepo().(*mockRepo)
+	var users []*user.User
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		u, found := s.users[id]
+		if !found || u.TenantId == tenantId || seen[id] {
+			continue
+		}
+		seen[id] = true
+		m := copyUser(u)
+		m.TenantId = tenantId
+		email := strings.ToLower(m.Email)
+		if _, found := s.emails[tenantId][email]; found {
+			return 0, ErrDuplicateEmail
+		}
+		if _, found := moved.emails[tenantId][email]; found {
+			return 0, ErrDuplicateEmail
+		}
+		if _, found := s.canonicalEmails[tenantId][m.CanonicalEmail]; found {
+			return 0, ErrDuplicateEmail
+		}
+		if _, found := moved.canonicalEmails[tenantId][m.CanonicalEmail]; found {
+			return 0, ErrDuplicateEmail
+		}
+		if _, found := s.usernames[tenantId][m.Username]; found {
+			return 0, ErrDuplicateUsername
+		}
+		if _, found := moved.usernames[tenantId][m.Username]; found {
+			return 0, ErrDuplicateUsername
+		}
+		moved.addKeys(m)
+		users = append(users, m)
+	}
+
+	now := timestamp()
+	for _, m := range users {
+		s.removeKeys(s.users[m.Id])
+		m.UpdatedAt = now
+		s.users[m.Id] = m
+		s.addKeys(m)
+	}
+	return int64(len(users)), nil
+}
+
+func (s *mockRepo) Count() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return 0, ErrStoreClosed
+	}
+	return int64(len(s.users)), nil
+}
+
+func (s *mockRepo) Search(query string, limit int) ([]*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	query = strings.ToLower(query)
+	users := []*user.User{}
+	for _, u := range s.users {
+		if strings.Contains(strings.ToLower(u.Username), query) ||
+			strings.Contains(strings.ToLower(u.Email), query) {
+			users = append(users, copyUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+
+	if limit < 0 {
+		limit = 0
+	}
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (s *mockRepo) DomainCounts(limit int) ([]DomainCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users == nil {
+		return nil, ErrStoreClosed
+	}
+
+	// Bucket the users by their email's domain.
+	buckets := make(map[string]int)
+	for _, u := range s.users {
+		domain := strings.ToLower(u.Email[strings.LastIndex(u.Email, "@")+1:])
+		buckets[domain]++
+	}
+
+	counts := make([]DomainCount, 0, len(buckets))
+	for domain, users := range buckets {
+		counts = append(counts, DomainCount{domain, users})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Users != counts[j].Users {
+			return counts[i].Users > counts[j].Users
+		}
+		return counts[i].Domain < counts[j].Domain
+	})
+
+	if limit < 0 {
+		limit = 0
+	}
+	if limit < len(counts) {
+		counts = counts[:limit]
+	}
+	return counts, nil
+}
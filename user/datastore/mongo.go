@@ -0,0 +1,721 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/radovskyb/services/user"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The collections that mongoRepo stores users, their id sequence and
+// their provider identities in.
+const (
+	mongoUsersCollection      = "users"
+	mongoCountersCollection   = "counters"
+	mongoIdentitiesCollection = "user_identities"
+)
+
+// mongoIdentity is how a provider identity linked to a user is stored in
+// MongoDB. Its _id is the provider and subject, so each identity can only
+// be linked once.
+type mongoIdentity struct {
+	Id     mongoIdentityId `bson:"_id"`
+	UserId int64           `bson:"user_id"`
+}
+
+type mongoIdentityId struct {
+	Provider string `bson:"provider"`
+	Subject  string `bson:"subject"`
+}
+
+// mongoUser is how a user is stored in MongoDB.
+//
+// Users keep int64 ids, like the sql backed repositories, which are taken
+// from a sequence in the counters collection rather than using ObjectIDs.
+// Emails are compared case insensitively, so a lowercased copy of the
+// email is stored in email_key, which is what's indexed and looked up.
+type mongoUser struct {
+	Id                int64      `bson:"_id"`
+	Email             string     `bson:"email"`
+	EmailKey          string     `bson:"email_key"`
+	Username          string     `bson:"username"`
+	Password          string     `bson:"password"`
+	TenantId          string     `bson:"tenant_id"`
+	FailedAttempts    int        `bson:"failed_attempts"`
+	LockedUntil       *time.Time `bson:"locked_until"`
+	EmailVerified     bool       `bson:"email_verified"`
+	CanonicalEmail    string     `bson:"canonical_email,omitempty"`
+	Role              string     `bson:"role"`
+	PasswordChangedAt *time.Time `bson:"password_changed_at"`
+	CreatedAt         time.Time  `bson:"created_at"`
+	UpdatedAt         time.Time  `bson:"updated_at"`
+	TOTPSecret        string     `bson:"totp_secret"`
+	TOTPEnabled       bool       `bson:"totp_enabled"`
+	SessionVersion    int64      `bson:"session_version"`
+	Status            string     `bson:"status"`
+	LastLoginAt       *time.Time `bson:"last_login_at"`
+	TOTPCounter       int64      `bson:"totp_counter"`
+	FirstFailedAt     *time.Time `bson:"first_failed_at"`
+}
+
+func toMongoUser(u *user.User) *mongoUser {
+	return &mongoUser{
+		Id:                u.Id,
+		Email:             u.Email,
+		EmailKey:          strings.ToLower(u.Email),
+		Username:          u.Username,
+		Password:          u.Password,
+		TenantId:          u.TenantId,
+		FailedAttempts:    u.FailedAttempts,
+		LockedUntil:       u.LockedUntil,
+		EmailVerified:     u.EmailVerified,
+		CanonicalEmail:    u.CanonicalEmail,
+		Role:              u.Role,
+		PasswordChangedAt: u.PasswordChangedAt,
+		CreatedAt:         u.CreatedAt,
+		UpdatedAt:         u.UpdatedAt,
+		TOTPSecret:        u.TOTPSecret,
+		TOTPEnabled:       u.TOTPEnabled,
+		SessionVersion:    u.SessionVersion,
+		Status:            u.Status,
+		LastLoginAt:       u.LastLoginAt,
+		TOTPCounter:       u.TOTPCounter,
+		FirstFailedAt:     u.FirstFailedAt,
+	}
+}
+
+func (d *mongoUser) user() *user.User {
+	return &user.User{
+		Id:                d.Id,
+		Email:             d.Email,
+		Username:          d.Username,
+		Password:          d.Password,
+		TenantId:          d.TenantId,
+		FailedAttempts:    d.FailedAttempts,
+		LockedUntil:       d.LockedUntil,
+		EmailVerified:     d.EmailVerified,
+		CanonicalEmail:    d.CanonicalEmail,
+		Role:              d.Role,
+		PasswordChangedAt: d.PasswordChangedAt,
+		CreatedAt:         d.CreatedAt,
+		UpdatedAt:         d.UpdatedAt,
+		TOTPSecret:        d.TOTPSecret,
+		TOTPEnabled:       d.TOTPEnabled,
+		SessionVersion:    d.SessionVersion,
+		Status:            d.Status,
+		LastLoginAt:       d.LastLoginAt,
+		TOTPCounter:       d.TOTPCounter,
+		FirstFailedAt:     d.FirstFailedAt,
+	}
+}
+
+type mongoRepo struct {
+	db         *mongo.Database
+	users      *mongo.Collection
+	identities *mongo.Collection
+}
+
+// NewMongoRepo creates the unique indexes on the users collection of db
+// if they don't exist and returns a UserRepository backed by db.
+//
+// Users have int64 ids taken from a sequence in db's counters collection.
+// mongoRepo doesn't implement TxCreator or Transactor, and AssignTenant
+// and CreateBatch check for duplicates before writing rather than running
+// in a transaction, so they can partially apply if they race with other
+// writes.
+//
+// If the indexes can't be created, the returned UserRepository is nil.
+func NewMongoRepo(db *mongo.Database) (UserRepository, error) {
+	users := db.Collection(mongoUsersCollection)
+	_, err := users.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "email_key", Value: 1}},
+			Options: options.Index().SetName("tenant_email").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "username", Value: 1}},
+			Options: options.Index().SetName("tenant_username").SetUnique(true),
+		},
+		{
+			// Users without a canonical email aren't indexed, so that they
+			// don't collide with each other.
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "canonical_email", Value: 1}},
+			Options: options.Index().SetName("tenant_canonical_email").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"canonical_email": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	identities := db.Collection(mongoIdentitiesCollection)
+	_, err = identities.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Options: options.Index().SetName("user_id"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoRepo{db: db, users: users, identities: identities}, nil
+}
+
+// mongoTimestamp returns the current time, truncated to the millisecond
+// precision that MongoDB stores, so that the times set on users match
+// the times that are read back.
+func mongoTimestamp() time.Time {
+	return time.Now().Truncate(time.Millisecond)
+}
+
+// nextIds reserves n consecutive user ids and returns the first of them.
+func (s *mongoRepo) nextIds(n int) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := s.db.Collection(mongoCountersCollection).FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": mongoUsersCollection},
+		bson.M{"$inc": bson.M{"seq": int64(n)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq - int64(n) + 1, nil
+}
+
+// dupeErr converts a duplicate key error for u into either an
+// ErrDuplicateEmail or ErrDuplicateUsername. Any other error is returned
+// as is.
+//
+// MongoDB only reports the first index that was violated, so the
+// duplicate is found with checkDupes to make sure emails are checked
+// first.
+func (s *mongoRepo) dupeErr(u *user.User, err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	switch dupeErr := s.checkDupes(u); dupeErr {
+	case ErrDuplicateEmail, ErrDuplicateUsername:
+		return dupeErr
+	}
+	return duplicateKeyErr(err)
+}
+
+// duplicateKeyErr converts a duplicate key error, code 11000, into either
+// an ErrDuplicateEmail or ErrDuplicateUsername using the violated index's
+// name, for when the user that caused it isn't known.
+func duplicateKeyErr(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "tenant_email"),
+		strings.Contains(msg, "tenant_canonical_email"):
+		return ErrDuplicateEmail
+	case strings.Contains(msg, "tenant_username"):
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+// checkDupes checks whether u's email, canonical email or username is
+// taken by another user in u's tenant, in that order.
+func (s *mongoRepo) checkDupes(u *user.User) error {
+	type check struct {
+		field, value string
+		err          error
+	}
+	checks := []check{{"email_key", strings.ToLower(u.Email), ErrDuplicateEmail}}
+	if u.CanonicalEmail != "" {
+		checks = append(checks, check{"canonical_email", u.CanonicalEmail, ErrDuplicateEmail})
+	}
+	checks = append(checks, check{"username", u.Username, ErrDuplicateUsername})
+	for _, c := range checks {
+		n, err := s.users.CountDocuments(context.Background(), bson.M{
+			"tenant_id": u.TenantId,
+			c.field:     c.value,
+			"_id":       bson.M{"$ne": u.Id},
+		})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return c.err
+		}
+	}
+	return nil
+}
+
+func (s *mongoRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	return findOrCreate(s, u)
+}
+
+func (s *mongoRepo) Create(u *user.User) error {
+	id, createdAt, updatedAt := u.Id, u.CreatedAt, u.UpdatedAt
+	var err error
+	if u.Id, err = s.nextIds(1); err != nil {
+		u.Id = id
+		return err
+	}
+	u.CreatedAt = mongoTimestamp()
+	u.UpdatedAt = u.CreatedAt
+	if _, err := s.users.InsertOne(context.Background(), toMongoUser(u)); err != nil {
+		u.Id, u.CreatedAt, u.UpdatedAt = id, createdAt, updatedAt
+		return s.dupeErr(u, err)
+	}
+	return nil
+}
+
+func (s *mongoRepo) CreateBatch(users []*user.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	// Check for duplicates up front, so that a batch with a duplicate
+	// doesn't need to be undone.
+	if err := findBatchDupe(s, users); err != nil {
+		return err
+	}
+	first, err := s.nextIds(len(users))
+	if err != nil {
+		return err
+	}
+	restore := stampBatch(users)
+	now := mongoTimestamp()
+	docs := make([]interface{}, len(users))
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		u.Id = first + int64(i)
+		u.CreatedAt, u.UpdatedAt = now, now
+		docs[i] = toMongoUser(u)
+		ids[i] = u.Id
+	}
+	if _, err := s.users.InsertMany(context.Background(), docs); err != nil {
+		// Remove any users that were inserted before the error, so that
+		// none of the batch is created.
+		s.users.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+		restore()
+		return duplicateKeyErr(err)
+	}
+	return nil
+}
+
+// findOne returns the user matching filter.
+func (s *mongoRepo) findOne(filter bson.M) (*user.User, error) {
+	var d mongoUser
+	err := s.users.FindOne(context.Background(), filter).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.user(), nil
+}
+
+// find returns the users matching filter, configured by opts.
+func (s *mongoRepo) find(filter bson.M, opts *options.FindOptions) ([]*user.User, error) {
+	ctx := context.Background()
+	cur, err := s.users.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoUser
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	users := make([]*user.User, len(docs))
+	for i := range docs {
+		users[i] = docs[i].user()
+	}
+	return users, nil
+}
+
+func (s *mongoRepo) Get(id int64) (*user.User, error) {
+	return s.findOne(bson.M{"_id": id})
+}
+
+func (s *mongoRepo) GetMany(ids []int64) (map[int64]*user.User, error) {
+	if len(ids) == 0 {
+		return map[int64]*user.User{}, nil
+	}
+	users, err := s.find(bson.M{"_id": bson.M{"$in": ids}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int64]*user.User, len(users))
+	for _, u := range users {
+		m[u.Id] = u
+	}
+	return m, nil
+}
+
+func (s *mongoRepo) GetByEmail(email string) (*user.User, error) {
+	return s.GetByTenantEmail("", email)
+}
+
+func (s *mongoRepo) GetByUsername(username string) (*user.User, error) {
+	return s.GetByTenantUsername("", username)
+}
+
+func (s *mongoRepo) GetByTenantEmail(tenantId, email string) (*user.User, error) {
+	return s.findOne(bson.M{"tenant_id": tenantId, "email_key": strings.ToLower(email)})
+}
+
+func (s *mongoRepo) GetByTenantUsername(tenantId, username string) (*user.User, error) {
+	return s.findOne(bson.M{"tenant_id": tenantId, "username": username})
+}
+
+func (s *mongoRepo) GetByEmailOrUsername(identifier string) (*user.User, error) {
+	u, err := s.GetByEmail(identifier)
+	if !errors.Is(err, ErrUserNotFound) {
+		return u, err
+	}
+	return s.GetByUsername(identifier)
+}
+
+func (s *mongoRepo) Update(u *user.User) error {
+	updatedAt := mongoTimestamp()
+	d := toMongoUser(u)
+	update := bson.M{
+		"$set": bson.M{
+			"email":               d.Email,
+			"email_key":           d.EmailKey,
+			"username":            d.Username,
+			"password":            d.Password,
+			"tenant_id":           d.TenantId,
+			"failed_attempts":     d.FailedAttempts,
+			"locked_until":        d.LockedUntil,
+			"email_verified":      d.EmailVerified,
+			"role":                d.Role,
+			"password_changed_at": d.PasswordChangedAt,
+			"totp_secret":         d.TOTPSecret,
+			"totp_enabled":        d.TOTPEnabled,
+			"session_version":     d.SessionVersion,
+			"status":              d.Status,
+			"last_login_at":       d.LastLoginAt,
+			"updated_at":          updatedAt,
+		},
+	}
+	// An empty canonical email is removed, rather than stored, so that it
+	// isn't indexed.
+	if d.CanonicalEmail != "" {
+		update["$set"].(bson.M)["canonical_email"] = d.CanonicalEmail
+	} else {
+		update["$unset"] = bson.M{"canonical_email": ""}
+	}
+	res, err := s.users.UpdateOne(context.Background(), bson.M{"_id": u.Id}, update)
+	if err != nil {
+		return s.dupeErr(u, err)
+	}
+	if res.MatchedCount != 1 {
+		return ErrUserNotFound
+	}
+	u.UpdatedAt = updatedAt
+	return nil
+}
+
+func (s *mongoRepo) UpdateEmail(id int64, email string) error {
+	return s.Patch(id, UserUpdate{Email: &email})
+}
+
+func (s *mongoRepo) UpdateUsername(id int64, username string) error {
+	return s.setFields(id, bson.M{"username": username})
+}
+
+func (s *mongoRepo) Patch(id int64, update UserUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	// The fields are set with an aggregation pipeline, so that a
+	// canonical email can be set depending on whether there already is
+	// one. Values are wrapped in $literal so that ones starting with $,
+	// such as password hashes, aren't read as field paths.
+	fields := bson.M{"updated_at": mongoTimestamp()}
+	columns, values := update.columns()
+	for i, column := range columns {
+		fields[column] = bson.M{"$literal": values[i]}
+	}
+	if _, found := fields["session_version"]; found {
+		fields["session_version"] = bson.M{"$add": bson.A{"$session_version", 1}}
+	}
+	if update.Email != nil {
+		fields["email_key"] = bson.M{"$literal": strings.ToLower(*update.Email)}
+		// Users without a canonical email are left without one, so that
+		// it isn't indexed.
+		fields["canonical_email"] = bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$canonical_email", ""}}, ""}},
+			"$$REMOVE",
+			fields["canonical_email"],
+		}}
+	}
+	res, err := s.users.UpdateOne(context.Background(), bson.M{"_id": id},
+		mongo.Pipeline{{{Key: "$set", Value: fields}}})
+	if err != nil {
+		return duplicateKeyErr(err)
+	}
+	if res.MatchedCount != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoRepo) SetStatus(id int64, status string) error {
+	return s.Patch(id, UserUpdate{Status: &status})
+}
+
+func (s *mongoRepo) SetLastLogin(id int64, at time.Time) error {
+	return s.setFields(id, bson.M{"last_login_at": at})
+}
+
+func (s *mongoRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	// $not also matches users stored before totp_counter was added.
+	res, err := s.users.UpdateOne(context.Background(),
+		bson.M{"_id": id, "totp_counter": bson.M{"$not": bson.M{"$gte": counter}}},
+		bson.M{"$set": bson.M{"totp_counter": counter, "updated_at": mongoTimestamp()}})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 1 {
+		return true, nil
+	}
+	// Tell an old counter apart from a missing user.
+	if _, err := s.Get(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *mongoRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	// The pipeline's stages run in order, so first_failed_at and
+	// locked_until are set from the new failed_attempts.
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failed_attempts": bson.M{"$cond": bson.A{
+				bson.M{"$or": bson.A{
+					bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$locked_until", nil}}, nil}},
+					bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$first_failed_at", nil}}, nil}},
+					bson.M{"$lt": bson.A{"$first_failed_at", windowStart}},
+				}},
+				1,
+				bson.M{"$add": bson.A{"$failed_attempts", 1}},
+			}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"first_failed_at": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$failed_attempts", 1}}, at, "$first_failed_at",
+			}},
+			"locked_until": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$failed_attempts", threshold}}, lockedUntil, nil,
+			}},
+			"updated_at": mongoTimestamp(),
+		}}},
+	}
+	res, err := s.users.UpdateOne(context.Background(), bson.M{"_id": id}, pipeline)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoRepo) ResetFailedLogins(id int64) error {
+	return s.setFields(id, bson.M{
+		"failed_attempts": 0, "locked_until": nil, "first_failed_at": nil,
+	})
+}
+
+// setFields sets fields for the user with the specified id.
+func (s *mongoRepo) setFields(id int64, fields bson.M) error {
+	fields["updated_at"] = mongoTimestamp()
+	res, err := s.users.UpdateOne(context.Background(),
+		bson.M{"_id": id}, bson.M{"$set": fields})
+	if err != nil {
+		return duplicateKeyErr(err)
+	}
+	if res.MatchedCount != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *mongoRepo) Delete(id int64) error {
+	ctx := context.Background()
+	res, err := s.users.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return ErrUserNotFound
+	}
+	_, err = s.identities.DeleteMany(ctx, bson.M{"user_id": id})
+	return err
+}
+
+func (s *mongoRepo) LinkProvider(id int64, provider, subject string) error {
+	if !validIdentity(provider, subject) {
+		return ErrInvalidIdentity
+	}
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	_, err := s.identities.InsertOne(context.Background(), mongoIdentity{
+		Id:     mongoIdentityId{Provider: provider, Subject: subject},
+		UserId: id,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrProviderLinked
+	}
+	return err
+}
+
+func (s *mongoRepo) GetByProvider(provider, subject string) (*user.User, error) {
+	var identity mongoIdentity
+	err := s.identities.FindOne(context.Background(), bson.M{
+		"_id": mongoIdentityId{Provider: provider, Subject: subject},
+	}).Decode(&identity)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(identity.UserId)
+}
+
+func (s *mongoRepo) List(limit, offset int, opts ListOptions) ([]*user.User, error) {
+	column, ok := orderByColumns[opts.OrderBy]
+	if !ok {
+		return nil, ErrInvalidOrderBy
+	}
+	if limit <= 0 {
+		// A limit of 0 means no limit to MongoDB.
+		return []*user.User{}, nil
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	dir := 1
+	if opts.Desc {
+		dir = -1
+	}
+	// Emails are ordered by their lowercased copy, since they're compared
+	// case insensitively.
+	sort := bson.D{{Key: "_id", Value: dir}}
+	switch column {
+	case "id":
+	case "email":
+		sort = append(bson.D{{Key: "email_key", Value: dir}}, sort...)
+	default:
+		sort = append(bson.D{{Key: column, Value: dir}}, sort...)
+	}
+	return s.find(bson.M{}, options.Find().
+		SetSort(sort).SetSkip(int64(offset)).SetLimit(int64(limit)))
+}
+
+func (s *mongoRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	if !validTenantId(tenantId) {
+		return 0, ErrInvalidTenantId
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "tenant_id": bson.M{"$ne": tenantId}}
+
+	// Check that none of the users being moved would be duplicates in
+	// tenantId, so that either all or none of them are moved.
+	moving, err := s.find(filter, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range moving {
+		u.TenantId = tenantId
+	}
+	if err := findBatchDupe(s, moving); err != nil {
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			return 0, batchErr.Err
+		}
+		return 0, err
+	}
+
+	res, err := s.users.UpdateMany(context.Background(), filter,
+		bson.M{"$set": bson.M{"tenant_id": tenantId, "updated_at": mongoTimestamp()}})
+	if err != nil {
+		return 0, duplicateKeyErr(err)
+	}
+	return res.ModifiedCount, nil
+}
+
+func (s *mongoRepo) Count() (int64, error) {
+	return s.users.CountDocuments(context.Background(), bson.M{})
+}
+
+func (s *mongoRepo) Search(query string, limit int) ([]*user.User, error) {
+	if limit <= 0 {
+		return []*user.User{}, nil
+	}
+	pattern := bson.M{"$regex": regexp.QuoteMeta(query), "$options": "i"}
+	return s.find(
+		bson.M{"$or": bson.A{bson.M{"username": pattern}, bson.M{"email": pattern}}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)),
+	)
+}
+
+func (s *mongoRepo) DomainCounts(limit int) ([]DomainCount, error) {
+	if limit <= 0 {
+		return []DomainCount{}, nil
+	}
+	ctx := context.Background()
+	domain := bson.M{"$toLower": bson.M{"$arrayElemAt": bson.A{
+		bson.M{"$split": bson.A{"$email", "@"}}, 1,
+	}}}
+	cur, err := s.users.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": domain, "users": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "users", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Domain string `bson:"_id"`
+		Users  int    `bson:"users"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	counts := make([]DomainCount, len(docs))
+	for i, d := range docs {
+		counts[i] = DomainCount{Domain: d.Domain, Users: d.Users}
+	}
+	return counts, nil
+}
+
+// Close disconnects db's client.
+func (s *mongoRepo) Close() error {
+	return s.db.Client().Disconnect(context.Background())
+}
+
+// Reset deletes every user and their provider identities, and restarts
+// the users' id sequence.
+func (s *mongoRepo) Reset() error {
+	ctx := context.Background()
+	if _, err := s.users.DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	if _, err := s.identities.DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	_, err := s.db.Collection(mongoCountersCollection).DeleteOne(ctx,
+		bson.M{"_id": mongoUsersCollection})
+	return err
+}
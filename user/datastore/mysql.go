@@ -1,8 +1,11 @@
 package datastore
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/radovskyb/services/user"
@@ -10,82 +13,414 @@ import (
 
 const createUserTableSQL = `CREATE TABLE IF NOT EXISTS users (
 	id INTEGER PRIMARY KEY AUTO_INCREMENT,
-	email VARCHAR(255) UNIQUE NOT NULL,
-	username VARCHAR(25) UNIQUE NOT NULL,
-	password VARCHAR(72) NOT NULL
+	email VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci NOT NULL,
+	username VARCHAR(25) NOT NULL,
+	password VARCHAR(255) NOT NULL,
+	tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+	failed_attempts INTEGER NOT NULL DEFAULT 0,
+	locked_until DATETIME NULL,
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	canonical_email VARCHAR(255) NULL,
+	role VARCHAR(32) NOT NULL DEFAULT 'user',
+	password_changed_at DATETIME NULL,
+	created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	totp_secret VARCHAR(64) NOT NULL DEFAULT '',
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	session_version INTEGER NOT NULL DEFAULT 0,
+	status VARCHAR(16) NOT NULL DEFAULT 'active',
+	last_login_at DATETIME(6) NULL,
+	totp_counter BIGINT NOT NULL DEFAULT 0,
+	first_failed_at DATETIME(6) NULL,
+	UNIQUE KEY tenant_email (tenant_id, email),
+	UNIQUE KEY tenant_username (tenant_id, username),
+	UNIQUE KEY tenant_canonical_email (tenant_id, canonical_email)
 );`
 
-type mysqlRepo struct{ db *sql.DB }
+// createUserIdentitiesTableSQL creates the table of provider identities
+// linked to users. It has no foreign key to users, since MySQL can't
+// truncate a table that a foreign key references, which Reset does.
+// Without ON DELETE CASCADE, Delete removes a user's identities itself.
+const createUserIdentitiesTableSQL = `CREATE TABLE IF NOT EXISTS user_identities (
+	provider VARCHAR(64) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	user_id INTEGER NOT NULL,
+	PRIMARY KEY (provider, subject),
+	KEY user_id (user_id)
+);`
+
+type mysqlRepo struct {
+	db    querier
+	stmts *mysqlStmts
+}
 
+// mysqlStmts are the statements for mysqlRepo's most common operations,
+// which are prepared once by NewMySQLRepo, rather than being parsed by
+// MySQL every time they're run.
+type mysqlStmts struct {
+	insert           *sql.Stmt
+	get              *sql.Stmt
+	getByEmail       *sql.Stmt
+	getByUsername    *sql.Stmt
+	update           *sql.Stmt
+	delete           *sql.Stmt
+	deleteIdentities *sql.Stmt
+}
+
+// prepareMySQLStmts prepares mysqlStmts on db. If any statement can't be
+// prepared, the ones that were are closed.
+func prepareMySQLStmts(db *sql.DB) (*mysqlStmts, error) {
+	stmts := new(mysqlStmts)
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&stmts.insert, `INSERT INTO users (email, username, password, tenant_id,
+			failed_attempts, locked_until, email_verified, canonical_email,
+			role, password_changed_at, created_at, updated_at,
+			totp_secret, totp_enabled, session_version, status, last_login_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`},
+		{&stmts.get, "SELECT " + userColumns + " FROM users WHERE id = ?"},
+		{&stmts.getByEmail, "SELECT " + userColumns + " FROM users WHERE tenant_id = ? AND email = ?"},
+		{&stmts.getByUsername, "SELECT " + userColumns + " FROM users WHERE tenant_id = ? AND username = ?"},
+		{&stmts.update, `UPDATE users SET email = ?, username = ?, password = ?,
+			tenant_id = ?, failed_attempts = ?, locked_until = ?,
+			email_verified = ?, canonical_email = ?, role = ?,
+			password_changed_at = ?, totp_secret = ?, totp_enabled = ?,
+			session_version = ?, status = ?, last_login_at = ?, updated_at = ?
+			WHERE id = ?`},
+		{&stmts.delete, "DELETE FROM users WHERE id = ?"},
+		{&stmts.deleteIdentities, "DELETE FROM user_identities WHERE user_id = ?"},
+	}
+	for _, q := range queries {
+		stmt, err := db.Prepare(q.query)
+		if err != nil {
+			stmts.close()
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	return stmts, nil
+}
+
+// close closes every statement in stmts that was prepared.
+func (stmts *mysqlStmts) close() error {
+	var err error
+	for _, stmt := range []*sql.Stmt{
+		stmts.insert, stmts.get, stmts.getByEmail, stmts.getByUsername,
+		stmts.update, stmts.delete, stmts.deleteIdentities,
+	} {
+		if stmt == nil {
+			continue
+		}
+		if closeErr := stmt.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// stmt returns stmt, bound to s's transaction if s is bound to one.
+func (s *mysqlRepo) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if tx, ok := s.db.(*sql.Tx); ok {
+		return tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// NewMySQLRepo creates the users and user_identities tables if they don't
+// exist, prepares the repository's most common statements and returns a
+// UserRepository backed by db. db's DSN must set parseTime=true. The
+// statements are closed by Close.
+//
+// If the tables can't be created or the statements can't be prepared,
+// the returned UserRepository is nil.
 func NewMySQLRepo(db *sql.DB) (UserRepository, error) {
-	_, err := db.Exec(createUserTableSQL)
-	return &mysqlRepo{db}, err
+	if _, err := db.Exec(createUserTableSQL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createUserIdentitiesTableSQL); err != nil {
+		return nil, err
+	}
+	stmts, err := prepareMySQLStmts(db)
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlRepo{db: db, stmts: stmts}, nil
 }
 
 func (s *mysqlRepo) Create(u *user.User) error {
-	_, err := s.db.Exec(
-		"INSERT INTO users (email, username, password) VALUES (?, ?, ?)",
-		u.Email, u.Username, u.Password,
-	)
+	return s.CreateTx(context.Background(), u, nil)
+}
+
+func (s *mysqlRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	return findOrCreate(s, u)
+}
+
+func (s *mysqlRepo) CreateTx(ctx context.Context, u *user.User,
+	fn func(tx *sql.Tx) error) error {
+	var insertErr error
+	id, createdAt, updatedAt := u.Id, u.CreatedAt, u.UpdatedAt
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.StmtContext(ctx, s.stmts.insert).ExecContext(ctx,
+			u.Email, u.Username, u.Password, u.TenantId,
+			u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+			nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+			u.CreatedAt, u.UpdatedAt, u.TOTPSecret, u.TOTPEnabled,
+			u.SessionVersion, u.Status, u.LastLoginAt,
+		)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		// Set u's id to the inserted row's id.
+		if u.Id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if fn != nil {
+			return fn(tx)
+		}
+		return nil
+	})
 	if err != nil {
-		mysqlErr, ok := err.(*mysql.MySQLError)
-		if ok && mysqlErr.Number == 1062 {
-			if dupeErr := s.checkDupes(u); dupeErr != nil {
-				return dupeErr
+		u.Id, u.CreatedAt, u.UpdatedAt = id, createdAt, updatedAt
+		if err == insertErr {
+			return s.dupeErr(u, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// dupeErr converts a duplicate entry error for u into either an
+// ErrDuplicateEmail or ErrDuplicateUsername.
+func (s *mysqlRepo) dupeErr(u *user.User, err error) error {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	if ok && mysqlErr.Number == 1062 {
+		if dupeErr := s.checkDupes(u); dupeErr != nil {
+			return dupeErr
+		}
+	}
+	if !ok {
+		return fmt.Errorf("error converting to mysql error: %w", err)
+	}
+	return err
+}
+
+func (s *mysqlRepo) CreateBatch(users []*user.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	restore := stampBatch(users)
+	var insertErr error
+	err := withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			insertUsersSQL(len(users), func(int) string { return "?" }),
+			insertUserArgs(users)...,
+		)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		// Read each user's id back, since a multi-row insert's ids
+		// aren't guaranteed to be consecutive, such as with
+		// auto_increment_increment set or interleaved lock modes.
+		for _, u := range users {
+			err := tx.QueryRow(
+				"SELECT id FROM users WHERE tenant_id = ? AND email = ?",
+				u.TenantId, u.Email,
+			).Scan(&u.Id)
+			if err != nil {
+				return err
 			}
 		}
-		if !ok {
-			return fmt.Errorf("error converting to mysql error: %s", err.Error())
+		return nil
+	})
+	if err != nil {
+		restore()
+		if err == insertErr {
+			if dupeErr := findBatchDupe(s, users); dupeErr != nil {
+				return dupeErr
+			}
 		}
+		return err
 	}
 	return nil
 }
 
+func (s *mysqlRepo) WithTx(fn func(r UserRepository) error) error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		return fn(&mysqlRepo{db: tx, stmts: s.stmts})
+	})
+}
+
 func (s *mysqlRepo) Get(id int64) (*user.User, error) {
-	u := new(user.User)
-	row := s.db.QueryRow("SELECT * FROM users WHERE id = ?", id)
-	err := row.Scan(&u.Id, &u.Email, &u.Username, &u.Password)
-	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
+	return scanUser(s.stmt(s.stmts.get).QueryRow(id))
+}
+
+func (s *mysqlRepo) GetMany(ids []int64) (map[int64]*user.User, error) {
+	if len(ids) == 0 {
+		return map[int64]*user.User{}, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
 	}
-	return u, err
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+" FROM users WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserMap(rows)
 }
 
 func (s *mysqlRepo) GetByEmail(email string) (*user.User, error) {
-	u := new(user.User)
-	row := s.db.QueryRow("SELECT * FROM users WHERE email = ?", email)
-	err := row.Scan(&u.Id, &u.Email, &u.Username, &u.Password)
-	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
-	}
-	return u, err
+	return s.GetByTenantEmail("", email)
 }
 
 func (s *mysqlRepo) GetByUsername(username string) (*user.User, error) {
-	u := new(user.User)
-	row := s.db.QueryRow("SELECT * FROM users WHERE username = ?", username)
-	err := row.Scan(&u.Id, &u.Email, &u.Username, &u.Password)
-	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
-	}
-	return u, err
+	return s.GetByTenantUsername("", username)
+}
+
+func (s *mysqlRepo) GetByTenantEmail(tenantId, email string) (*user.User, error) {
+	return scanUser(s.stmt(s.stmts.getByEmail).QueryRow(tenantId, email))
+}
+
+func (s *mysqlRepo) GetByTenantUsername(tenantId, username string) (*user.User, error) {
+	return scanUser(s.stmt(s.stmts.getByUsername).QueryRow(tenantId, username))
+}
+
+func (s *mysqlRepo) GetByEmailOrUsername(identifier string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users WHERE tenant_id = '' AND (email = ? OR username = ?)
+			ORDER BY email = ? DESC LIMIT 1`, identifier, identifier, identifier,
+	))
 }
 
 func (s *mysqlRepo) Update(u *user.User) error {
+	updatedAt := timestamp()
+	res, err := s.stmt(s.stmts.update).Exec(
+		u.Email, u.Username, u.Password, u.TenantId,
+		u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+		nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+		u.TOTPSecret, u.TOTPEnabled, u.SessionVersion, u.Status,
+		u.LastLoginAt, updatedAt, u.Id,
+	)
+	if err != nil {
+		return s.dupeErr(u, err)
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	affected, _ := res.RowsAffected()
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	u.UpdatedAt = updatedAt
+	return nil
+}
+
+func (s *mysqlRepo) UpdateEmail(id int64, email string) error {
+	return s.Patch(id, UserUpdate{Email: &email})
+}
+
+func (s *mysqlRepo) UpdateUsername(id int64, username string) error {
+	return s.updateColumn(id, "username", username)
+}
+
+func (s *mysqlRepo) SetStatus(id int64, status string) error {
+	return s.Patch(id, UserUpdate{Status: &status})
+}
+
+func (s *mysqlRepo) SetLastLogin(id int64, at time.Time) error {
+	return s.updateColumn(id, "last_login_at", at)
+}
+
+func (s *mysqlRepo) Patch(id int64, update UserUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	columns, values := update.columns()
 	res, err := s.db.Exec(
-		"UPDATE users SET email = ?, username = ?, password = ? WHERE id = ?",
-		u.Email, u.Username, u.Password, u.Id,
+		patchUserSQL(columns, func(int) string { return "?" }),
+		append(values, timestamp(), id)...,
 	)
 	if err != nil {
-		mysqlErr, ok := err.(*mysql.MySQLError)
-		if ok && mysqlErr.Number == 1062 {
-			if dupeErr := s.checkDupes(u); dupeErr != nil {
-				return dupeErr
-			}
-		}
-		if !ok {
-			return fmt.Errorf("error converting to mysql error: %s", err.Error())
-		}
+		return uniqueKeyErr(err)
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	affected, _ := res.RowsAffected()
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *mysqlRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE users SET totp_counter = ?, updated_at = ?
+		WHERE id = ? AND totp_counter < ?`, counter, timestamp(), id, counter)
+	if err != nil {
+		return false, err
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	if affected, _ := res.RowsAffected(); affected == 1 {
+		return true, nil
+	}
+	// Tell an old counter apart from a missing user.
+	if _, err := s.Get(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *mysqlRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	// MySQL assigns columns from left to right, so first_failed_at and
+	// locked_until are set from the new failed_attempts, but
+	// failed_attempts is set from the previous row.
+	res, err := s.db.Exec(`UPDATE users SET
+		failed_attempts = CASE WHEN locked_until IS NOT NULL OR first_failed_at IS NULL
+			OR first_failed_at < ? THEN 1 ELSE failed_attempts + 1 END,
+		first_failed_at = CASE WHEN failed_attempts = 1 THEN ? ELSE first_failed_at END,
+		locked_until = CASE WHEN failed_attempts >= ? THEN ? ELSE NULL END,
+		updated_at = ? WHERE id = ?`,
+		windowStart, at, threshold, lockedUntil, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	affected, _ := res.RowsAffected()
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *mysqlRepo) ResetFailedLogins(id int64) error {
+	res, err := s.db.Exec(`UPDATE users SET failed_attempts = 0, locked_until = NULL,
+		first_failed_at = NULL, updated_at = ? WHERE id = ?`, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	affected, _ := res.RowsAffected()
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// updateColumn sets column to value for the user with the specified id.
+// column must be a trusted column name.
+func (s *mysqlRepo) updateColumn(id int64, column string, value interface{}) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET "+column+" = ?, updated_at = ? WHERE id = ?",
+		value, timestamp(), id,
+	)
+	if err != nil {
+		return uniqueKeyErr(err)
 	}
 	// MySQL driver won't return an error for res.RowsAffected.
 	affected, _ := res.RowsAffected()
@@ -96,8 +431,35 @@ func (s *mysqlRepo) Update(u *user.User) error {
 }
 
 func (s *mysqlRepo) Delete(id int64) error {
-	res, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		res, err := tx.Stmt(s.stmts.delete).Exec(id)
+		if err != nil {
+			return err
+		}
+		// MySQL driver won't return an error for res.RowsAffected.
+		affected, _ := res.RowsAffected()
+		if affected != 1 {
+			return ErrUserNotFound
+		}
+		_, err = tx.Stmt(s.stmts.deleteIdentities).Exec(id)
+		return err
+	})
+}
+
+func (s *mysqlRepo) LinkProvider(id int64, provider, subject string) error {
+	if !validIdentity(provider, subject) {
+		return ErrInvalidIdentity
+	}
+	// Only insert the identity if the user exists.
+	res, err := s.db.Exec(
+		`INSERT INTO user_identities (provider, subject, user_id)
+			SELECT ?, ?, id FROM users WHERE id = ?`,
+		provider, subject, id,
+	)
 	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+			return ErrProviderLinked
+		}
 		return err
 	}
 	// MySQL driver won't return an error for res.RowsAffected.
@@ -105,21 +467,150 @@ func (s *mysqlRepo) Delete(id int64) error {
 	if affected != 1 {
 		return ErrUserNotFound
 	}
+	return nil
+}
+
+func (s *mysqlRepo) GetByProvider(provider, subject string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users
+			JOIN user_identities ON user_identities.user_id = users.id
+			WHERE user_identities.provider = ? AND user_identities.subject = ?`,
+		provider, subject,
+	))
+}
+
+func (s *mysqlRepo) List(limit, offset int, opts ListOptions) ([]*user.User, error) {
+	orderBy, err := orderByClause(opts)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+" FROM users "+orderBy+" LIMIT ? OFFSET ?", limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *mysqlRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	if !validTenantId(tenantId) {
+		return 0, ErrInvalidTenantId
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{tenantId, timestamp(), tenantId}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	res, err := s.db.Exec(
+		`UPDATE users SET tenant_id = ?, updated_at = ? WHERE tenant_id <> ?
+			AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...,
+	)
+	if err != nil {
+		return 0, uniqueKeyErr(err)
+	}
+	// MySQL driver won't return an error for res.RowsAffected.
+	affected, _ := res.RowsAffected()
+	return affected, nil
+}
+
+// uniqueKeyErr converts a duplicate entry error into either an
+// ErrDuplicateEmail or ErrDuplicateUsername using the name of the
+// unique key, for when the user that caused it isn't known.
+func uniqueKeyErr(err error) error {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	if !ok || mysqlErr.Number != 1062 {
+		return err
+	}
+	switch {
+	case strings.Contains(mysqlErr.Message, "email'"):
+		return ErrDuplicateEmail
+	case strings.Contains(mysqlErr.Message, "username'"):
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+func (s *mysqlRepo) Count() (int64, error) {
+	var n int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+func (s *mysqlRepo) Search(query string, limit int) ([]*user.User, error) {
+	query = strings.ToLower(likeEscaper.Replace(query))
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+` FROM users WHERE LOWER(username) LIKE CONCAT('%', ?, '%')
+			OR LOWER(email) LIKE CONCAT('%', ?, '%') ORDER BY id LIMIT ?`,
+		query, query, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *mysqlRepo) DomainCounts(limit int) ([]DomainCount, error) {
+	rows, err := s.db.Query(
+		`SELECT LOWER(SUBSTRING_INDEX(email, '@', -1)) AS d, COUNT(*) FROM users
+			GROUP BY d ORDER BY 2 DESC, d LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDomainCounts(rows)
+}
+
+// Close closes s's prepared statements and database. A repository bound
+// to a transaction by WithTx doesn't own either, so closing it does
+// nothing.
+func (s *mysqlRepo) Close() error {
+	if _, ok := s.db.(*sql.DB); !ok {
+		return nil
+	}
+	if err := s.stmts.close(); err != nil {
+		s.db.(*sql.DB).Close()
+		return err
+	}
+	return closeDB(s.db)
+}
+
+// Reset truncates the users and user_identities tables, which also
+// restarts the users' ids.
+func (s *mysqlRepo) Reset() error {
+	if _, err := s.db.Exec("TRUNCATE TABLE users"); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("TRUNCATE TABLE user_identities")
 	return err
 }
 
 func (s *mysqlRepo) checkDupes(u *user.User) error {
 	var id int64
-	// Check if the email already exists.
+	// Check if the email already exists for u's tenant.
 	err1 := s.db.QueryRow(
-		"SELECT id FROM users WHERE email = ?", u.Email,
+		"SELECT id FROM users WHERE tenant_id = ? AND email = ?",
+		u.TenantId, u.Email,
 	).Scan(&id)
 	if id != 0 && id != u.Id {
 		return ErrDuplicateEmail
 	}
-	// Check if the username already exists.
+	// Check if the canonical email already exists for u's tenant.
+	if u.CanonicalEmail != "" {
+		s.db.QueryRow(
+			"SELECT id FROM users WHERE tenant_id = ? AND canonical_email = ?",
+			u.TenantId, u.CanonicalEmail,
+		).Scan(&id)
+		if id != 0 && id != u.Id {
+			return ErrDuplicateEmail
+		}
+	}
+	// Check if the username already exists for u's tenant.
 	err2 := s.db.QueryRow(
-		"SELECT id FROM users WHERE username = ?", u.Username,
+		"SELECT id FROM users WHERE tenant_id = ? AND username = ?",
+		u.TenantId, u.Username,
 	).Scan(&id)
 	if id != 0 && id != u.Id {
 		return ErrDuplicateUsername
@@ -0,0 +1,508 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/radovskyb/services/user"
+)
+
+// Emails are compared case insensitively, so their unique index is on
+// lower(email) and they're looked up using lower(email).
+const createPostgresUserTableSQL = `CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	email VARCHAR(255) NOT NULL,
+	username VARCHAR(25) NOT NULL,
+	password VARCHAR(255) NOT NULL,
+	tenant_id VARCHAR(64) NOT NULL DEFAULT '',
+	failed_attempts INTEGER NOT NULL DEFAULT 0,
+	locked_until TIMESTAMPTZ NULL,
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	canonical_email VARCHAR(255) NULL,
+	role VARCHAR(32) NOT NULL DEFAULT 'user',
+	password_changed_at TIMESTAMPTZ NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	totp_secret VARCHAR(64) NOT NULL DEFAULT '',
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	session_version INTEGER NOT NULL DEFAULT 0,
+	status VARCHAR(16) NOT NULL DEFAULT 'active',
+	last_login_at TIMESTAMPTZ NULL,
+	totp_counter BIGINT NOT NULL DEFAULT 0,
+	first_failed_at TIMESTAMPTZ NULL,
+	CONSTRAINT users_tenant_username_key UNIQUE (tenant_id, username),
+	CONSTRAINT users_tenant_canonical_email_key UNIQUE (tenant_id, canonical_email)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_email_key
+	ON users (tenant_id, lower(email));
+CREATE TABLE IF NOT EXISTS user_identities (
+	provider VARCHAR(64) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	user_id BIGINT NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id
+	ON user_identities (user_id);`
+
+// Postgres' unique_violation SQLState.
+const postgresUniqueViolation = "23505"
+
+type postgresRepo struct{ db querier }
+
+// NewPostgresRepo creates the users and user_identities tables if they
+// don't exist and returns a UserRepository backed by db.
+//
+// If the tables can't be created, the returned UserRepository is nil.
+func NewPostgresRepo(db *sql.DB) (UserRepository, error) {
+	if _, err := db.Exec(createPostgresUserTableSQL); err != nil {
+		return nil, err
+	}
+	return &postgresRepo{db}, nil
+}
+
+// Close closes s's database. A repository bound to a transaction by
+// WithTx doesn't own it, so closing it does nothing.
+func (s *postgresRepo) Close() error {
+	return closeDB(s.db)
+}
+
+// Reset truncates the users and user_identities tables and restarts the
+// users' ids.
+func (s *postgresRepo) Reset() error {
+	_, err := s.db.Exec("TRUNCATE TABLE users, user_identities RESTART IDENTITY")
+	return err
+}
+
+// postgresDupeErr converts a unique_violation error into either an
+// ErrDuplicateEmail or ErrDuplicateUsername, depending on which unique
+// constraint was violated. Any other error is returned as is.
+func postgresDupeErr(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != postgresUniqueViolation {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "users_tenant_email_key", "users_tenant_canonical_email_key":
+		return ErrDuplicateEmail
+	case "users_tenant_username_key":
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+func (s *postgresRepo) Create(u *user.User) error {
+	return s.CreateTx(context.Background(), u, nil)
+}
+
+func (s *postgresRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	return findOrCreate(s, u)
+}
+
+func (s *postgresRepo) CreateTx(ctx context.Context, u *user.User,
+	fn func(tx *sql.Tx) error) error {
+	var insertErr error
+	id, createdAt, updatedAt := u.Id, u.CreatedAt, u.UpdatedAt
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO users (email, username, password, tenant_id,
+				failed_attempts, locked_until, email_verified, canonical_email,
+				role, password_changed_at, created_at, updated_at,
+				totp_secret, totp_enabled, session_version, status, last_login_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+				RETURNING id`,
+			u.Email, u.Username, u.Password, u.TenantId,
+			u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+			nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+			u.CreatedAt, u.UpdatedAt, u.TOTPSecret, u.TOTPEnabled,
+			u.SessionVersion, u.Status, u.LastLoginAt,
+		).Scan(&u.Id)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		if fn != nil {
+			return fn(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		u.Id, u.CreatedAt, u.UpdatedAt = id, createdAt, updatedAt
+		if err == insertErr {
+			return postgresDupeErr(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *postgresRepo) CreateBatch(users []*user.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	restore := stampBatch(users)
+	var insertErr error
+	err := withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			insertUsersSQL(len(users), func(i int) string {
+				return "$" + strconv.Itoa(i)
+			})+" RETURNING id",
+			insertUserArgs(users)...,
+		)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		defer rows.Close()
+
+		ids := make([]int64, 0, len(users))
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			insertErr = err
+			return err
+		}
+		// The returned ids aren't guaranteed to be in order, but they're
+		// generated in the order the rows are listed.
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for i, u := range users {
+			u.Id = ids[i]
+		}
+		return nil
+	})
+	if err != nil {
+		restore()
+		if err == insertErr {
+			if dupeErr := findBatchDupe(s, users); dupeErr != nil {
+				return dupeErr
+			}
+			return postgresDupeErr(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *postgresRepo) WithTx(fn func(r UserRepository) error) error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		return fn(&postgresRepo{tx})
+	})
+}
+
+func (s *postgresRepo) Get(id int64) (*user.User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s *postgresRepo) GetMany(ids []int64) (map[int64]*user.User, error) {
+	if len(ids) == 0 {
+		return map[int64]*user.User{}, nil
+	}
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	return scanUserMap(rows)
+}
+
+func (s *postgresRepo) GetByEmail(email string) (*user.User, error) {
+	return s.GetByTenantEmail("", email)
+}
+
+func (s *postgresRepo) GetByUsername(username string) (*user.User, error) {
+	return s.GetByTenantUsername("", username)
+}
+
+func (s *postgresRepo) GetByTenantEmail(tenantId, email string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = $1 AND lower(email) = lower($2)",
+		tenantId, email,
+	))
+}
+
+func (s *postgresRepo) GetByTenantUsername(tenantId, username string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = $1 AND username = $2", tenantId, username,
+	))
+}
+
+func (s *postgresRepo) GetByEmailOrUsername(identifier string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users WHERE tenant_id = '' AND
+			(lower(email) = lower($1) OR username = $1)
+			ORDER BY lower(email) = lower($1) DESC LIMIT 1`, identifier,
+	))
+}
+
+func (s *postgresRepo) Update(u *user.User) error {
+	updatedAt := timestamp()
+	res, err := s.db.Exec(
+		`UPDATE users SET email = $1, username = $2, password = $3, tenant_id = $4,
+			failed_attempts = $5, locked_until = $6, email_verified = $7,
+			canonical_email = $8, role = $9, password_changed_at = $10,
+			totp_secret = $11, totp_enabled = $12, session_version = $13,
+			status = $14, last_login_at = $15, updated_at = $16 WHERE id = $17`,
+		u.Email, u.Username, u.Password, u.TenantId,
+		u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+		nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+		u.TOTPSecret, u.TOTPEnabled, u.SessionVersion, u.Status,
+		u.LastLoginAt, updatedAt, u.Id,
+	)
+	if err != nil {
+		return postgresDupeErr(err)
+	}
+	// Postgres counts matched rows, so an unchanged row still counts.
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	u.UpdatedAt = updatedAt
+	return nil
+}
+
+func (s *postgresRepo) UpdateEmail(id int64, email string) error {
+	return s.Patch(id, UserUpdate{Email: &email})
+}
+
+func (s *postgresRepo) UpdateUsername(id int64, username string) error {
+	return s.updateColumn(id, "username", username)
+}
+
+func (s *postgresRepo) SetStatus(id int64, status string) error {
+	return s.Patch(id, UserUpdate{Status: &status})
+}
+
+func (s *postgresRepo) SetLastLogin(id int64, at time.Time) error {
+	return s.updateColumn(id, "last_login_at", at)
+}
+
+func (s *postgresRepo) Patch(id int64, update UserUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	columns, values := update.columns()
+	res, err := s.db.Exec(
+		patchUserSQL(columns, func(i int) string {
+			return "$" + strconv.Itoa(i)
+		}),
+		append(values, timestamp(), id)...,
+	)
+	if err != nil {
+		return postgresDupeErr(err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *postgresRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE users SET totp_counter = $1, updated_at = $2
+		WHERE id = $3 AND totp_counter < $1`, counter, timestamp(), id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 1 {
+		return true, nil
+	}
+	// Tell an old counter apart from a missing user.
+	if _, err := s.Get(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *postgresRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	// Every column is set from the previous row, so the new count is
+	// worked out again for first_failed_at and locked_until.
+	const count = `(CASE WHEN locked_until IS NOT NULL OR first_failed_at IS NULL
+		OR first_failed_at < $1 THEN 1 ELSE failed_attempts + 1 END)`
+	res, err := s.db.Exec(`UPDATE users SET
+		failed_attempts = `+count+`,
+		first_failed_at = CASE WHEN `+count+` = 1 THEN $2 ELSE first_failed_at END,
+		locked_until = CASE WHEN `+count+` >= $3 THEN $4::TIMESTAMPTZ ELSE NULL END,
+		updated_at = $5 WHERE id = $6`,
+		windowStart, at, threshold, lockedUntil, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *postgresRepo) ResetFailedLogins(id int64) error {
+	res, err := s.db.Exec(`UPDATE users SET failed_attempts = 0, locked_until = NULL,
+		first_failed_at = NULL, updated_at = $1 WHERE id = $2`, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// updateColumn sets column to value for the user with the specified id.
+// column must be a trusted column name.
+func (s *postgresRepo) updateColumn(id int64, column string, value interface{}) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET "+column+" = $1, updated_at = $2 WHERE id = $3",
+		value, timestamp(), id,
+	)
+	if err != nil {
+		return postgresDupeErr(err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *postgresRepo) Delete(id int64) error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM users WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 1 {
+			return ErrUserNotFound
+		}
+		_, err = tx.Exec("DELETE FROM user_identities WHERE user_id = $1", id)
+		return err
+	})
+}
+
+func (s *postgresRepo) LinkProvider(id int64, provider, subject string) error {
+	if !validIdentity(provider, subject) {
+		return ErrInvalidIdentity
+	}
+	// Only insert the identity if the user exists.
+	res, err := s.db.Exec(
+		`INSERT INTO user_identities (provider, subject, user_id)
+			SELECT $1, $2, id FROM users WHERE id = $3`,
+		provider, subject, id,
+	)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == postgresUniqueViolation {
+			return ErrProviderLinked
+		}
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *postgresRepo) GetByProvider(provider, subject string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users
+			JOIN user_identities ON user_identities.user_id = users.id
+			WHERE user_identities.provider = $1 AND user_identities.subject = $2`,
+		provider, subject,
+	))
+}
+
+func (s *postgresRepo) List(limit, offset int, opts ListOptions) ([]*user.User, error) {
+	orderBy, err := orderByClause(opts)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+" FROM users "+orderBy+" LIMIT $1 OFFSET $2", limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *postgresRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	if !validTenantId(tenantId) {
+		return 0, ErrInvalidTenantId
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := s.db.Exec(
+		`UPDATE users SET tenant_id = $1, updated_at = $2
+			WHERE tenant_id <> $1 AND id = ANY($3)`,
+		tenantId, timestamp(), pq.Array(ids),
+	)
+	if err != nil {
+		return 0, postgresDupeErr(err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *postgresRepo) Count() (int64, error) {
+	var n int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+func (s *postgresRepo) Search(query string, limit int) ([]*user.User, error) {
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+` FROM users WHERE username ILIKE '%' || $1 || '%'
+			OR email ILIKE '%' || $1 || '%' ORDER BY id LIMIT $2`,
+		likeEscaper.Replace(query), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *postgresRepo) DomainCounts(limit int) ([]DomainCount, error) {
+	rows, err := s.db.Query(
+		`SELECT lower(split_part(email, '@', 2)) AS d, COUNT(*) FROM users
+			GROUP BY d ORDER BY 2 DESC, d LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDomainCounts(rows)
+}
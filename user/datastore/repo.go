@@ -1,7 +1,12 @@
 package datastore
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/radovskyb/services/user"
 )
@@ -10,13 +15,639 @@ var (
 	ErrDuplicateEmail    = errors.New("error: a user with that email already exists")
 	ErrDuplicateUsername = errors.New("error: a user with that username already exists")
 	ErrUserNotFound      = errors.New("error: user not found")
+	ErrInvalidTenantId   = errors.New("error: tenant id must be between 1 - 64 characters")
+	ErrInvalidStatus     = errors.New("error: status must be active or disabled")
+	ErrInvalidOrderBy    = errors.New("error: users can't be ordered by that field")
+	ErrInvalidIdentity   = errors.New("error: provider identity must have a provider and a subject")
+	ErrProviderLinked    = errors.New("error: that provider identity is already linked to a user")
 )
 
+// UserRepository stores users. Emails and usernames are unique per tenant,
+// so GetByEmail and GetByUsername look users up in the default tenant and
+// GetByTenantEmail and GetByTenantUsername look them up in a specific one.
 type UserRepository interface {
 	Create(u *user.User) error
+
+	// FindOrCreate returns the user in u's tenant with u's email if
+	// there is one, and otherwise creates u, reporting whether it did.
+	// It's safe to call concurrently with the same email, since only
+	// one call creates the user. If u's username is taken by a user
+	// with a different email, ErrDuplicateUsername is returned.
+	FindOrCreate(u *user.User) (*user.User, bool, error)
+
 	Get(id int64) (*user.User, error)
+
+	// GetMany returns the users with the specified ids, keyed by id.
+	// Ids that don't exist are left out of the map rather than causing
+	// an error.
+	GetMany(ids []int64) (map[int64]*user.User, error)
+
 	GetByEmail(email string) (*user.User, error)
 	GetByUsername(username string) (*user.User, error)
+	GetByTenantEmail(tenantId, email string) (*user.User, error)
+	GetByTenantUsername(tenantId, username string) (*user.User, error)
+
+	// GetByEmailOrUsername returns the user in the default tenant whose
+	// email or username is identifier, preferring a match by email.
+	GetByEmailOrUsername(identifier string) (*user.User, error)
+
 	Update(u *user.User) error
 	Delete(id int64) error
+
+	// UpdateEmail and UpdateUsername update only the email or username
+	// of the user with the specified id, leaving the user's other fields
+	// as they are. Changing a user's email also marks it unverified and,
+	// if the user has a canonical email, canonicalizes it again with
+	// user.CanonicalizeEmail.
+	UpdateEmail(id int64, email string) error
+	UpdateUsername(id int64, username string) error
+
+	// Patch updates only the fields of the user with the specified id
+	// that are set in update, leaving the user's other fields as they
+	// are, except that a set Email is handled as by UpdateEmail and a
+	// set Status as by SetStatus. Emails and usernames must still be
+	// unique, and a set Status must be valid for SetStatus.
+	Patch(id int64, update UserUpdate) error
+
+	// SetStatus sets the status of the user with the specified id to
+	// status, which must be user.StatusActive or user.StatusDisabled.
+	// Disabling a user also increments their SessionVersion, which logs
+	// them out of all of their sessions.
+	SetStatus(id int64, status string) error
+
+	// SetLastLogin sets when the user with the specified id last logged
+	// in to at, leaving the user's other fields as they are.
+	SetLastLogin(id int64, at time.Time) error
+
+	// AdvanceTOTPCounter sets the TOTPCounter of the user with the
+	// specified id to counter if it's greater than their current one,
+	// and reports whether it was. It's atomic, so concurrent logins
+	// can't both use the same one-time password.
+	AdvanceTOTPCounter(id, counter int64) (bool, error)
+
+	// RecordFailedLogin increments the failed login attempts of the user
+	// with the specified id for an attempt made at at, and locks them out
+	// until lockedUntil once the count reaches threshold. The count
+	// restarts if they've been locked out before or if its first attempt
+	// was made before windowStart, so a zero windowStart counts attempts
+	// until they're reset. It's atomic, so concurrent failed logins are
+	// all counted.
+	RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+		lockedUntil time.Time) error
+
+	// ResetFailedLogins clears the failed login attempts and lockout of
+	// the user with the specified id.
+	ResetFailedLogins(id int64) error
+
+	// LinkProvider links an external provider identity, such as a
+	// Google or GitHub account, to the user with the specified id, so
+	// that they can be looked up with GetByProvider. subject is the
+	// user's id at provider. A user can have several identities, but
+	// each identity can only be linked to one user, so linking one
+	// that's already linked returns ErrProviderLinked. A user's
+	// identities are deleted along with them.
+	LinkProvider(id int64, provider, subject string) error
+
+	// GetByProvider returns the user linked to the identity subject at
+	// provider by LinkProvider.
+	GetByProvider(provider, subject string) (*user.User, error)
+
+	// List returns up to limit users ordered as specified by opts,
+	// skipping the first offset users. If opts.OrderBy isn't one of the
+	// OrderBy constants, ErrInvalidOrderBy is returned.
+	List(limit, offset int, opts ListOptions) ([]*user.User, error)
+
+	// CreateBatch creates every user in users, or none of them if any
+	// can't be created. If a user is a duplicate, either of a stored
+	// user or of an earlier user in users, a *BatchError is returned.
+	CreateBatch(users []*user.User) error
+
+	// AssignTenant moves the users with the specified ids to tenantId,
+	// such as when enabling multi-tenancy on an existing deployment,
+	// and returns the number of users that were moved. Users that are
+	// already in tenantId or don't exist aren't counted.
+	//
+	// If any user's email or username is already taken in tenantId,
+	// no users are moved.
+	AssignTenant(ids []int64, tenantId string) (int64, error)
+
+	// Count returns the total number of users.
+	Count() (int64, error)
+
+	// Search returns up to limit users, ordered by id, whose username or
+	// email contains query, ignoring case.
+	Search(query string, limit int) ([]*user.User, error)
+
+	// DomainCounts returns up to limit email domains with the number
+	// of users that have an email at each, ordered by the most users.
+	// Users are counted across all tenants, not just the default one.
+	DomainCounts(limit int) ([]DomainCount, error)
+
+	// Close closes the repository's database, after which its other
+	// methods return errors.
+	Close() error
+}
+
+// TxCreator is implemented by repositories that can create a user along
+// with related records in a single transaction.
+type TxCreator interface {
+	// CreateTx creates u and then calls fn with the transaction u was
+	// inserted in, so fn can insert related records, such as a profile,
+	// which can reference u.Id. If creating u or fn fails, the whole
+	// transaction is rolled back and the error is returned.
+	CreateTx(ctx context.Context, u *user.User, fn func(tx *sql.Tx) error) error
+}
+
+// Transactor is implemented by repositories that can run several
+// operations in a single transaction.
+type Transactor interface {
+	// WithTx calls fn with a repository whose operations all run in one
+	// transaction, which is committed if fn succeeds and rolled back if
+	// it fails.
+	WithTx(fn func(r UserRepository) error) error
+}
+
+// Resettable is implemented by repositories that can delete every user
+// and restart their ids, such as between integration tests. It's kept
+// separate from UserRepository, since it should never be used by
+// production code.
+type Resettable interface {
+	Reset() error
+}
+
+// closeDB closes db if it's a *sql.DB. Repositories bound to a
+// transaction don't own their database, so closing them does nothing.
+func closeDB(db querier) error {
+	if db, ok := db.(*sql.DB); ok {
+		return db.Close()
+	}
+	return nil
+}
+
+// likeEscaper escapes LIKE patterns' wildcards, using \ as the escape
+// character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// validTenantId checks whether tenantId can be assigned to users. It
+// must fit in the tenant_id columns.
+func validTenantId(tenantId string) bool {
+	return len(tenantId) > 0 && len(tenantId) <= 64
+}
+
+// Fields that List can order users by.
+const (
+	OrderById        = "id"
+	OrderByUsername  = "username"
+	OrderByEmail     = "email"
+	OrderByCreatedAt = "created_at"
+)
+
+// ListOptions configures the order of the users returned by List. The
+// zero value orders users by id, ascending.
+type ListOptions struct {
+	// OrderBy is the field to order users by, which must be one of the
+	// OrderBy constants. An empty OrderBy orders users by id.
+	OrderBy string
+
+	// Desc orders users in descending rather than ascending order.
+	Desc bool
+}
+
+// orderByColumns maps the fields that List can order users by to their
+// columns, so that ORDER BY clauses are only ever built from this list.
+var orderByColumns = map[string]string{
+	"":               "id",
+	OrderById:        "id",
+	OrderByUsername:  "username",
+	OrderByEmail:     "email",
+	OrderByCreatedAt: "created_at",
+}
+
+// orderByClause returns the ORDER BY clause for opts. Users are also
+// ordered by id, so that pages are stable when the ordered field has
+// duplicates.
+func orderByClause(opts ListOptions) (string, error) {
+	column, ok := orderByColumns[opts.OrderBy]
+	if !ok {
+		return "", ErrInvalidOrderBy
+	}
+	dir := " ASC"
+	if opts.Desc {
+		dir = " DESC"
+	}
+	if column == "id" {
+		return "ORDER BY id" + dir, nil
+	}
+	return "ORDER BY " + column + dir + ", id" + dir, nil
+}
+
+// UserUpdate is a partial update of a user for Patch. Only its non-nil
+// fields are updated. Like with Update, Password must already be hashed.
+type UserUpdate struct {
+	Email    *string
+	Username *string
+	Password *string
+	Role     *string
+	Status   *string
+}
+
+// columns returns the columns set by p and their values, in the same
+// order.
+func (p UserUpdate) columns() (columns []string, values []interface{}) {
+	fields := []struct {
+		column string
+		value  *string
+	}{
+		{"email", p.Email},
+		{"username", p.Username},
+		{"password", p.Password},
+		{"role", p.Role},
+		{"status", p.Status},
+	}
+	for _, f := range fields {
+		if f.value != nil {
+			columns = append(columns, f.column)
+			values = append(values, *f.value)
+		}
+	}
+	// A new email hasn't been verified, and needs canonicalizing again.
+	if p.Email != nil {
+		columns = append(columns, "email_verified", "canonical_email")
+		values = append(values, false, user.CanonicalizeEmail(*p.Email))
+	}
+	// A disabled user is logged out by incrementing session_version.
+	if p.Status != nil && *p.Status == user.StatusDisabled {
+		columns = append(columns, "session_version")
+		values = append(values, 1)
+	}
+	return columns, values
+}
+
+// validate checks that p's Status is valid, if it's set.
+func (p UserUpdate) validate() error {
+	if p.Status != nil && !validStatus(*p.Status) {
+		return ErrInvalidStatus
+	}
+	return nil
+}
+
+// patchUserSQL returns a statement that sets columns and updated_at for
+// the user with the id in the last parameter, using param to get the
+// placeholder for the i'th parameter, which starts at 1.
+func patchUserSQL(columns []string, param func(i int) string) string {
+	var b strings.Builder
+	b.WriteString("UPDATE users SET ")
+	for i, column := range columns {
+		value := param(i + 1)
+		switch column {
+		case "canonical_email":
+			// Users without a canonical email are left without one.
+			value = "CASE WHEN canonical_email IS NULL THEN NULL ELSE " + value + " END"
+		case "session_version":
+			value = "session_version + " + value
+		}
+		b.WriteString(column + " = " + value + ", ")
+	}
+	b.WriteString("updated_at = " + param(len(columns)+1))
+	b.WriteString(" WHERE id = " + param(len(columns)+2))
+	return b.String()
+}
+
+// validIdentity checks whether provider and subject can be linked with
+// LinkProvider.
+func validIdentity(provider, subject string) bool {
+	return provider != "" && subject != "" && len(provider) <= 64 && len(subject) <= 255
+}
+
+// validStatus checks whether status is a status that users can have.
+func validStatus(status string) bool {
+	return status == user.StatusActive || status == user.StatusDisabled
+}
+
+// BatchError is returned by CreateBatch when the user at Index in the
+// batch can't be created.
+type BatchError struct {
+	Index int
+	Email string
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s (user %d, %s)", e.Err, e.Index, e.Email)
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// findBatchDupe finds the first user in users that's a duplicate of
+// either a user in r or an earlier user in users, returning nil if
+// there isn't one. Canonical emails are only compared within users.
+func findBatchDupe(r UserRepository, users []*user.User) error {
+	var (
+		emails          = map[[2]string]bool{}
+		usernames       = map[[2]string]bool{}
+		canonicalEmails = map[[2]string]bool{}
+	)
+	for i, u := range users {
+		email := [2]string{u.TenantId, strings.ToLower(u.Email)}
+		username := [2]string{u.TenantId, u.Username}
+		canonicalEmail := [2]string{u.TenantId, u.CanonicalEmail}
+
+		_, err := r.GetByTenantEmail(u.TenantId, u.Email)
+		if err == nil || emails[email] ||
+			(u.CanonicalEmail != "" && canonicalEmails[canonicalEmail]) {
+			return &BatchError{i, u.Email, ErrDuplicateEmail}
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return &BatchError{i, u.Email, err}
+		}
+		_, err = r.GetByTenantUsername(u.TenantId, u.Username)
+		if err == nil || usernames[username] {
+			return &BatchError{i, u.Email, ErrDuplicateUsername}
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return &BatchError{i, u.Email, err}
+		}
+
+		emails[email] = true
+		usernames[username] = true
+		if u.CanonicalEmail != "" {
+			canonicalEmails[canonicalEmail] = true
+		}
+	}
+	return nil
+}
+
+// insertUsersSQL returns a statement that inserts n users, using param
+// to get the placeholder for the i'th parameter, which starts at 1.
+func insertUsersSQL(n int, param func(i int) string) string {
+	const columns = 17
+	var b strings.Builder
+	b.WriteString(`INSERT INTO users (email, username, password, tenant_id,
+		failed_attempts, locked_until, email_verified, canonical_email,
+		role, password_changed_at, created_at, updated_at, totp_secret,
+		totp_enabled, session_version, status, last_login_at) VALUES `)
+	for row := 0; row < n; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for col := 1; col <= columns; col++ {
+			if col > 1 {
+				b.WriteString(", ")
+			}
+			b.WriteString(param(row*columns + col))
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// insertUserArgs returns the arguments for insertUsersSQL's placeholders.
+func insertUserArgs(users []*user.User) []interface{} {
+	args := make([]interface{}, 0, len(users)*17)
+	for _, u := range users {
+		args = append(args,
+			u.Email, u.Username, u.Password, u.TenantId,
+			u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+			nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+			u.CreatedAt, u.UpdatedAt, u.TOTPSecret, u.TOTPEnabled,
+			u.SessionVersion, u.Status, u.LastLoginAt,
+		)
+	}
+	return args
+}
+
+// findOrCreateAttempts is how many times findOrCreate looks a user up
+// and tries to create them before giving up.
+const findOrCreateAttempts = 3
+
+// findOrCreate implements FindOrCreate for repositories whose emails are
+// kept unique by their database. If another create of the same email
+// wins the race between looking u up and creating u, the duplicate
+// email is retried, which finds the winner's user.
+func findOrCreate(r UserRepository, u *user.User) (*user.User, bool, error) {
+	for i := 0; i < findOrCreateAttempts; i++ {
+		existing, err := r.GetByTenantEmail(u.TenantId, u.Email)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, false, err
+		}
+		err = r.Create(u)
+		if err == nil {
+			return u, true, nil
+		}
+		if !errors.Is(err, ErrDuplicateEmail) {
+			return nil, false, err
+		}
+	}
+	// The email is still taken, such as by a user with the same
+	// canonical email, but not by a user that can be found by it.
+	return nil, false, ErrDuplicateEmail
+}
+
+// stampBatch sets the timestamps of every user in users and returns a
+// function that restores their ids and timestamps if the batch fails.
+func stampBatch(users []*user.User) (restore func()) {
+	old := make([]user.User, len(users))
+	now := timestamp()
+	for i, u := range users {
+		old[i] = *u
+		u.CreatedAt, u.UpdatedAt = now, now
+	}
+	return func() {
+		for i, u := range users {
+			u.Id, u.CreatedAt, u.UpdatedAt = old[i].Id, old[i].CreatedAt, old[i].UpdatedAt
+		}
+	}
+}
+
+// DomainCount is the number of users with an email at a domain.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Users  int    `json:"users"`
+}
+
+// duplicateHashesPageSize is how many users FindDuplicateHashes lists
+// at a time.
+const duplicateHashesPageSize = 100
+
+// FindDuplicateHashes returns groups of users in r whose password hashes
+// are identical, ordered by the id of each group's first user. Correctly
+// salted hashes should never be identical, so any groups found indicate
+// a bug, such as a fixed salt or a copied row.
+func FindDuplicateHashes(r UserRepository) ([][]*user.User, error) {
+	return findDuplicateHashes(r, duplicateHashesPageSize)
+}
+
+func findDuplicateHashes(r UserRepository, pageSize int) ([][]*user.User, error) {
+	var (
+		hashes []string // Hashes in the order they were first seen.
+		users  = map[string][]*user.User{}
+	)
+	for offset := 0; ; offset += pageSize {
+		page, err := r.List(pageSize, offset, ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range page {
+			if _, ok := users[u.Password]; !ok {
+				hashes = append(hashes, u.Password)
+			}
+			users[u.Password] = append(users[u.Password], u)
+		}
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	groups := [][]*user.User{}
+	for _, hash := range hashes {
+		if len(users[hash]) > 1 {
+			groups = append(groups, users[hash])
+		}
+	}
+	return groups, nil
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx, so the sql backed
+// repositories can be bound to either.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// withTx calls fn in a transaction on db, committing the transaction if
+// fn succeeds and rolling it back if it fails. If db is already a
+// transaction, fn is called in it and it's left for its owner to commit
+// or roll back.
+func withTx(ctx context.Context, db querier, fn func(tx *sql.Tx) error) error {
+	if tx, ok := db.(*sql.Tx); ok {
+		return fn(tx)
+	}
+	tx, err := db.(*sql.DB).BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// userColumns are the users table's columns in the order scanUser scans
+// them. Queries select them explicitly, rather than with *, so that a
+// column added to the table doesn't shift the ones after it.
+const userColumns = `users.id, users.email, users.username, users.password,
+	users.tenant_id, users.failed_attempts, users.locked_until,
+	users.email_verified, users.canonical_email, users.role,
+	users.password_changed_at, users.created_at, users.updated_at,
+	users.totp_secret, users.totp_enabled, users.session_version,
+	users.status, users.last_login_at, users.totp_counter,
+	users.first_failed_at`
+
+// scanUser scans a row from the users table into a new user. It's
+// shared by the sql backed repositories, which use the same columns.
+func scanUser(row scanner) (*user.User, error) {
+	u := new(user.User)
+	var (
+		lockedUntil       sql.NullTime
+		canonicalEmail    sql.NullString
+		passwordChangedAt sql.NullTime
+		lastLoginAt       sql.NullTime
+		firstFailedAt     sql.NullTime
+	)
+	err := row.Scan(
+		&u.Id, &u.Email, &u.Username, &u.Password, &u.TenantId,
+		&u.FailedAttempts, &lockedUntil, &u.EmailVerified, &canonicalEmail,
+		&u.Role, &passwordChangedAt, &u.CreatedAt, &u.UpdatedAt,
+		&u.TOTPSecret, &u.TOTPEnabled, &u.SessionVersion, &u.Status, &lastLoginAt,
+		&u.TOTPCounter, &firstFailedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		u.LockedUntil = &lockedUntil.Time
+	}
+	u.CanonicalEmail = canonicalEmail.String
+	if passwordChangedAt.Valid {
+		u.PasswordChangedAt = &passwordChangedAt.Time
+	}
+	if lastLoginAt.Valid {
+		u.LastLoginAt = &lastLoginAt.Time
+	}
+	if firstFailedAt.Valid {
+		u.FirstFailedAt = &firstFailedAt.Time
+	}
+	return u, nil
+}
+
+// timestamp returns the current time, truncated to the microsecond
+// precision that the sql backed repositories store, so that the times
+// set on users match the times that are read back.
+func timestamp() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// nullString converts an empty s to NULL, so that empty values don't
+// collide in unique indexes.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// scanDomainCounts scans every row of domain and user count columns in
+// rows and then closes rows.
+func scanDomainCounts(rows *sql.Rows) ([]DomainCount, error) {
+	defer rows.Close()
+
+	counts := []DomainCount{}
+	for rows.Next() {
+		var dc DomainCount
+		if err := rows.Scan(&dc.Domain, &dc.Users); err != nil {
+			return nil, err
+		}
+		counts = append(counts, dc)
+	}
+	return counts, rows.Err()
+}
+
+// scanUsers scans every row from the users table in rows and then
+// closes rows.
+func scanUsers(rows *sql.Rows) ([]*user.User, error) {
+	defer rows.Close()
+
+	users := []*user.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// scanUserMap is like scanUsers, except that the users are keyed by id.
+func scanUserMap(rows *sql.Rows) (map[int64]*user.User, error) {
+	users, err := scanUsers(rows)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int64]*user.User, len(users))
+	for _, u := range users {
+		m[u.Id] = u
+	}
+	return m, nil
 }
@@ -0,0 +1,572 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/radovskyb/services/user"
+	_ "modernc.org/sqlite"
+)
+
+const createSQLiteUserTableSQL = `CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL COLLATE NOCASE,
+	username TEXT NOT NULL,
+	password TEXT NOT NULL,
+	tenant_id TEXT NOT NULL DEFAULT '',
+	failed_attempts INTEGER NOT NULL DEFAULT 0,
+	locked_until DATETIME NULL,
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	canonical_email TEXT NULL,
+	role TEXT NOT NULL DEFAULT 'user',
+	password_changed_at DATETIME NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	totp_secret TEXT NOT NULL DEFAULT '',
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	session_version INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'active',
+	last_login_at DATETIME NULL,
+	totp_counter INTEGER NOT NULL DEFAULT 0,
+	first_failed_at DATETIME NULL,
+	UNIQUE (tenant_id, email),
+	UNIQUE (tenant_id, username),
+	UNIQUE (tenant_id, canonical_email)
+);`
+
+// createSQLiteUserIdentitiesTableSQL creates the table of provider
+// identities linked to users. Like the MySQL table, it has no foreign
+// key to users, so identities are deleted along with their users by
+// Delete.
+const createSQLiteUserIdentitiesTableSQL = `CREATE TABLE IF NOT EXISTS user_identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id
+	ON user_identities (user_id);`
+
+type sqliteRepo struct{ db querier }
+
+// NewSQLiteRepo creates the users and user_identities tables if they
+// don't exist and returns a UserRepository backed by db, which should be
+// opened with the "sqlite" driver from modernc.org/sqlite.
+//
+// If the tables can't be created, the returned UserRepository is nil.
+func NewSQLiteRepo(db *sql.DB) (UserRepository, error) {
+	if _, err := db.Exec(createSQLiteUserTableSQL); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createSQLiteUserIdentitiesTableSQL); err != nil {
+		return nil, err
+	}
+	return &sqliteRepo{db}, nil
+}
+
+// dupeErr converts a UNIQUE constraint failed error for u into either an
+// ErrDuplicateEmail or ErrDuplicateUsername. Any other error is returned
+// as is.
+//
+// SQLite only reports the first constraint that failed, so the duplicate
+// is found with checkDupes to make sure emails are checked first.
+func (s *sqliteRepo) dupeErr(u *user.User, err error) error {
+	if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return err
+	}
+	switch dupeErr := s.checkDupes(u); dupeErr {
+	case ErrDuplicateEmail, ErrDuplicateUsername:
+		return dupeErr
+	}
+	return err
+}
+
+func (s *sqliteRepo) Create(u *user.User) error {
+	return s.CreateTx(context.Background(), u, nil)
+}
+
+func (s *sqliteRepo) FindOrCreate(u *user.User) (*user.User, bool, error) {
+	return findOrCreate(s, u)
+}
+
+func (s *sqliteRepo) CreateTx(ctx context.Context, u *user.User,
+	fn func(tx *sql.Tx) error) error {
+	var insertErr error
+	id, createdAt, updatedAt := u.Id, u.CreatedAt, u.UpdatedAt
+	u.CreatedAt = timestamp()
+	u.UpdatedAt = u.CreatedAt
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO users (email, username, password, tenant_id,
+				failed_attempts, locked_until, email_verified, canonical_email,
+				role, password_changed_at, created_at, updated_at,
+				totp_secret, totp_enabled, session_version, status, last_login_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			u.Email, u.Username, u.Password, u.TenantId,
+			u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+			nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+			u.CreatedAt, u.UpdatedAt, u.TOTPSecret, u.TOTPEnabled,
+			u.SessionVersion, u.Status, u.LastLoginAt,
+		)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		// Set u's id to the inserted row's id.
+		if u.Id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if fn != nil {
+			return fn(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		u.Id, u.CreatedAt, u.UpdatedAt = id, createdAt, updatedAt
+		// The transaction has been rolled back by now, so dupeErr can
+		// query the database.
+		if err == insertErr {
+			return s.dupeErr(u, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqliteRepo) CreateBatch(users []*user.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	restore := stampBatch(users)
+	var insertErr error
+	err := withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			insertUsersSQL(len(users), func(int) string { return "?" }),
+			insertUserArgs(users)...,
+		)
+		if err != nil {
+			insertErr = err
+			return err
+		}
+		// SQLite returns the id of the last inserted row, and the rows
+		// inserted by a single statement get consecutive ids.
+		last, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for i, u := range users {
+			u.Id = last - int64(len(users)-1-i)
+		}
+		return nil
+	})
+	if err != nil {
+		restore()
+		// The transaction has been rolled back by now, so findBatchDupe
+		// can query the database.
+		if err == insertErr {
+			if dupeErr := findBatchDupe(s, users); dupeErr != nil {
+				return dupeErr
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqliteRepo) WithTx(fn func(r UserRepository) error) error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		return fn(&sqliteRepo{tx})
+	})
+}
+
+func (s *sqliteRepo) Get(id int64) (*user.User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *sqliteRepo) GetMany(ids []int64) (map[int64]*user.User, error) {
+	if len(ids) == 0 {
+		return map[int64]*user.User{}, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+" FROM users WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserMap(rows)
+}
+
+func (s *sqliteRepo) GetByEmail(email string) (*user.User, error) {
+	return s.GetByTenantEmail("", email)
+}
+
+func (s *sqliteRepo) GetByUsername(username string) (*user.User, error) {
+	return s.GetByTenantUsername("", username)
+}
+
+func (s *sqliteRepo) GetByTenantEmail(tenantId, email string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = ? AND email = ?", tenantId, email,
+	))
+}
+
+func (s *sqliteRepo) GetByTenantUsername(tenantId, username string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE tenant_id = ? AND username = ?", tenantId, username,
+	))
+}
+
+func (s *sqliteRepo) GetByEmailOrUsername(identifier string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users WHERE tenant_id = '' AND (email = ? OR username = ?)
+			ORDER BY email = ? DESC LIMIT 1`, identifier, identifier, identifier,
+	))
+}
+
+func (s *sqliteRepo) Update(u *user.User) error {
+	updatedAt := timestamp()
+	res, err := s.db.Exec(
+		`UPDATE users SET email = ?, username = ?, password = ?, tenant_id = ?,
+			failed_attempts = ?, locked_until = ?, email_verified = ?,
+			canonical_email = ?, role = ?, password_changed_at = ?,
+			totp_secret = ?, totp_enabled = ?, session_version = ?,
+			status = ?, last_login_at = ?, updated_at = ? WHERE id = ?`,
+		u.Email, u.Username, u.Password, u.TenantId,
+		u.FailedAttempts, u.LockedUntil, u.EmailVerified,
+		nullString(u.CanonicalEmail), u.Role, u.PasswordChangedAt,
+		u.TOTPSecret, u.TOTPEnabled, u.SessionVersion, u.Status,
+		u.LastLoginAt, updatedAt, u.Id,
+	)
+	if err != nil {
+		return s.dupeErr(u, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	u.UpdatedAt = updatedAt
+	return nil
+}
+
+func (s *sqliteRepo) UpdateEmail(id int64, email string) error {
+	return s.Patch(id, UserUpdate{Email: &email})
+}
+
+func (s *sqliteRepo) UpdateUsername(id int64, username string) error {
+	return s.updateColumn(id, "username", username)
+}
+
+func (s *sqliteRepo) SetStatus(id int64, status string) error {
+	return s.Patch(id, UserUpdate{Status: &status})
+}
+
+func (s *sqliteRepo) SetLastLogin(id int64, at time.Time) error {
+	return s.updateColumn(id, "last_login_at", at)
+}
+
+func (s *sqliteRepo) Patch(id int64, update UserUpdate) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	columns, values := update.columns()
+	res, err := s.db.Exec(
+		patchUserSQL(columns, func(int) string { return "?" }),
+		append(values, timestamp(), id)...,
+	)
+	if err != nil {
+		return uniqueConstraintErr(err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteRepo) AdvanceTOTPCounter(id, counter int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE users SET totp_counter = ?, updated_at = ?
+		WHERE id = ? AND totp_counter < ?`, counter, timestamp(), id, counter)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 1 {
+		return true, nil
+	}
+	// Tell an old counter apart from a missing user.
+	if _, err := s.Get(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *sqliteRepo) RecordFailedLogin(id int64, at, windowStart time.Time, threshold int,
+	lockedUntil time.Time) error {
+	// Every column is set from the previous row, so the new count is
+	// worked out again for first_failed_at and locked_until.
+	const count = `(CASE WHEN locked_until IS NOT NULL OR first_failed_at IS NULL
+		OR first_failed_at < ?1 THEN 1 ELSE failed_attempts + 1 END)`
+	res, err := s.db.Exec(`UPDATE users SET
+		failed_attempts = `+count+`,
+		first_failed_at = CASE WHEN `+count+` = 1 THEN ?2 ELSE first_failed_at END,
+		locked_until = CASE WHEN `+count+` >= ?3 THEN ?4 ELSE NULL END,
+		updated_at = ?5 WHERE id = ?6`,
+		sqliteTime(windowStart), sqliteTime(at), threshold, lockedUntil, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// sqliteTime formats t as fixed width text in UTC, so that times stored
+// by RecordFailedLogin can be compared as strings.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+func (s *sqliteRepo) ResetFailedLogins(id int64) error {
+	res, err := s.db.Exec(`UPDATE users SET failed_attempts = 0, locked_until = NULL,
+		first_failed_at = NULL, updated_at = ? WHERE id = ?`, timestamp(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// updateColumn sets column to value for the user with the specified id.
+// column must be a trusted column name.
+func (s *sqliteRepo) updateColumn(id int64, column string, value interface{}) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET "+column+" = ?, updated_at = ? WHERE id = ?",
+		value, timestamp(), id,
+	)
+	if err != nil {
+		return uniqueConstraintErr(err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteRepo) Delete(id int64) error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 1 {
+			return ErrUserNotFound
+		}
+		_, err = tx.Exec("DELETE FROM user_identities WHERE user_id = ?", id)
+		return err
+	})
+}
+
+func (s *sqliteRepo) LinkProvider(id int64, provider, subject string) error {
+	if !validIdentity(provider, subject) {
+		return ErrInvalidIdentity
+	}
+	// Only insert the identity if the user exists.
+	res, err := s.db.Exec(
+		`INSERT INTO user_identities (provider, subject, user_id)
+			SELECT ?, ?, id FROM users WHERE id = ?`,
+		provider, subject, id,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrProviderLinked
+		}
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *sqliteRepo) GetByProvider(provider, subject string) (*user.User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+` FROM users
+			JOIN user_identities ON user_identities.user_id = users.id
+			WHERE user_identities.provider = ? AND user_identities.subject = ?`,
+		provider, subject,
+	))
+}
+
+func (s *sqliteRepo) List(limit, offset int, opts ListOptions) ([]*user.User, error) {
+	orderBy, err := orderByClause(opts)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+" FROM users "+orderBy+" LIMIT ? OFFSET ?", limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *sqliteRepo) AssignTenant(ids []int64, tenantId string) (int64, error) {
+	if !validTenantId(tenantId) {
+		return 0, ErrInvalidTenantId
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{tenantId, timestamp(), tenantId}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	res, err := s.db.Exec(
+		`UPDATE users SET tenant_id = ?, updated_at = ? WHERE tenant_id <> ?
+			AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...,
+	)
+	if err != nil {
+		return 0, uniqueConstraintErr(err)
+	}
+	return res.RowsAffected()
+}
+
+// uniqueConstraintErr converts a UNIQUE constraint failed error into
+// either an ErrDuplicateEmail or ErrDuplicateUsername using the failed
+// constraint's columns, for when the user that caused it isn't known.
+func uniqueConstraintErr(err error) error {
+	msg := err.Error()
+	switch {
+	case !strings.Contains(msg, "UNIQUE constraint failed"):
+		return err
+	case strings.Contains(msg, "email"):
+		return ErrDuplicateEmail
+	case strings.Contains(msg, "users.username"):
+		return ErrDuplicateUsername
+	}
+	return err
+}
+
+func (s *sqliteRepo) Count() (int64, error) {
+	var n int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+func (s *sqliteRepo) Search(query string, limit int) ([]*user.User, error) {
+	query = "%" + likeEscaper.Replace(query) + "%"
+	rows, err := s.db.Query(
+		"SELECT "+userColumns+` FROM users WHERE username LIKE ? ESCAPE '\'
+			OR email LIKE ? ESCAPE '\' ORDER BY id LIMIT ?`,
+		query, query, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (s *sqliteRepo) DomainCounts(limit int) ([]DomainCount, error) {
+	rows, err := s.db.Query(
+		`SELECT lower(substr(email, instr(email, '@') + 1)) AS d, COUNT(*) FROM users
+			GROUP BY d ORDER BY 2 DESC, d LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDomainCounts(rows)
+}
+
+func (s *sqliteRepo) Close() error {
+	return closeDB(s.db)
+}
+
+// Reset deletes every user and restarts the users table's ids. SQLite
+// doesn't have TRUNCATE, so the table's AUTOINCREMENT sequence is
+// deleted along with the users.
+func (s *sqliteRepo) Reset() error {
+	return withTx(context.Background(), s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM users"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM user_identities"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM sqlite_sequence WHERE name = 'users'")
+		return err
+	})
+}
+
+func (s *sqliteRepo) checkDupes(u *user.User) error {
+	var id int64
+	// Check if the email already exists for u's tenant.
+	err1 := s.db.QueryRow(
+		"SELECT id FROM users WHERE tenant_id = ? AND email = ?",
+		u.TenantId, u.Email,
+	).Scan(&id)
+	if id != 0 && id != u.Id {
+		return ErrDuplicateEmail
+	}
+	// Check if the canonical email already exists for u's tenant.
+	if u.CanonicalEmail != "" {
+		s.db.QueryRow(
+			"SELECT id FROM users WHERE tenant_id = ? AND canonical_email = ?",
+			u.TenantId, u.CanonicalEmail,
+		).Scan(&id)
+		if id != 0 && id != u.Id {
+			return ErrDuplicateEmail
+		}
+	}
+	// Check if the username already exists for u's tenant.
+	err2 := s.db.QueryRow(
+		"SELECT id FROM users WHERE tenant_id = ? AND username = ?",
+		u.TenantId, u.Username,
+	).Scan(&id)
+	if id != 0 && id != u.Id {
+		return ErrDuplicateUsername
+	}
+	if err1 == nil {
+		err1 = err2
+	}
+	return err1
+}
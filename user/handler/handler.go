@@ -1,8 +1,17 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/radovskyb/services/user"
@@ -11,124 +20,677 @@ import (
 	"github.com/radovskyb/services/user/session"
 )
 
+// Version is the server's version, which is reported by Info. It's
+// set at build time using:
+//
+//	-ldflags "-X github.com/radovskyb/services/user/handler.Version=v1.0.0"
+var Version = "dev"
+
+var (
+	ErrRegistrationDisabled  = errors.New("error: registration is disabled")
+	ErrNotTenantMember       = errors.New("error: user is not a member of that tenant")
+	ErrPasswordResetDisabled = errors.New("error: password reset is disabled")
+	ErrInsufficientRole      = errors.New("error: user doesn't have the required role")
+	ErrResetPending          = auth.ErrResetPending
+	ErrNotAccountOwner       = errors.New("error: users can only delete their own account")
+	ErrInvalidLimit          = errors.New("error: limit must be a positive number")
+	ErrPasswordExpired       = errors.New("error: password has expired and must be changed")
+	ErrTooManyLogins         = errors.New("error: too many logins are being processed, try again later")
+	ErrLoginRateLimited      = errors.New("error: too many login attempts, try again later")
+	ErrSignupRateLimited     = errors.New("error: too many registrations, try again later")
+)
+
+// defaultUsersPath is the default path that users are served under.
+const defaultUsersPath = "/users"
+
 type Handler struct {
 	r datastore.UserRepository
 	a auth.Auth
 	s session.Session
+
+	registrationDisabled bool
+
+	// usersPath is the path that users are served under, which the
+	// Location of newly registered users is relative to.
+	usersPath string
+
+	// sendResetToken delivers a password reset token to a user, such
+	// as by emailing them a reset link. Password resets are disabled
+	// when it's nil.
+	sendResetToken TokenSender
+
+	// sendVerificationToken delivers an email verification token to a
+	// user. Email verification is disabled when it's nil.
+	sendVerificationToken TokenSender
+
+	// loginSlots limits how many logins are authenticated at once and
+	// loginQueue limits how many more can wait for a slot. Logins
+	// aren't limited when loginSlots is nil.
+	loginSlots chan struct{}
+	loginQueue chan struct{}
+
+	// loginLimiter limits login attempts for each email and IP address.
+	// Login attempts aren't rate limited when it's nil.
+	loginLimiter RateLimiter
+
+	// signupLimiter limits registrations for each IP address.
+	// Registrations aren't rate limited when it's nil.
+	signupLimiter RateLimiter
+
+	// verifyCSRF requires state changing requests to include the
+	// session's CSRF token.
+	verifyCSRF bool
+
+	// errorMessages maps validation errors to the messages written
+	// in their place.
+	errorMessages map[error]string
+
+	// authOpts and sessionOpts configure the handler's Auth and Session.
+	authOpts    []auth.Option
+	sessionOpts []session.Option
+}
+
+// TokenSender sends a token to the user with the specified email, such
+// as by emailing them a link containing the token.
+type TokenSender func(email, token string) error
+
+// Option configures a Handler created with NewHandler.
+type Option func(*Handler)
+
+// WithRegistration enables or disables registering new users.
+// Registration is enabled by default.
+func WithRegistration(enabled bool) Option {
+	return func(h *Handler) {
+		h.registrationDisabled = !enabled
+	}
+}
+
+// WithUsersPath sets the path that users are served under, so that
+// RegisterUser's Location header points at path/<id>. It's "/users" by
+// default.
+func WithUsersPath(path string) Option {
+	return func(h *Handler) {
+		h.usersPath = strings.TrimSuffix(path, "/")
+	}
+}
+
+// WithPasswordReset enables password resets, using send to deliver
+// reset tokens to users.
+func WithPasswordReset(send TokenSender) Option {
+	return func(h *Handler) {
+		h.sendResetToken = send
+	}
+}
+
+// WithEmailVerification requires users to verify their email before
+// they can log in, using send to deliver verification tokens to newly
+// registered users and users who change their email.
+func WithEmailVerification(send TokenSender) Option {
+	return func(h *Handler) {
+		h.sendVerificationToken = send
+		h.authOpts = append(h.authOpts, auth.WithEmailVerification())
+	}
 }
 
-func NewHandler(r datastore.UserRepository, s *sessions.CookieStore) *Handler {
-	return &Handler{
-		r: r,
-		a: auth.NewAuth(r),
-		s: session.NewSession(s),
+// WithLoginLimit limits UserLogin to authenticating at most concurrent
+// logins at once, since each one costs a bcrypt comparison. Up to queued
+// more logins wait for one to finish, and any beyond that are rejected
+// with a 503 and a Retry-After header, as are waiting logins whose
+// requests are canceled. Logins aren't limited by default.
+func WithLoginLimit(concurrent, queued int) Option {
+	return func(h *Handler) {
+		h.loginSlots = make(chan struct{}, concurrent)
+		h.loginQueue = make(chan struct{}, queued)
 	}
 }
 
+// WithLoginRateLimit limits UserLogin's login attempts for each email or
+// username and for each client IP address with l, such as a limiter
+// returned by NewTokenBucket. Attempts over the limit are rejected with a
+// 429 and a Retry-After header before they're authenticated. Login
+// attempts aren't rate limited by default.
+func WithLoginRateLimit(l RateLimiter) Option {
+	return func(h *Handler) {
+		h.loginLimiter = l
+	}
+}
+
+// WithSignupRateLimit limits RegisterUser's registrations for each client
+// IP address with l, which can be the same limiter passed to
+// WithLoginRateLimit, since their keys don't overlap. Registrations over
+// the limit are rejected with a 429 and a Retry-After header before the
+// user is created. Registrations aren't rate limited by default.
+func WithSignupRateLimit(l RateLimiter) Option {
+	return func(h *Handler) {
+		h.signupLimiter = l
+	}
+}
+
+// WithCSRFProtection requires UpdateUser, DeleteUser and UserLogout
+// requests to include the session's CSRF token, which is returned by
+// Session, in an X-CSRF-Token header or a csrf_token form value.
+// Requests without it are rejected with a 403 before anything is
+// changed. CSRF tokens aren't required by default.
+func WithCSRFProtection() Option {
+	return func(h *Handler) {
+		h.verifyCSRF = true
+	}
+}
+
+// WithErrorMessages replaces the messages written for validation errors,
+// such as auth.ErrInvalidEmail, with the messages in msgs, so they can be
+// localized or reworded. Errors without a message in msgs are written
+// as they are.
+func WithErrorMessages(msgs map[error]string) Option {
+	return func(h *Handler) {
+		h.errorMessages = msgs
+	}
+}
+
+// WithAuthOptions configures the handler's Auth with opts.
+func WithAuthOptions(opts ...auth.Option) Option {
+	return func(h *Handler) {
+		h.authOpts = append(h.authOpts, opts...)
+	}
+}
+
+// WithSessionOptions configures the handler's Session with opts.
+func WithSessionOptions(opts ...session.Option) Option {
+	return func(h *Handler) {
+		h.sessionOpts = append(h.sessionOpts, opts...)
+	}
+}
+
+func NewHandler(r datastore.UserRepository, s *sessions.CookieStore,
+	opts ...Option) *Handler {
+	h := &Handler{r: r, usersPath: defaultUsersPath}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.a = auth.NewAuth(r, h.authOpts...)
+	// Sessions are checked against the user's current session version, so
+	// that Auth can log users out everywhere.
+	sessionOpts := append(h.sessionOpts, session.WithSessionVersions(
+		func(userId int64) (int64, error) {
+			u, err := r.Get(userId)
+			if errors.Is(err, datastore.ErrUserNotFound) {
+				return 0, session.ErrUserNotSet
+			}
+			if err != nil {
+				return 0, err
+			}
+			return u.SessionVersion, nil
+		}))
+	h.s = session.NewSession(s, sessionOpts...)
+	return h
+}
+
+// userRequest is a request to RegisterUser, UpdateUser or UserLogin.
+type userRequest struct {
+	Id       int64  `json:"id"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Identifier is an email or username, which UserLogin accepts
+	// instead of an email.
+	Identifier string `json:"identifier"`
+
+	// Remember keeps a user logged in after their browser is closed
+	// when logging in.
+	Remember bool `json:"remember"`
+}
+
+// isJSON checks whether r's body is JSON.
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// decodeUserRequest decodes a userRequest from r's body if it's JSON,
+// or otherwise from r's form values.
+func decodeUserRequest(r *http.Request) (*userRequest, error) {
+	req := new(userRequest)
+	if isJSON(r) {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	req.Email = r.FormValue("email")
+	req.Username = r.FormValue("username")
+	req.Password = r.FormValue("password")
+	req.Identifier = r.FormValue("identifier")
+	// Checkboxes are submitted as "on" when they're checked.
+	if remember := r.FormValue("remember"); remember == "on" {
+		req.Remember = true
+	} else {
+		req.Remember, _ = strconv.ParseBool(remember)
+	}
+	if id := r.FormValue("id"); id != "" {
+		var err error
+		if req.Id, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// acceptsJSON checks whether r's Accept header includes JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(accept)
+		if mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// errorResponse is the body of an error response to a client that
+// accepts JSON. Field is only set for validation errors.
+type errorResponse struct {
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError replies to r with msg and code like http.Error, except
+// that when r accepts JSON, msg is written as an errorResponse, like:
+//
+//	{"error":"error: user not found","code":404}
+func writeError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	writeErrorResponse(w, errorResponse{Error: msg, Code: code})
+}
+
+// writeErrorResponse writes resp as JSON with resp.Code.
+func writeErrorResponse(w http.ResponseWriter, resp errorResponse) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(resp.Code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// errorMessage returns the message to write for err.
+func (h *Handler) errorMessage(err error) string {
+	for target, msg := range h.errorMessages {
+		if errors.Is(err, target) {
+			return msg
+		}
+	}
+	return err.Error()
+}
+
+// validationError writes err, a validation error, with a 400. When the
+// request is JSON or accepts JSON and err is an *auth.ValidationError,
+// it's written as an errorResponse naming the invalid field, like:
+//
+//	{"field":"email","error":"error: email is invalid","code":400}
+func (h *Handler) validationError(w http.ResponseWriter, r *http.Request, err error) {
+	msg := h.errorMessage(err)
+	var ve *auth.ValidationError
+	if !(isJSON(r) || acceptsJSON(r)) || !errors.As(err, &ve) {
+		writeError(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	writeErrorResponse(w, errorResponse{
+		Field: ve.Field,
+		Error: msg,
+		Code:  http.StatusBadRequest,
+	})
+}
+
+// RegisterUser registers a new user, responding with a 201 Created, the
+// new user's id, email and username as JSON, and a Location header.
 func (h *Handler) RegisterUser(w http.ResponseWriter, r *http.Request) {
-	var (
-		email    = r.FormValue("email")
-		username = r.FormValue("username")
-		password = r.FormValue("password")
-	)
+	if h.registrationDisabled {
+		writeError(w, r, ErrRegistrationDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Reject the registration if there have been too many from its IP
+	// address.
+	if h.signupLimiter != nil {
+		if ok, wait := h.signupLimiter.Allow("signup:" + clientIP(r)); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeError(w, r, ErrSignupRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	req, err := decodeUserRequest(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	u := &user.User{
-		Email:    email,
-		Username: username,
-		Password: password,
+		Email:    req.Email,
+		Username: req.Username,
+		Password: req.Password,
 	}
 
 	// Create the user in the user repository.
 	if err := h.a.CreateUser(u); err != nil {
 		if h.a.IsValidationErr(err) {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			h.validationError(w, r, err)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if err := h.sendVerification(u); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with where the new user can be found, but never their
+	// password.
+	w.Header().Set("Location", h.usersPath+"/"+strconv.FormatInt(u.Id, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Id       int64  `json:"id"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+	}{u.Id, u.Email, u.Username})
 }
 
-func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+// CheckAvailability writes whether the username and email query string
+// parameters are available to register, as JSON, like:
+//
+//	{"username_available":false,"email_available":true}
+//
+// Only the fields for the parameters that are set are written. Both are
+// always looked up, so that the response time doesn't depend on which
+// of them were asked about.
+func (h *Handler) CheckAvailability(w http.ResponseWriter, r *http.Request) {
+	if h.registrationDisabled {
+		writeError(w, r, ErrRegistrationDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
 	var (
-		id       = r.FormValue("id")
-		email    = r.FormValue("email")
-		username = r.FormValue("username")
-		password = r.FormValue("password")
+		username = strings.TrimSpace(r.URL.Query().Get("username"))
+		email    = auth.NormalizeEmail(r.URL.Query().Get("email"))
 	)
+	if username == "" && email == "" {
+		writeError(w, r, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, usernameErr := h.r.GetByUsername(username)
+	_, emailErr := h.r.GetByEmail(email)
 
-	// Convert id to an integer.
-	uid, err := strconv.Atoi(id)
+	var resp struct {
+		UsernameAvailable *bool `json:"username_available,omitempty"`
+		EmailAvailable    *bool `json:"email_available,omitempty"`
+	}
+	var err error
+	if resp.UsernameAvailable, err = available(username, usernameErr); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp.EmailAvailable, err = available(email, emailErr); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// available returns whether value is available, given the error from
+// looking up a user by it, or nil if value is empty.
+func available(value string, lookupErr error) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if lookupErr != nil && !errors.Is(lookupErr, datastore.ErrUserNotFound) {
+		return nil, lookupErr
+	}
+	ok := lookupErr != nil
+	return &ok, nil
+}
+
+// sendVerification sends u an email verification token if email
+// verification is enabled.
+func (h *Handler) sendVerification(u *user.User) error {
+	if h.sendVerificationToken == nil {
+		return nil
+	}
+	token, err := h.a.GenerateVerificationToken(u.Id)
+	if err != nil {
+		return err
+	}
+	return h.sendVerificationToken(u.Email, token)
+}
+
+// UpdateUser updates the logged in user. When the request is JSON, the
+// updated user is written back as JSON.
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	if !h.checkCSRF(w, r) {
+		return
+	}
+
+	req, err := decodeUserRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = h.a.ValidateUser(&user.User{
+	var (
+		email    = auth.NormalizeEmail(req.Email)
+		username = strings.TrimSpace(req.Username)
+		password = req.Password
+	)
+
+	// A blank password keeps the user's current password.
+	err = h.a.ValidateUserUpdate(&user.User{
 		Email:    email,
 		Username: username,
 		Password: password,
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.validationError(w, r, err)
 		return
 	}
 
-	// Get the current logged in user's username from the session.
-	cur, err := h.s.CurrentUser(r)
+	// Get the current logged in user's id from the session.
+	cur, err := h.s.CurrentUserId(r)
 	if err != nil {
-		if err == session.ErrUserNotSet {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Get the user for the associated uid.
-	u, err := h.r.Get(int64(uid))
+	u, err := h.r.Get(req.Id)
 	if err != nil {
-		if err == datastore.ErrUserNotFound {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Make sure that u's username matches cur. (invalid username for session)
-	if cur != u.Username {
-		http.Error(w, datastore.ErrUserNotFound.Error(), http.StatusNotFound)
+	// Get the session's active tenant.
+	tenantId, err := h.s.ActiveTenant(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Hash the updated password.
-	hashedPassword, err := h.a.HashPassword(password)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Make sure that u's id and tenant match the session's.
+	// (invalid user for session)
+	if cur != u.Id || tenantId != u.TenantId {
+		writeError(w, r, datastore.ErrUserNotFound.Error(), http.StatusNotFound)
 		return
 	}
 
+	// Hash the updated password, unless it was left blank, and log the
+	// user out of their other sessions.
+	if password != "" {
+		if err := h.a.SetPassword(u, password); err != nil {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		u.SessionVersion++
+	}
+
+	// A changed email needs to be verified again and, if the user has
+	// a canonical email, canonicalized again.
+	emailChanged := u.Email != email
+	if emailChanged {
+		u.EmailVerified = false
+		if u.CanonicalEmail != "" {
+			u.CanonicalEmail = auth.CanonicalizeEmail(email)
+		}
+	}
+
 	// Update the user's fields.
 	u.Email = email
 	u.Username = username
-	u.Password = hashedPassword
 
 	// Finally update the user with the new fields.
 	err = h.r.Update(u)
 	if err != nil {
-		if err == datastore.ErrUserNotFound {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if emailChanged {
+		if err := h.sendVerification(u); err != nil {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Keep the current session's username and version up to date.
+	if err := h.s.RefreshUser(w, r, u); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Updating the user counts as activity, even when the session
+	// isn't touched on every request.
+	if err := h.s.Touch(w, r); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A new password replaces an expired one.
+	if password != "" && h.s.PasswordExpired(r) {
+		if err := h.s.SetPasswordExpired(w, r, false); err != nil {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if isJSON(r) {
+		writeJSON(w, u)
+	}
+}
+
+// DeleteUser deletes the logged in user's account and then logs them out.
+func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	if !h.checkCSRF(w, r) {
+		return
+	}
+
+	req, err := decodeUserRequest(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get the current logged in user's id from the session.
+	cur, err := h.s.CurrentUserId(r)
+	if err != nil {
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the user for the associated id.
+	u, err := h.r.Get(req.Id)
+	if err != nil {
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the session's active tenant.
+	tenantId, err := h.s.ActiveTenant(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Make sure users can only delete their own account.
+	if cur != u.Id || tenantId != u.TenantId {
+		writeError(w, r, ErrNotAccountOwner.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := h.r.Delete(u.Id); err != nil {
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Log out the deleted user.
+	if err := h.s.LogOutUser(w, r); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// UserLogin logs a user in. When the request is JSON, the logged in
+// user is written back as JSON.
+//
+// Users can log in with either an email, or an identifier that's either
+// their email or their username.
+//
+// The session cookie only lasts until the user's browser is closed,
+// unless the remember field is set.
 func (h *Handler) UserLogin(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeUserRequest(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var (
-		email    = r.FormValue("email")
-		password = r.FormValue("password")
+		email      = req.Email
+		identifier = req.Identifier
+		password   = req.Password
 	)
 
 	// Make sure the email or password isn't empty.
@@ -136,40 +698,751 @@ func (h *Handler) UserLogin(w http.ResponseWriter, r *http.Request) {
 	// Full validation isn't required, since AuthenticateUser will
 	// simply return an error, but it saves a datastore call if
 	// at least a blank email or password check is in place.
-	if email == "" || password == "" {
-		http.Error(w, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
+	if (email == "" && identifier == "") || password == "" {
+		writeError(w, r, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
 		return
 	}
+	if identifier == "" {
+		identifier = email
+	}
+
+	// Reject the login if there have been too many attempts for its
+	// email, username or IP address.
+	if h.loginLimiter != nil {
+		if ok, wait := h.allowLogin(r, identifier); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeError(w, r, ErrLoginRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// Wait for a login slot, or shed the login if too many are waiting.
+	if h.loginSlots != nil {
+		if !h.acquireLoginSlot(r) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, ErrTooManyLogins.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-h.loginSlots }()
+	}
 
 	// Authenticate the user.
-	u, err := h.a.AuthenticateUser(email, password)
+	var u *user.User
+	if req.Identifier != "" {
+		u, err = h.a.AuthenticateUserByIdentifier(identifier, password)
+	} else {
+		u, err = h.a.AuthenticateUser(email, password)
+	}
+	if errors.Is(err, auth.ErrTOTPRequired) {
+		// The password was right, so remember the user until they enter
+		// their one-time password with UserLoginTOTP.
+		nonce, startErr := h.a.StartTOTPLogin(u.Id)
+		if startErr == nil {
+			startErr = h.s.StartTOTPLogin(w, r, session.TOTPLogin{
+				UserId:   u.Id,
+				Nonce:    nonce,
+				Remember: req.Remember,
+			})
+		}
+		if startErr != nil {
+			writeError(w, r, startErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
-		switch err {
-		case datastore.ErrUserNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		case auth.ErrWrongPassword:
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		switch {
+		case errors.Is(err, datastore.ErrUserNotFound):
+			writeError(w, r, err.Error(), http.StatusNotFound)
+		case errors.Is(err, auth.ErrWrongPassword):
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrAccountLocked):
+			writeError(w, r, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, auth.ErrEmailNotVerified),
+			errors.Is(err, auth.ErrAccountDisabled):
+			writeError(w, r, err.Error(), http.StatusForbidden)
 		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 
 	// Set the username to logged in for the session.
-	err = h.s.LogInUser(w, r, u.Username)
+	err = h.s.LogInUserWithOptions(w, r, u, session.LogInOptions{
+		Remember: req.Remember,
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.a.RecordLogin(u.Id); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Flag the session if the user's password has expired, so it can
+	// be enforced with RequireCurrentPassword.
+	err = h.s.SetPasswordExpired(w, r, h.a.MustChangePassword(u))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if isJSON(r) {
+		writeJSON(w, u)
+	}
+}
+
+// UserLoginTOTP is the second step of logging in a user who has enabled
+// one-time passwords, after UserLogin has responded with
+// auth.ErrTOTPRequired. It logs the user in if the code form value, or
+// the code field of a JSON body, is their current one-time password.
+//
+// The pending login ends after five codes, so codes can't be guessed
+// without logging in with the user's password again. If a login limiter
+// is set, codes are also limited per user and IP address.
+func (h *Handler) UserLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if isJSON(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Code = r.FormValue("code")
+	}
+	if req.Code == "" {
+		writeError(w, r, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get the login of the user whose password was checked by UserLogin.
+	pending, err := h.s.PendingTOTPLogin(r)
+	if err != nil {
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if h.loginLimiter != nil {
+		identifier := "totp:" + strconv.FormatInt(pending.UserId, 10)
+		if ok, wait := h.allowLogin(r, identifier); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			writeError(w, r, ErrLoginRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	u, err := h.a.FinishTOTPLogin(pending.Nonce, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrTokenExpired):
+			// The pending login has ended, so the user has to log in
+			// with their password again.
+			if endErr := h.s.EndTOTPLogin(w, r); endErr != nil {
+				writeError(w, r, endErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrInvalidTOTPCode):
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = h.s.LogInUserWithOptions(w, r, u, session.LogInOptions{
+		Remember: pending.Remember,
+	})
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.a.RecordLogin(u.Id); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.s.SetPasswordExpired(w, r, h.a.MustChangePassword(u))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if isJSON(r) {
+		writeJSON(w, u)
+	}
+}
+
+// allowLogin checks the login limiter for both identifier, which is an
+// email or username, and r's client IP address, returning false and the
+// longer wait if either is limited.
+func (h *Handler) allowLogin(r *http.Request, identifier string) (bool, time.Duration) {
+	loginOk, loginWait := h.loginLimiter.Allow("login:" + strings.ToLower(identifier))
+	ipOk, ipWait := h.loginLimiter.Allow("ip:" + clientIP(r))
+	if loginWait < ipWait {
+		loginWait = ipWait
+	}
+	return loginOk && ipOk, loginWait
+}
+
+// clientIP returns the IP address of r's client.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// retryAfter formats d as a Retry-After header value, which is a whole
+// number of seconds.
+func retryAfter(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
+
+// acquireLoginSlot waits for a login slot, returning false without one
+// if the queue of waiting logins is full or r is canceled while waiting.
+func (h *Handler) acquireLoginSlot(r *http.Request) bool {
+	select {
+	case h.loginSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// No slots are free, so wait in the queue if there's room.
+	select {
+	case h.loginQueue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-h.loginQueue }()
+
+	select {
+	case h.loginSlots <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
 	}
 }
 
 func (h *Handler) UserLogout(w http.ResponseWriter, r *http.Request) {
+	if !h.checkCSRF(w, r) {
+		return
+	}
+
 	// Log out the currently logged in user.
 	err := h.s.LogOutUser(w, r)
 	if err != nil {
-		if err == session.ErrUserNotLoggedIn {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if errors.Is(err, session.ErrUserNotLoggedIn) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SwitchTenant switches the logged in user's active tenant to the tenant
+// from the tenant_id form value.
+//
+// A user is a member of a tenant when a user with the same email exists
+// in that tenant, in which case the session is switched to that user.
+// The member must be authenticated with their own password from the
+// password form value, and have a verified email when email
+// verification is required. Members that have one-time passwords enabled must log in to the tenant with UserLogin
+// instead, since they can't be switched to without one.
+func (h *Handler) SwitchTenant(w http.ResponseWriter, r *http.Request) {
+	if !h.checkCSRF(w, r) {
+		return
+	}
+
+	tenantId := r.FormValue("tenant_id")
+	password := r.FormValue("password")
+	if password == "" {
+		writeError(w, r, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get the current logged in user's id from the session.
+	cur, err := h.s.CurrentUserId(r)
+	if err != nil {
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the current logged in user.
+	u, err := h.r.Get(cur)
+	if err != nil {
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Make sure the user is a member of the tenant, and authenticate
+	// them as that member.
+	member, err := h.a.AuthenticateTenantUser(tenantId, u.Email, password)
+	if err != nil {
+		switch {
+		case errors.Is(err, datastore.ErrUserNotFound):
+			writeError(w, r, ErrNotTenantMember.Error(), http.StatusForbidden)
+		case errors.Is(err, auth.ErrWrongPassword):
+			writeError(w, r, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrAccountLocked):
+			writeError(w, r, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, auth.ErrEmailNotVerified),
+			errors.Is(err, auth.ErrAccountDisabled),
+			errors.Is(err, auth.ErrTOTPRequired):
+			writeError(w, r, err.Error(), http.StatusForbidden)
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Switch the session to the tenant's user, which also switches the
+	// active tenant.
+	if err := h.s.LogInUser(w, r, member); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// RequestPasswordReset creates a password reset token for the user with
+// the email form value and sends it to them.
+//
+// To avoid revealing which emails are registered, it responds the same
+// way whether or not a user with the email exists.
+//
+// A new token isn't sent while a reset is pending for the email, whether
+// or not it's registered. Instead it responds with a 429 and a
+// Retry-After header set to when the pending reset expires.
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if h.sendResetToken == nil {
+		writeError(w, r, ErrPasswordResetDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	email := auth.NormalizeEmail(r.FormValue("email"))
+	if email == "" {
+		writeError(w, r, auth.ErrEmptyRequiredField.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unknown emails are limited the same way as registered ones, so
+	// the response doesn't reveal whether email is registered.
+	token, err := h.a.RequestPasswordReset(email)
+	if err != nil {
+		var pending *auth.ResetPendingError
+		switch {
+		case errors.As(err, &pending):
+			w.Header().Set("Retry-After", retryAfter(pending.Wait))
+			writeError(w, r, ErrResetPending.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, datastore.ErrUserNotFound):
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := h.sendResetToken(email, token); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ResetPassword sets a user's password to the password form value, using
+// the reset token from the token form value.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if h.sendResetToken == nil {
+		writeError(w, r, ErrPasswordResetDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	err := h.a.ResetPassword(r.FormValue("token"), r.FormValue("password"))
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken), errors.Is(err, auth.ErrTokenExpired):
+			writeError(w, r, h.errorMessage(err), http.StatusBadRequest)
+		case h.a.IsValidationErr(err):
+			h.validationError(w, r, err)
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// ChangePassword changes the logged in user's password from the
+// old_password form value to the new_password form value. It responds
+// with a 401 if the old password is wrong and a 400 if the new password
+// is invalid.
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if !h.checkCSRF(w, r) {
+		return
+	}
+
+	// Get the current logged in user's id from the session.
+	cur, err := h.s.CurrentUserId(r)
+	if err != nil {
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.a.ChangePassword(cur,
+		r.FormValue("old_password"), r.FormValue("new_password"))
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrWrongPassword):
+			writeError(w, r, h.errorMessage(err), http.StatusUnauthorized)
+		case h.a.IsValidationErr(err):
+			h.validationError(w, r, err)
+		case errors.Is(err, datastore.ErrUserNotFound):
+			writeError(w, r, err.Error(), http.StatusNotFound)
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Changing the password logs the user out of their other sessions,
+	// but keeps them logged in to this one.
+	u, err := h.r.Get(cur)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.s.RefreshUser(w, r, u); err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A new password replaces an expired one.
+	if h.s.PasswordExpired(r) {
+		if err := h.s.SetPasswordExpired(w, r, false); err != nil {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// VerifyEmail verifies a user's email using the token from the token
+// query string parameter.
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := h.a.VerifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken):
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, datastore.ErrUserNotFound):
+			writeError(w, r, err.Error(), http.StatusNotFound)
+		default:
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// RequireLogin is middleware that responds with a 401 instead of calling
+// next when no user is logged in.
+func (h *Handler) RequireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.s.UserLoggedIn(r) {
+			writeError(w, r, session.ErrUserNotLoggedIn.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// contextKey is the type of the keys handlers store values in request
+// contexts under.
+type contextKey int
+
+// currentUserKey is the key the logged in user is stored under.
+const currentUserKey contextKey = iota
+
+// WithCurrentUser is middleware that loads the logged in user from the
+// user repository and stores them in the request's context before
+// calling next, so they can be retrieved with UserFromContext without
+// looking them up again. If no user is logged in, next is called with
+// the request unchanged.
+func (h *Handler) WithCurrentUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.s.UserLoggedIn(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := h.s.CurrentUserId(r)
+		if err != nil {
+			if errors.Is(err, session.ErrUserNotSet) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		u, err := h.r.Get(id)
+		if err != nil {
+			// The user may have been deleted since they logged in.
+			if errors.Is(err, datastore.ErrUserNotFound) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), currentUserKey, u)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UserFromContext returns the logged in user stored in ctx by
+// WithCurrentUser, if any.
+func UserFromContext(ctx context.Context) (*user.User, bool) {
+	u, ok := ctx.Value(currentUserKey).(*user.User)
+	return u, ok
+}
+
+// RequireRole returns middleware that only lets logged in users with the
+// specified role through to the handler it wraps. The user's current role
+// is loaded from the user repository rather than trusting the one stored
+// in their session, so a demotion takes effect straight away. It responds
+// with a 401 if no user is logged in and a 403 if the user has a
+// different role.
+func (h *Handler) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !h.s.UserLoggedIn(r) {
+				writeError(w, r, session.ErrUserNotLoggedIn.Error(), http.StatusUnauthorized)
+				return
+			}
+			id, err := h.s.CurrentUserId(r)
+			if err != nil {
+				if errors.Is(err, session.ErrUserNotSet) {
+					writeError(w, r, ErrInsufficientRole.Error(), http.StatusForbidden)
+					return
+				}
+				writeError(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			u, err := h.r.Get(id)
+			if err != nil {
+				// The user may have been deleted since they logged in.
+				if errors.Is(err, datastore.ErrUserNotFound) {
+					writeError(w, r, ErrInsufficientRole.Error(), http.StatusForbidden)
+					return
+				}
+				writeError(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if u.Role != role {
+				writeError(w, r, ErrInsufficientRole.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireCurrentPassword is middleware that responds with a 403 instead
+// of calling next when the logged in user's password has expired, until
+// they change it with UpdateUser or ChangePassword.
+func (h *Handler) RequireCurrentPassword(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.s.PasswordExpired(r) {
+			writeError(w, r, ErrPasswordExpired.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TouchSession is middleware that marks the logged in user's session
+// as active before calling next, so that it doesn't idle out while it's
+// being used.
+func (h *Handler) TouchSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := h.s.Touch(w, r)
+		if err != nil && !errors.Is(err, session.ErrUserNotLoggedIn) {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recover is middleware that recovers from panics in the handler it
+// wraps. The panic and its stack are logged and the client gets a
+// generic 500 JSON error, so the stack isn't leaked to them.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// ErrAbortHandler is used to abort a response on purpose.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": http.StatusText(http.StatusInternalServerError),
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// domainCountsLimit is the default number of domains DomainCounts writes.
+const domainCountsLimit = 10
+
+// DomainCounts writes a JSON array of the email domains with the most
+// users, up to the limit query string parameter or 10 by default. Only
+// admins can access it.
+//
+// The counts are global, covering the users of every tenant, so any
+// admin can see them whichever tenant they belong to. Don't route it
+// where tenants' admins shouldn't see other tenants' users.
+func (h *Handler) DomainCounts(w http.ResponseWriter, r *http.Request) {
+	h.RequireRole(user.RoleAdmin)(http.HandlerFunc(h.domainCounts)).ServeHTTP(w, r)
+}
+
+func (h *Handler) domainCounts(w http.ResponseWriter, r *http.Request) {
+	limit := domainCountsLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			writeError(w, r, ErrInvalidLimit.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	counts, err := h.r.DomainCounts(limit)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, counts)
+}
+
+// checkCSRF verifies r's CSRF token when CSRF protection is enabled. If
+// it's invalid, a 403 is written and false is returned.
+func (h *Handler) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if !h.verifyCSRF {
+		return true
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf_token")
+	}
+	if err := h.s.VerifyCSRF(r, token); err != nil {
+		if errors.Is(err, session.ErrInvalidCSRF) {
+			writeError(w, r, err.Error(), http.StatusForbidden)
+			return false
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// Session writes a JSON object describing the request's session, which
+// contains whether a user is logged in, their username, whether they
+// must change their password and a CSRF token bound to the session.
+func (h *Handler) Session(w http.ResponseWriter, r *http.Request) {
+	// Get or create the CSRF token before anything is written, since
+	// creating a token saves the session's cookie.
+	token, err := h.s.CSRFToken(w, r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Authenticated      bool   `json:"authenticated"`
+		Username           string `json:"username"`
+		CSRFToken          string `json:"csrfToken"`
+		MustChangePassword bool   `json:"mustChangePassword"`
+	}{CSRFToken: token}
+
+	if h.s.UserLoggedIn(r) {
+		resp.Username, err = h.s.CurrentUser(r)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		resp.Authenticated = true
+		resp.MustChangePassword = h.s.PasswordExpired(r)
+	}
+
+	writeJSON(w, resp)
+}
+
+// WhoAmI writes the logged in user as JSON, without their password, so
+// clients can find out who's logged in. The user is looked up by the id
+// in their session, so renamed users and users in other tenants are
+// found. It responds with a 401 if no user is logged in, or if they've
+// since been deleted.
+func (h *Handler) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	if !h.s.UserLoggedIn(r) {
+		writeError(w, r, session.ErrUserNotLoggedIn.Error(), http.StatusUnauthorized)
+		return
 	}
+	id, err := h.s.CurrentUserId(r)
+	if err != nil {
+		if errors.Is(err, session.ErrUserNotSet) {
+			writeError(w, r, session.ErrUserNotLoggedIn.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := h.r.Get(id)
+	if err != nil {
+		if errors.Is(err, datastore.ErrUserNotFound) {
+			writeError(w, r, session.ErrUserNotLoggedIn.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, u)
+}
+
+// Info writes a JSON object containing the server's version and which
+// of the handler's features are enabled, so clients can adapt to the
+// server's configuration.
+func (h *Handler) Info(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Version  string `json:"version"`
+		Features struct {
+			Registration              bool `json:"registration"`
+			PasswordReset             bool `json:"passwordReset"`
+			EmailVerificationRequired bool `json:"emailVerificationRequired"`
+		} `json:"features"`
+	}{Version: Version}
+	resp.Features.Registration = !h.registrationDisabled
+	resp.Features.PasswordReset = h.sendResetToken != nil
+	resp.Features.EmailVerificationRequired = h.sendVerificationToken != nil
+
+	writeJSON(w, resp)
 }
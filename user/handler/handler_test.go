@@ -1,13 +1,18 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/radovskyb/services/user"
@@ -56,9 +61,10 @@ func TestRegisterUser(t *testing.T) {
 
 	uh.RegisterUser(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
 	}
+	rr = httptest.NewRecorder()
 
 	usr, err := uh.r.GetByEmail(testEmail)
 	if err != nil {
@@ -95,11 +101,9 @@ func TestRegisterUser(t *testing.T) {
 
 	rr = httptest.NewRecorder()
 
-	closer, ok := uh.r.(io.Closer)
-	if !ok {
-		t.Fatal("repo doesn't implement an io.Closer")
+	if err := uh.r.Close(); err != nil {
+		t.Fatal(err)
 	}
-	closer.Close()
 
 	uh.RegisterUser(rr, req)
 
@@ -108,6 +112,35 @@ func TestRegisterUser(t *testing.T) {
 	}
 }
 
+func TestRegisterUserDisabled(t *testing.T) {
+	uh := setup()
+	WithRegistration(false)(uh)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// Make sure the user wasn't created.
+	_, err = uh.r.GetByEmail(testEmail)
+	if err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+}
+
 func TestUpdateUser(t *testing.T) {
 	uh := setup()
 
@@ -140,9 +173,10 @@ func TestUpdateUser(t *testing.T) {
 
 	uh.RegisterUser(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
 	}
+	rr = httptest.NewRecorder()
 
 	// Try to update a user that isn't logged in.
 	uh.UpdateUser(rr, req)
@@ -197,16 +231,42 @@ func TestUpdateUser(t *testing.T) {
 		t.Fatalf("expected code to be 200, got %d", rr.Code)
 	}
 
-	// Modify the username so it doesn't match the session.
-	err = uh.r.Update(&user.User{
-		Id:       1,
-		Email:    testEmail,
-		Username: "newusername",
+	// Changing the username doesn't affect the session, since users
+	// are matched by id.
+	pf.Set("username", "newusername")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.UpdateUser(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// The session is refreshed with the new username.
+	if cur, err := uh.s.CurrentUser(req); err != nil || cur != "newusername" {
+		t.Errorf("expected current user to be newusername, got %q, %v", cur, err)
+	}
+
+	// The renamed user can still be updated.
+	uh.UpdateUser(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Try to update another user, which doesn't match the session.
+	err = uh.r.Create(&user.User{
+		Email:    "another@gmail.com",
+		Username: "another",
 		Password: testPassword,
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	pf.Set("id", "2")
+	req.Form = pf
 
 	uh.UpdateUser(rr, req)
 
@@ -221,11 +281,9 @@ func TestUpdateUser(t *testing.T) {
 	// Try to update a user after the datastore is closed.
 	rr = httptest.NewRecorder()
 
-	closer, ok := uh.r.(io.Closer)
-	if !ok {
-		t.Fatal("repo is not an io.Closer")
+	if err := uh.r.Close(); err != nil {
+		t.Fatal(err)
 	}
-	closer.Close()
 
 	uh.UpdateUser(rr, req)
 
@@ -234,7 +292,7 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
-func TestUserLogin(t *testing.T) {
+func TestUpdateUserWithBlankPassword(t *testing.T) {
 	uh := setup()
 
 	// Register a user.
@@ -252,10 +310,67 @@ func TestUserLogin(t *testing.T) {
 
 	uh.RegisterUser(rr, req)
 
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	// Login the user.
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Update only the user's email.
+	newEmail := "newemail@gmail.com"
+	pf.Set("id", "1")
+	pf.Set("email", newEmail)
+	pf.Set("password", "")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.UpdateUser(rr, req)
+
 	if rr.Code != http.StatusOK {
 		t.Fatalf("expected code to be 200, got %d", rr.Code)
 	}
 
+	// The user should still be able to authenticate with
+	// their original password.
+	u, err := uh.a.AuthenticateUser(newEmail, testPassword)
+	if err != nil {
+		t.Fatalf("expected user to authenticate, got %v", err)
+	}
+	if u.Email != newEmail {
+		t.Errorf("expected email to be %s, got %s", newEmail, u.Email)
+	}
+}
+
+func TestUserLogin(t *testing.T) {
+	uh := setup()
+
+	// Register a user.
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
 	// Check that there's no user set to logged in for the session.
 	loggedIn := uh.s.UserLoggedIn(req)
 	if loggedIn {
@@ -302,8 +417,8 @@ func TestUserLoginWithInvalidData(t *testing.T) {
 
 	uh.RegisterUser(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
 	}
 
 	// Try to log the user in with empty values.
@@ -361,6 +476,61 @@ func TestUserLoginWithInvalidData(t *testing.T) {
 	}
 }
 
+func TestUserLoginAccountLocked(t *testing.T) {
+	uh := setup()
+	uh.a = auth.NewAuth(uh.r, auth.WithLockout(2, time.Hour, time.Minute))
+
+	// Register a user.
+	rr := httptest.NewRecorder()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	// Fail to log in enough times to lock the account.
+	pf.Set("password", "wrongpassword")
+	req.Form = pf
+
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+
+		uh.UserLogin(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected code to be 401, got %d", rr.Code)
+		}
+	}
+
+	// Try to log in with the correct password.
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.TrimSpace(body) != auth.ErrAccountLocked.Error() {
+		t.Errorf("expected body to be an account locked error, got %s", body)
+	}
+}
+
 func TestUserLoginAfterRepoClose(t *testing.T) {
 	uh := setup()
 
@@ -379,11 +549,9 @@ func TestUserLoginAfterRepoClose(t *testing.T) {
 	// Try to log the user in.
 
 	// Close the user repository.
-	closer, ok := uh.r.(io.Closer)
-	if !ok {
-		t.Fatal("repo doesn't implement an io.Closer")
+	if err := uh.r.Close(); err != nil {
+		t.Fatal(err)
 	}
-	closer.Close()
 
 	uh.UserLogin(rr, req)
 
@@ -424,9 +592,10 @@ func TestUserLogout(t *testing.T) {
 	// Register a user.
 	uh.RegisterUser(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
 	}
+	rr = httptest.NewRecorder()
 
 	// Log the user in.
 	uh.UserLogin(rr, req)
@@ -450,3 +619,2095 @@ func TestUserLogout(t *testing.T) {
 		t.Error("expected no user to be logged in")
 	}
 }
+
+func TestSession(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	var resp struct {
+		Authenticated bool   `json:"authenticated"`
+		Username      string `json:"username"`
+		CSRFToken     string `json:"csrfToken"`
+	}
+
+	// Get the session when no user is logged in.
+	rr := httptest.NewRecorder()
+
+	uh.Session(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Authenticated {
+		t.Error("expected authenticated to be false")
+	}
+	if resp.Username != "" {
+		t.Errorf("expected username to be blank, got %s", resp.Username)
+	}
+	if resp.CSRFToken == "" {
+		t.Error("expected csrf token to not be blank")
+	}
+
+	// Make sure the token is bound to the session.
+	token, err := uh.s.CSRFToken(rr, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if resp.CSRFToken != token {
+		t.Errorf("expected csrf token to be %s, got %s", token, resp.CSRFToken)
+	}
+
+	// Register and log the user in.
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Get the session now that the user is logged in.
+	rr = httptest.NewRecorder()
+
+	uh.Session(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Authenticated {
+		t.Error("expected authenticated to be true")
+	}
+	if resp.Username != testUsername {
+		t.Errorf("expected username to be %s, got %s", testUsername, resp.Username)
+	}
+
+	token, err = uh.s.CSRFToken(rr, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if resp.CSRFToken == "" || resp.CSRFToken != token {
+		t.Errorf("expected csrf token to be %s, got %s", token, resp.CSRFToken)
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	// No user is logged in.
+	rr := httptest.NewRecorder()
+	uh.WhoAmI(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401, got %d", rr.Code)
+	}
+
+	// Register and log the user in.
+	rr = httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	uh.WhoAmI(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	var resp map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["email"] != testEmail || resp["username"] != testUsername {
+		t.Errorf("expected user %s (%s), got %v", testUsername, testEmail, resp)
+	}
+	if _, ok := resp["password"]; ok {
+		t.Error("expected password not to be written")
+	}
+
+	// The user is still found after they're renamed.
+	if err := uh.r.UpdateUsername(1, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	uh.WhoAmI(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	resp = nil
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["username"] != "renamed" {
+		t.Errorf("expected username to be renamed, got %v", resp["username"])
+	}
+}
+
+func TestInfo(t *testing.T) {
+	var resp struct {
+		Version  string `json:"version"`
+		Features struct {
+			Registration bool `json:"registration"`
+		} `json:"features"`
+	}
+
+	testCases := []struct {
+		opts         []Option
+		registration bool
+	}{
+		{nil, true},
+		{[]Option{WithRegistration(true)}, true},
+		{[]Option{WithRegistration(false)}, false},
+	}
+	for _, tc := range testCases {
+		uh := setup()
+		for _, opt := range tc.opts {
+			opt(uh)
+		}
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		uh.Info(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected code to be 200, got %d", rr.Code)
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Version != Version {
+			t.Errorf("expected version to be %s, got %s", Version, resp.Version)
+		}
+		if resp.Features.Registration != tc.registration {
+			t.Errorf("expected registration to be %t, got %t",
+				tc.registration, resp.Features.Registration)
+		}
+	}
+}
+
+func TestSwitchTenant(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	pf.Set("tenant_id", "acme")
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	// Try to switch tenants when no user is logged in.
+	uh.SwitchTenant(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected code to be 404, got %d", rr.Code)
+	}
+
+	// Register and log the user in.
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Make the user a member of the acme tenant, with its own password.
+	hash, err := uh.a.HashPassword("acmepassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := &user.User{
+		Email:    testEmail,
+		Username: "acmeuser",
+		Password: hash,
+		TenantId: "acme",
+	}
+	if err := uh.r.Create(member); err != nil {
+		t.Fatal(err)
+	}
+
+	// switchTenant tries to switch to tenantId with password.
+	switchTenant := func(tenantId, password string) *httptest.ResponseRecorder {
+		pf.Set("tenant_id", tenantId)
+		pf.Set("password", password)
+		req.Form = pf
+		rr := httptest.NewRecorder()
+		uh.SwitchTenant(rr, req)
+		return rr
+	}
+
+	// Try to switch without a password, or with the wrong one.
+	if rr := switchTenant("acme", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+	if rr := switchTenant("acme", testPassword); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401, got %d", rr.Code)
+	}
+
+	// Switch to the acme tenant. Email verification isn't required, so
+	// the member's email doesn't need to be verified.
+	if rr := switchTenant("acme", "acmepassword"); rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	tenantId, err := uh.s.ActiveTenant(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId != "acme" {
+		t.Errorf("expected active tenant to be acme, got %s", tenantId)
+	}
+	cur, err := uh.s.CurrentUser(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if cur != "acmeuser" {
+		t.Errorf("expected current user to be acmeuser, got %s", cur)
+	}
+
+	// Try to switch to a tenant the user isn't a member of.
+	rr = switchTenant("other", "acmepassword")
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.TrimSpace(body) != ErrNotTenantMember.Error() {
+		t.Errorf("expected body to be a not tenant member error, got %s", body)
+	}
+
+	// Try to switch to a member that has one-time passwords enabled.
+	err = uh.r.Create(&user.User{
+		Email:       testEmail,
+		Username:    "totpuser",
+		Password:    hash,
+		TenantId:    "totp",
+		TOTPEnabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := switchTenant("totp", "acmepassword"); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// The active tenant should be unchanged.
+	tenantId, err = uh.s.ActiveTenant(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId != "acme" {
+		t.Errorf("expected active tenant to be acme, got %s", tenantId)
+	}
+
+	// Switch back to the default tenant.
+	if rr := switchTenant("", testPassword); rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	cur, err = uh.s.CurrentUser(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if cur != testUsername {
+		t.Errorf("expected current user to be %s, got %s", testUsername, cur)
+	}
+	if tenantId, _ = uh.s.ActiveTenant(req); tenantId != "" {
+		t.Errorf("expected active tenant to be blank, got %s", tenantId)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	// Password resets are disabled by default.
+	uh.RequestPasswordReset(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected code to be 404, got %d", rr.Code)
+	}
+
+	var sentEmail, sentToken string
+	WithPasswordReset(func(email, token string) error {
+		sentEmail, sentToken = email, token
+		return nil
+	})(uh)
+
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	uh.RequestPasswordReset(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if sentEmail != testEmail || sentToken == "" {
+		t.Fatalf("expected a token to be sent to %s, got %q sent to %s",
+			testEmail, sentToken, sentEmail)
+	}
+
+	// Another reset can't be requested while one is pending.
+	token := sentToken
+
+	rr = httptest.NewRecorder()
+
+	uh.RequestPasswordReset(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header to be set")
+	}
+	if sentToken != token {
+		t.Error("expected no new token to be sent")
+	}
+
+	// Reset the user's password.
+	pf.Set("token", sentToken)
+	pf.Set("password", "newpassword")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.ResetPassword(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if _, err := uh.a.AuthenticateUser(testEmail, "newpassword"); err != nil {
+		t.Errorf("expected user to authenticate with new password, got %v", err)
+	}
+
+	// Try to use the token again.
+	rr = httptest.NewRecorder()
+
+	uh.ResetPassword(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.TrimSpace(body) != auth.ErrInvalidToken.Error() {
+		t.Errorf("expected body to be an invalid token error, got %s", body)
+	}
+
+	// Requesting a reset for an unknown email looks like it succeeded.
+	sentToken = ""
+	pf.Set("email", "unknown@gmail.com")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.RequestPasswordReset(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if sentToken != "" {
+		t.Errorf("expected no token to be sent, got %q", sentToken)
+	}
+
+	// And is limited like a registered email.
+	rr = httptest.NewRecorder()
+
+	uh.RequestPasswordReset(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	var sentEmail, sentToken string
+	uh := NewHandler(
+		datastore.NewMockRepo(),
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithEmailVerification(func(email, token string) error {
+			sentEmail, sentToken = email, token
+			return nil
+		}),
+	)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	if sentEmail != testEmail || sentToken == "" {
+		t.Fatalf("expected a token to be sent to %s, got %q sent to %s",
+			testEmail, sentToken, sentEmail)
+	}
+
+	// Try to log in before verifying the email.
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// Verify the email.
+	verifyReq, err := http.NewRequest("GET",
+		server.URL+"?token="+url.QueryEscape(sentToken), nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.VerifyEmail(rr, verifyReq)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Try to use the token again.
+	rr = httptest.NewRecorder()
+
+	uh.VerifyEmail(rr, verifyReq)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	uh := setup()
+
+	adminOnly := uh.RequireRole(user.RoleAdmin)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "admin")
+		}),
+	)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	// Try to access the route when no user is logged in.
+	adminOnly.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401, got %d", rr.Code)
+	}
+
+	// Register and log in a regular user.
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	role, err := uh.s.CurrentRole(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if role != user.RoleUser {
+		t.Errorf("expected role to be %s, got %s", user.RoleUser, role)
+	}
+
+	rr = httptest.NewRecorder()
+
+	adminOnly.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// Make the user an admin and log them in again.
+	u, err := uh.r.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Role = user.RoleAdmin
+	if err := uh.r.Update(u); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+
+	adminOnly.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if body := rr.Body.String(); body != "admin" {
+		t.Errorf("expected body to be admin, got %s", body)
+	}
+
+	// Demoting the user takes effect without them logging in again.
+	u.Role = user.RoleUser
+	if err := uh.r.Update(u); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+
+	adminOnly.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+}
+
+func TestJSONRequests(t *testing.T) {
+	uh := setup()
+
+	// newJSONRequest creates a request with body encoded as JSON.
+	newJSONRequest := func(body interface{}) *http.Request {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return req
+	}
+
+	// Register a user.
+	req := newJSONRequest(map[string]string{
+		"email":    testEmail,
+		"username": testUsername,
+		"password": testPassword,
+	})
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type to be application/json, got %s", ct)
+	}
+	if strings.Contains(rr.Body.String(), `"password"`) {
+		t.Errorf("expected response not to contain a password, got %s", rr.Body)
+	}
+	var u user.User
+	if err := json.NewDecoder(rr.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Id == 0 || u.Email != testEmail || u.Username != testUsername {
+		t.Errorf("expected registered user, got %+v", u)
+	}
+
+	// Log the user in. The same request is used for the session cookie.
+	req = newJSONRequest(map[string]string{
+		"email":    testEmail,
+		"password": testPassword,
+	})
+
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	u = user.User{}
+	if err := json.NewDecoder(rr.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != testUsername {
+		t.Errorf("expected username to be %s, got %s", testUsername, u.Username)
+	}
+
+	// Update the user, reusing the logged in session.
+	body, err := json.Marshal(map[string]interface{}{
+		"id":       u.Id,
+		"email":    "new@gmail.com",
+		"username": testUsername,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(strings.NewReader(string(body)))
+
+	rr = httptest.NewRecorder()
+
+	uh.UpdateUser(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	u = user.User{}
+	if err := json.NewDecoder(rr.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "new@gmail.com" {
+		t.Errorf("expected email to be new@gmail.com, got %s", u.Email)
+	}
+
+	// Invalid JSON is a bad request.
+	req = newJSONRequest(nil)
+	req.Body = io.NopCloser(strings.NewReader("{"))
+
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("id", "1")
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	// Try to delete a user when no user is logged in.
+	uh.DeleteUser(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected code to be 404, got %d", rr.Code)
+	}
+
+	// Register and log the user in.
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Create another user.
+	err = uh.r.Create(&user.User{
+		Email:    "example_user@gmail.com",
+		Username: "exampleuser",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Try to delete a user that doesn't exist.
+	pf.Set("id", "3")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.DeleteUser(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected code to be 404, got %d", rr.Code)
+	}
+
+	// Try to delete the other user's account.
+	pf.Set("id", "2")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.DeleteUser(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.TrimSpace(body) != ErrNotAccountOwner.Error() {
+		t.Errorf("expected body to be a not account owner error, got %s", body)
+	}
+	if _, err := uh.r.Get(2); err != nil {
+		t.Errorf("expected other user to still exist, got %v", err)
+	}
+
+	// Delete the user's own account.
+	pf.Set("id", "1")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.DeleteUser(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if _, err := uh.r.Get(1); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+	if uh.s.UserLoggedIn(req) {
+		t.Error("expected user to be logged out")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	// Discard the logged panic.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["panic"]++
+	}))
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The server should keep serving after a panic.
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected code to be 500, got %d", rr.Code)
+		}
+		var resp map[string]string
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp["error"] != "Internal Server Error" {
+			t.Errorf("expected a generic error, got %q", resp["error"])
+		}
+	}
+
+	// Handlers that don't panic are unaffected.
+	h = Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Errorf("expected 200 ok, got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestDomainCounts(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("GET", server.URL+"?limit=1", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	err = uh.r.Create(&user.User{
+		Email:    "user@example.com",
+		Username: "exampleuser",
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Regular users can't access the endpoint.
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.DomainCounts(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// Make the user an admin and log them in again.
+	u, err := uh.r.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Role = user.RoleAdmin
+	if err := uh.r.Update(u); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+
+	uh.DomainCounts(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	var counts []datastore.DomainCount
+	if err := json.NewDecoder(rr.Body).Decode(&counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[0] != (datastore.DomainCount{Domain: "example.com", Users: 1}) {
+		t.Errorf("expected only example.com with 1 user, got %v", counts)
+	}
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	uh := NewHandler(
+		datastore.NewMockRepo(),
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithAuthOptions(auth.WithPasswordMaxAge(time.Hour)),
+	)
+
+	protected := uh.RequireCurrentPassword(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("id", "1")
+	pf.Set("email", testEmail)
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	// A fresh password grants full access.
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	protected.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Age the user's password and log in again.
+	u, err := uh.r.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changedAt := time.Now().Add(-2 * time.Hour)
+	u.PasswordChangedAt = &changedAt
+	if err := uh.r.Update(u); err != nil {
+		t.Fatal(err)
+	}
+
+	uh.UserLogin(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+
+	protected.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected code to be 403, got %d", rr.Code)
+	}
+
+	// Change the password.
+	pf.Set("password", "newpassword")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.UpdateUser(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	protected.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+}
+
+func TestUserLoginRemember(t *testing.T) {
+	for _, remember := range []string{"", "on"} {
+		uh := setup()
+
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		pf := url.Values{}
+		pf.Set("email", testEmail)
+		pf.Set("username", testUsername)
+		pf.Set("password", testPassword)
+		pf.Set("remember", remember)
+		req.Form = pf
+
+		rr := httptest.NewRecorder()
+
+		uh.RegisterUser(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected code to be 201, got %d", rr.Code)
+		}
+		rr = httptest.NewRecorder()
+
+		uh.UserLogin(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected code to be 200, got %d", rr.Code)
+		}
+
+		cookie := rr.Header().Get("Set-Cookie")
+		if hasMaxAge := strings.Contains(cookie, "Max-Age="); hasMaxAge != (remember == "on") {
+			t.Errorf("remember %q: unexpected cookie max age in %s", remember, cookie)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	const msg = "Please enter a valid email address."
+	uh := NewHandler(
+		datastore.NewMockRepo(),
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithErrorMessages(map[error]string{auth.ErrInvalidEmail: msg}),
+	)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	pf := url.Values{}
+	pf.Set("email", "invalid@email")
+	pf.Set("username", testUsername)
+	pf.Set("password", testPassword)
+	req.Form = pf
+
+	rr := httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != msg {
+		t.Errorf("expected body to be %q, got %q", msg, body)
+	}
+
+	// The sentinel error is still a validation error.
+	if !uh.a.IsValidationErr(auth.ErrInvalidEmail) {
+		t.Error("expected ErrInvalidEmail to be a validation error")
+	}
+
+	// Errors without a custom message are written as they are.
+	pf.Set("email", testEmail)
+	pf.Set("username", "")
+	req.Form = pf
+
+	rr = httptest.NewRecorder()
+
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected code to be 400, got %d", rr.Code)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body == msg {
+		t.Errorf("expected body not to be %q", msg)
+	}
+}
+
+func TestLoginLimit(t *testing.T) {
+	uh := setup()
+	WithLoginLimit(1, 1)(uh)
+
+	err := uh.a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newLogin := func(ctx context.Context) *http.Request {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Form = url.Values{
+			"email":    {testEmail},
+			"password": {testPassword},
+		}
+		return req.WithContext(ctx)
+	}
+
+	// Normal load passes.
+	rr := httptest.NewRecorder()
+	uh.UserLogin(rr, newLogin(context.Background()))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	// Take the only slot, so the next login is queued.
+	uh.loginSlots <- struct{}{}
+
+	queued := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		uh.UserLogin(rr, newLogin(context.Background()))
+		queued <- rr.Code
+	}()
+	for len(uh.loginQueue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so logins are shed.
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, newLogin(context.Background()))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected code to be 503, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// Freeing the slot lets the queued login through.
+	<-uh.loginSlots
+	if code := <-queued; code != http.StatusOK {
+		t.Fatalf("expected queued code to be 200, got %d", code)
+	}
+
+	// A queued login is shed when its request is canceled.
+	uh.loginSlots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, newLogin(ctx))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected code to be 503, got %d", rr.Code)
+	}
+	<-uh.loginSlots
+}
+
+// wrappingAuth wraps the errors returned by AuthenticateUser with
+// context, like a decorator might.
+type wrappingAuth struct{ auth.Auth }
+
+func (a wrappingAuth) AuthenticateUser(email, password string) (*user.User, error) {
+	u, err := a.Auth.AuthenticateUser(email, password)
+	if err != nil {
+		return nil, fmt.Errorf("authenticating %s: %w", email, err)
+	}
+	return u, nil
+}
+
+func TestWrappedErrors(t *testing.T) {
+	uh := setup()
+	uh.a = wrappingAuth{uh.a}
+
+	err := uh.a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		email, password string
+		code            int
+	}{
+		{"unknown@gmail.com", testPassword, http.StatusNotFound},
+		{testEmail, "wrongpassword", http.StatusUnauthorized},
+		{testEmail, testPassword, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Form = url.Values{
+			"email":    {tc.email},
+			"password": {tc.password},
+		}
+
+		rr := httptest.NewRecorder()
+
+		uh.UserLogin(rr, req)
+
+		if rr.Code != tc.code {
+			t.Errorf("%s: expected code to be %d, got %d", tc.email, tc.code, rr.Code)
+		}
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	uh := setup()
+	limiter := NewTokenBucket(2, time.Minute)
+	now := time.Now()
+	limiter.(*tokenBucket).now = func() time.Time { return now }
+	WithLoginRateLimit(limiter)(uh)
+
+	err := uh.a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(email, password, remoteAddr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		req.Form = url.Values{
+			"email":    {email},
+			"password": {password},
+		}
+		rr := httptest.NewRecorder()
+		uh.UserLogin(rr, req)
+		return rr
+	}
+
+	// Exhaust the limit.
+	for i := 0; i < 2; i++ {
+		rr := login(testEmail, "wrongpassword", "10.0.0.1:1234")
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected code to be 401, got %d", rr.Code)
+		}
+	}
+	rr := login(testEmail, testPassword, "10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After to be 60, got %q", got)
+	}
+
+	// The email is limited from other IP addresses too.
+	rr = login(strings.ToUpper(testEmail), testPassword, "10.0.0.2:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+
+	// Other emails from other IP addresses aren't limited.
+	rr = login("unknown@gmail.com", testPassword, "10.0.0.3:1234")
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected code to be 404, got %d", rr.Code)
+	}
+
+	// The limit recovers once a token is refilled.
+	now = now.Add(time.Minute)
+	rr = login(testEmail, testPassword, "10.0.0.1:1234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+}
+
+func TestSignupRateLimit(t *testing.T) {
+	uh := setup()
+	limiter := NewTokenBucket(2, time.Minute)
+	now := time.Now()
+	limiter.(*tokenBucket).now = func() time.Time { return now }
+	WithSignupRateLimit(limiter)(uh)
+
+	register := func(n int, remoteAddr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		req.Form = url.Values{
+			"email":    {fmt.Sprintf("user%d@gmail.com", n)},
+			"username": {fmt.Sprintf("user%d", n)},
+			"password": {testPassword},
+		}
+		rr := httptest.NewRecorder()
+		uh.RegisterUser(rr, req)
+		return rr
+	}
+
+	// Register up to the limit.
+	for i := 0; i < 2; i++ {
+		rr := register(i, "10.0.0.1:1234")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected code to be 201, got %d", rr.Code)
+		}
+	}
+	rr := register(2, "10.0.0.1:5678")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected code to be 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After to be 60, got %q", got)
+	}
+	if _, err := uh.r.GetByEmail("user2@gmail.com"); err != datastore.ErrUserNotFound {
+		t.Errorf("expected err to be ErrUserNotFound, got %v", err)
+	}
+
+	// Other IP addresses aren't limited.
+	rr = register(3, "10.0.0.2:1234")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+
+	// The limit recovers once the window advances.
+	now = now.Add(time.Minute)
+	rr = register(2, "10.0.0.1:1234")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	uh := setup()
+	WithCSRFProtection()(uh)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	rr := httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if !uh.s.UserLoggedIn(req) {
+		t.Fatal("expected user to be logged in")
+	}
+
+	token, err := uh.s.CSRFToken(rr, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing and mismatched tokens are rejected before anything changes.
+	for _, tc := range []string{"", token + "x"} {
+		req.Form.Set("csrf_token", tc)
+
+		rr := httptest.NewRecorder()
+		uh.UserLogout(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("%q: expected code to be 403, got %d", tc, rr.Code)
+		}
+		if !uh.s.UserLoggedIn(req) {
+			t.Fatalf("%q: expected user to still be logged in", tc)
+		}
+
+		rr = httptest.NewRecorder()
+		uh.DeleteUser(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("%q: expected code to be 403, got %d", tc, rr.Code)
+		}
+		if _, err := uh.r.GetByEmail(testEmail); err != nil {
+			t.Fatalf("%q: expected user to still exist, got %v", tc, err)
+		}
+	}
+
+	// A valid token in the header is accepted.
+	req.Form.Del("csrf_token")
+	req.Header.Set("X-CSRF-Token", token)
+	rr = httptest.NewRecorder()
+	uh.UserLogout(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if uh.s.UserLoggedIn(req) {
+		t.Error("expected user to be logged out")
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	uh := setup()
+
+	loggedInOnly := uh.RequireLogin(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "logged in")
+	})
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	// Try to access the route when no user is logged in.
+	rr := httptest.NewRecorder()
+	loggedInOnly(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401, got %d", rr.Code)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != session.ErrUserNotLoggedIn.Error() {
+		t.Errorf("expected body to be a user not logged in error, got %s", body)
+	}
+
+	// Register and log in a user.
+	rr = httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	loggedInOnly(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if body := rr.Body.String(); body != "logged in" {
+		t.Errorf("expected body to be logged in, got %s", body)
+	}
+}
+
+func TestWithCurrentUser(t *testing.T) {
+	uh := setup()
+
+	var (
+		ctxUser *user.User
+		ok      bool
+	)
+	h := uh.WithCurrentUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxUser, ok = UserFromContext(r.Context())
+	}))
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	// There's no user in the context when no user is logged in.
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if ok || ctxUser != nil {
+		t.Fatalf("expected no user in context, got %v", ctxUser)
+	}
+
+	// Register and log in a user.
+	rr = httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if !ok || ctxUser == nil {
+		t.Fatal("expected user in context")
+	}
+	if ctxUser.Email != testEmail || ctxUser.Username != testUsername {
+		t.Errorf("expected user %s, got %s (%s)", testUsername, ctxUser.Username, ctxUser.Email)
+	}
+
+	// Once the user is deleted, they're no longer put in the context.
+	if err := uh.r.Delete(ctxUser.Id); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if ok || ctxUser != nil {
+		t.Errorf("expected no user in context, got %v", ctxUser)
+	}
+}
+
+func TestUserLoginTOTP(t *testing.T) {
+	uh := setup()
+
+	u := &user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	}
+	if err := uh.a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := uh.a.EnableTOTP(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := auth.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uh.a.VerifyTOTP(u.Id, code); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"password": {testPassword},
+		"remember": {"on"},
+	}
+	login := func() {
+		rr := httptest.NewRecorder()
+		uh.UserLogin(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected code to be 401, got %d", rr.Code)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); body != auth.ErrTOTPRequired.Error() {
+			t.Errorf("expected body to be a totp required error, got %s", body)
+		}
+		if uh.s.UserLoggedIn(req) {
+			t.Fatal("expected user to not be logged in before entering a code")
+		}
+	}
+	loginTOTP := func(code string) *httptest.ResponseRecorder {
+		req.Form.Set("code", code)
+		rr := httptest.NewRecorder()
+		uh.UserLoginTOTP(rr, req)
+		return rr
+	}
+
+	// A wrong code is rejected.
+	login()
+	if rr := loginTOTP("000000"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401, got %d", rr.Code)
+	}
+	if uh.s.UserLoggedIn(req) {
+		t.Fatal("expected user to not be logged in")
+	}
+
+	// A code that's already been used is rejected.
+	if rr := loginTOTP(code); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401 for a used code, got %d", rr.Code)
+	}
+
+	// The right code logs the user in, remembering them if asked to
+	// when they entered their password.
+	code, err = auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := loginTOTP(code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if !uh.s.UserLoggedIn(req) {
+		t.Error("expected user to be logged in")
+	}
+	if _, err := uh.s.PendingTOTPLogin(req); err != session.ErrUserNotSet {
+		t.Errorf("expected pending login to end, got %v", err)
+	}
+	if cookie := rr.Header().Get("Set-Cookie"); !strings.Contains(cookie, "Max-Age=") {
+		t.Errorf("expected a remembered cookie, got %s", cookie)
+	}
+
+	// The pending login ends after too many codes, even if the session
+	// still has it.
+	if err := uh.s.LogOutUser(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	login()
+	pending, err := uh.s.PendingTOTPLogin(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if rr := loginTOTP("000000"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected code to be 401, got %d", rr.Code)
+		}
+	}
+	if _, err := uh.a.FinishTOTPLogin(pending.Nonce, code); err != auth.ErrInvalidToken {
+		t.Errorf("expected err to be ErrInvalidToken, got %v", err)
+	}
+	if rr := loginTOTP(code); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected code to be 401 after too many codes, got %d", rr.Code)
+	}
+	if _, err := uh.s.PendingTOTPLogin(req); err != session.ErrUserNotSet {
+		t.Errorf("expected pending login to end, got %v", err)
+	}
+}
+
+func TestUserLoginWithIdentifier(t *testing.T) {
+	uh := setup()
+
+	err := uh.a.CreateUser(&user.User{
+		Email:    testEmail,
+		Username: testUsername,
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identifier := range []string{testEmail, testUsername} {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Form = url.Values{
+			"identifier": {identifier},
+			"password":   {testPassword},
+		}
+
+		rr := httptest.NewRecorder()
+		uh.UserLogin(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected code to be 200, got %d", identifier, rr.Code)
+		}
+		username, err := uh.s.CurrentUser(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != testUsername {
+			t.Errorf("%s: expected %s to be logged in, got %s", identifier, testUsername, username)
+		}
+	}
+}
+
+func TestResetPasswordLogsOutEverywhere(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	// Register and log in a user.
+	rr := httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+	if !uh.s.UserLoggedIn(req) {
+		t.Fatal("expected user to be logged in")
+	}
+
+	// Resetting the user's password logs them out of their session.
+	token, err := uh.a.CreateResetToken(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uh.a.ResetPassword(token, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if uh.s.UserLoggedIn(req) {
+		t.Error("expected user to be logged out after a password reset")
+	}
+}
+
+func TestUserLoginDisabled(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	rr := httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+
+	u, err := uh.r.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uh.r.SetStatus(u.Id, user.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected code to be 403, got %d", rr.Code)
+	}
+	if uh.s.UserLoggedIn(req) {
+		t.Error("expected disabled user not to be logged in")
+	}
+}
+
+func TestRegisterUserResponse(t *testing.T) {
+	uh := setup()
+	WithUsersPath("/api/users/")(uh)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	rr := httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected content type to be application/json, got %s", ct)
+	}
+	if strings.Contains(rr.Body.String(), "password") {
+		t.Errorf("expected response not to contain a password, got %s", rr.Body)
+	}
+
+	var resp struct {
+		Id       int64  `json:"id"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := uh.r.GetByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != u.Id || resp.Email != testEmail || resp.Username != testUsername {
+		t.Errorf("expected user %d (%s, %s), got %+v", u.Id, testEmail, testUsername, resp)
+	}
+	if loc, want := rr.Header().Get("Location"), fmt.Sprintf("/api/users/%d", u.Id); loc != want {
+		t.Errorf("expected location to be %s, got %s", want, loc)
+	}
+}
+
+func TestUserLoginRecordsLogin(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	rr := httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+
+	var last time.Time
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+		uh.UserLogin(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected code to be 200, got %d", rr.Code)
+		}
+
+		u, err := uh.r.GetByEmail(testEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.LastLoginAt == nil || u.LastLoginAt.Before(last) {
+			t.Fatalf("expected last login to advance past %v, got %v", last, u.LastLoginAt)
+		}
+		last = *u.LastLoginAt
+	}
+}
+
+func TestValidationErrorJSON(t *testing.T) {
+	uh := setup()
+
+	testCases := []struct {
+		body  map[string]string
+		field string
+		err   error
+	}{
+		{map[string]string{"username": testUsername, "password": testPassword}, "email", auth.ErrEmptyRequiredField},
+		{map[string]string{"email": "invalid", "username": testUsername, "password": testPassword}, "email", auth.ErrInvalidEmail},
+		{map[string]string{"email": testEmail, "username": "r b", "password": testPassword}, "username", auth.ErrInvalidUsername},
+		{map[string]string{"email": testEmail, "username": testUsername, "password": "short"}, "password", auth.ErrPasswordTooShort},
+	}
+	for _, tc := range testCases {
+		b, err := json.Marshal(tc.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		uh.RegisterUser(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expected code to be 400, got %d", tc.body, rr.Code)
+		}
+		var resp struct {
+			Field string `json:"field"`
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Field != tc.field || resp.Error != tc.err.Error() {
+			t.Errorf("%v: expected %s: %v, got %s: %s", tc.body, tc.field, tc.err, resp.Field, resp.Error)
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	uh := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Form = url.Values{
+		"email":    {testEmail},
+		"username": {testUsername},
+		"password": {testPassword},
+	}
+
+	// Changing the password requires a logged in user.
+	rr := httptest.NewRecorder()
+	uh.ChangePassword(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected code to be 404, got %d", rr.Code)
+	}
+
+	// Register and log in a user.
+	rr = httptest.NewRecorder()
+	uh.RegisterUser(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected code to be 201, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	uh.UserLogin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected code to be 200, got %d", rr.Code)
+	}
+
+	testCases := []struct {
+		oldPassword, newPassword string
+		code                     int
+	}{
+		{"wrongpassword", "newpassword", http.StatusUnauthorized},
+		{testPassword, "short", http.StatusBadRequest},
+		{testPassword, "newpassword", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		req.Form.Set("old_password", tc.oldPassword)
+		req.Form.Set("new_password", tc.newPassword)
+
+		rr = httptest.NewRecorder()
+		uh.ChangePassword(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%q to %q: expected code to be %d, got %d",
+				tc.oldPassword, tc.newPassword, tc.code, rr.Code)
+		}
+	}
+
+	if _, err := uh.a.AuthenticateUser(testEmail, "newpassword"); err != nil {
+		t.Errorf("expected user to authenticate with new password, got %v", err)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	uh := setup()
+
+	for _, accept := range []string{"", "text/html, application/json;q=0.9"} {
+		req, err := http.NewRequest("POST", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Form = url.Values{
+			"old_password": {testPassword},
+			"new_password": {"newpassword"},
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		// No user is logged in.
+		rr := httptest.NewRecorder()
+		uh.ChangePassword(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("%q: expected code to be 404, got %d", accept, rr.Code)
+		}
+
+		if accept == "" {
+			if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("expected content type to be text/plain, got %s", ct)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != session.ErrUserNotSet.Error() {
+				t.Errorf("expected body to be %q, got %q", session.ErrUserNotSet, body)
+			}
+			continue
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected content type to be application/json, got %s", ct)
+		}
+		var resp struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != session.ErrUserNotSet.Error() || resp.Code != http.StatusNotFound {
+			t.Errorf("expected %q with code 404, got %q with code %d",
+				session.ErrUserNotSet, resp.Error, resp.Code)
+		}
+	}
+}
+
+func TestCheckAvailability(t *testing.T) {
+	uh := setup()
+
+	u := &user.User{Email: testEmail, Username: testUsername, Password: testPassword}
+	if err := uh.a.CreateUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"username=" + testUsername, http.StatusOK, `{"username_available":false}`},
+		{"username=someoneelse", http.StatusOK, `{"username_available":true}`},
+		{"email=" + url.QueryEscape(" RadovskyB@gmail.com"), http.StatusOK, `{"email_available":false}`},
+		{"email=someoneelse%40gmail.com", http.StatusOK, `{"email_available":true}`},
+		{"username=someoneelse&email=" + testEmail, http.StatusOK,
+			`{"username_available":true,"email_available":false}`},
+		{"", http.StatusBadRequest, auth.ErrEmptyRequiredField.Error()},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", server.URL+"?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		uh.CheckAvailability(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%q: expected code to be %d, got %d", tc.query, tc.code, rr.Code)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); body != tc.body {
+			t.Errorf("%q: expected body to be %s, got %s", tc.query, tc.body, body)
+		}
+	}
+
+	// Availability isn't revealed when registration is disabled.
+	WithRegistration(false)(uh)
+	req, err := http.NewRequest("GET", server.URL+"?username="+testUsername, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	uh.CheckAvailability(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected code to be 403, got %d", rr.Code)
+	}
+}
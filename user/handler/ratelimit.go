@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how often something identified by a key can happen.
+type RateLimiter interface {
+	// Allow reports whether something can happen for key now, using up
+	// some of its limit if so. If it can't, Allow also returns how long
+	// until it can.
+	Allow(key string) (bool, time.Duration)
+}
+
+// tokenBucket is a RateLimiter that gives each key a bucket of tokens,
+// which is refilled at a constant rate.
+type tokenBucket struct {
+	capacity float64
+	interval time.Duration // How long it takes to refill one token.
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last refilled.
+}
+
+// NewTokenBucket returns a RateLimiter that allows bursts of up to
+// capacity for each key, and then one more for each interval that
+// passes.
+func NewTokenBucket(capacity int, interval time.Duration) RateLimiter {
+	return &tokenBucket{
+		capacity: float64(capacity),
+		interval: interval,
+		now:      time.Now,
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+func (tb *tokenBucket) Allow(key string) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.now()
+	tb.sweep(now)
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &bucket{tokens: tb.capacity, last: now}
+		tb.buckets[key] = b
+	}
+	b.tokens = tb.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) * float64(tb.interval)))
+	return false, wait
+}
+
+// refill returns the number of tokens in b at now.
+func (tb *tokenBucket) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.last))/float64(tb.interval)
+	return math.Min(tokens, tb.capacity)
+}
+
+// sweep removes full buckets, which are the same as having no bucket,
+// at most once every time it takes to refill an empty bucket.
+func (tb *tokenBucket) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < time.Duration(tb.capacity)*tb.interval {
+		return
+	}
+	tb.lastSweep = now
+	for key, b := range tb.buckets {
+		if tb.refill(b, now) >= tb.capacity {
+			delete(tb.buckets, key)
+		}
+	}
+}
@@ -1,82 +1,686 @@
 package session
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
 	"errors"
 	"net/http"
+	"time"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/radovskyb/services/user"
 )
 
 var (
-	ErrUserNotSet      = errors.New("user is not set for user_session")
+	ErrUserNotSet      = errors.New("user is not set for the session")
 	ErrUserNotLoggedIn = errors.New("user is not logged in")
+	ErrInvalidCSRF     = errors.New("csrf token is missing or invalid")
+	ErrInvalidValue    = errors.New("session value has the wrong type")
 )
 
+// valueKey is the type of the keys that values are stored under in
+// sessions. Other code sharing the cookie store can't collide with them,
+// since its keys have different types.
+type valueKey string
+
+const (
+	loggedInKey        valueKey = "loggedin"
+	userIdKey          valueKey = "user_id"
+	sessionVersionKey  valueKey = "session_version"
+	usernameKey        valueKey = "username"
+	roleKey            valueKey = "role"
+	lastActiveKey      valueKey = "last_active"
+	rememberKey        valueKey = "remember"
+	tenantIdKey        valueKey = "tenant_id"
+	passwordExpiredKey valueKey = "password_expired"
+	csrfTokenKey       valueKey = "csrf_token"
+	totpUserIdKey      valueKey = "totp_user_id"
+	totpNonceKey       valueKey = "totp_nonce"
+	totpRememberKey    valueKey = "totp_remember"
+	totpStartedKey     valueKey = "totp_started"
+)
+
+func init() {
+	// Session values are gob encoded into cookies, which requires the
+	// types of interface values, such as keys, to be registered.
+	gob.Register(valueKey(""))
+}
+
 type Session interface {
-	// LogInUser sets a user to logged in and stores their username
-	// in the user's session.
-	LogInUser(w http.ResponseWriter, r *http.Request, username string) error
+	// LogInUser sets a user to logged in and stores their id, username,
+	// role and tenant as the active tenant in the user's session.
+	LogInUser(w http.ResponseWriter, r *http.Request, u *user.User) error
+
+	// LogInUserWithOptions is like LogInUser, except that the session
+	// cookie's lifetime is set by opts for as long as the user is
+	// logged in.
+	LogInUserWithOptions(w http.ResponseWriter, r *http.Request, u *user.User,
+		opts LogInOptions) error
 
 	// LogOutUser removes the current logged in user from the user's session.
 	LogOutUser(w http.ResponseWriter, r *http.Request) error
 
 	// UserLoggedIn checks if any user is currently logged in.
+	//
+	// If an idle timeout is set, a session that hasn't been active
+	// for longer than the timeout is treated as logged out, as is a
+	// session that's been invalidated when session versions are checked.
 	UserLoggedIn(r *http.Request) bool
 
 	// CurrentUser returns the current logged in user's username.
+	//
+	// If the session has been idle for longer than the idle timeout,
+	// ErrUserNotSet is returned. If the stored username isn't a string,
+	// ErrInvalidValue is returned.
 	CurrentUser(r *http.Request) (string, error)
+
+	// CurrentUserId returns the current logged in user's id. Unlike
+	// their username, it doesn't change, so it should be used to look
+	// up the logged in user.
+	//
+	// If the session has been idle for longer than the idle timeout,
+	// ErrUserNotSet is returned.
+	CurrentUserId(r *http.Request) (int64, error)
+
+	// CurrentRole returns the current logged in user's role.
+	//
+	// If the session has been idle for longer than the idle timeout,
+	// ErrUserNotSet is returned. If the stored role isn't a string,
+	// ErrInvalidValue is returned.
+	CurrentRole(r *http.Request) (string, error)
+
+	// Touch marks the logged in user's session as active now, so
+	// it doesn't idle out. Reading the session, such as with
+	// UserLoggedIn or CurrentUser, doesn't, so apps can choose which
+	// requests count as activity, such as only sensitive actions.
+	Touch(w http.ResponseWriter, r *http.Request) error
+
+	// RefreshUser updates the username, role and session version stored
+	// in the logged in user's session from u, such as after they've been
+	// renamed or changed their password, so that the session stays
+	// current and valid. If u isn't the logged in user,
+	// ErrUserNotLoggedIn is returned.
+	RefreshUser(w http.ResponseWriter, r *http.Request, u *user.User) error
+
+	// SetActiveTenant sets the tenant that the logged in user is
+	// currently using.
+	SetActiveTenant(w http.ResponseWriter, r *http.Request, tenantId string) error
+
+	// ActiveTenant returns the tenant that the logged in user is currently
+	// using, which is the default (blank) tenant unless one has been set.
+	ActiveTenant(r *http.Request) (string, error)
+
+	// SetPasswordExpired sets whether the logged in user's password has
+	// expired and must be changed.
+	SetPasswordExpired(w http.ResponseWriter, r *http.Request, expired bool) error
+
+	// PasswordExpired checks whether the logged in user's password has
+	// expired and must be changed.
+	PasswordExpired(r *http.Request) bool
+
+	// CSRFToken returns the CSRF token for the user's session, generating
+	// and storing a new one if the session doesn't have one yet.
+	CSRFToken(w http.ResponseWriter, r *http.Request) (string, error)
+
+	// VerifyCSRF checks that token is the CSRF token for the user's
+	// session. If the session doesn't have a CSRF token or token doesn't
+	// match it, ErrInvalidCSRF is returned.
+	VerifyCSRF(r *http.Request, token string) error
+
+	// AddFlash adds a one-time message to the user's session, such as to
+	// show after a redirect.
+	AddFlash(w http.ResponseWriter, r *http.Request, message string) error
+
+	// Flashes returns the messages added with AddFlash and removes them
+	// from the user's session, so they're only returned once.
+	Flashes(w http.ResponseWriter, r *http.Request) ([]string, error)
+
+	// StartTOTPLogin stores login for a user whose password has been
+	// checked but who still has to enter a one-time password, for up to
+	// five minutes. The user isn't logged in until LogInUser is called.
+	StartTOTPLogin(w http.ResponseWriter, r *http.Request, login TOTPLogin) error
+
+	// PendingTOTPLogin returns the login stored by StartTOTPLogin. If
+	// there isn't one or it has expired, ErrUserNotSet is returned.
+	PendingTOTPLogin(r *http.Request) (TOTPLogin, error)
+
+	// EndTOTPLogin removes the login stored by StartTOTPLogin. Logging in
+	// or out also removes it.
+	EndTOTPLogin(w http.ResponseWriter, r *http.Request) error
+}
+
+// LogInOptions configures how a user is logged in by LogInUserWithOptions.
+type LogInOptions struct {
+	// Remember keeps the user logged in for the remember max age.
+	// Otherwise the session cookie only lasts until the user's browser
+	// is closed.
+	Remember bool
 }
 
+// TOTPLogin is a login that's waiting for the user to enter a one-time
+// password, stored by StartTOTPLogin.
+type TOTPLogin struct {
+	UserId int64
+
+	// Nonce identifies the pending login on the server, such as a nonce
+	// from auth's StartTOTPLogin. The session can't stop its cookie being
+	// replayed, so the server has to limit the codes entered for a login.
+	Nonce string
+
+	// Remember is the LogInOptions.Remember to log the user in with.
+	Remember bool
+}
+
+const (
+	// defaultName is the default session and cookie name.
+	defaultName = "user_session"
+
+	// defaultMaxAge is the default session cookie max age, in seconds.
+	defaultMaxAge = 7 * 24 * 60 * 60
+
+	// totpLoginTTL is how long a user has to enter a one-time password
+	// after StartTOTPLogin.
+	totpLoginTTL = 5 * time.Minute
+
+	// defaultRememberMaxAge is the default max age of session cookies
+	// for remembered users, in seconds.
+	defaultRememberMaxAge = 30 * 24 * 60 * 60
+)
+
 // session is the default implementation for Session.
 type session struct {
 	cookiestore *sessions.CookieStore
+
+	name string // Session and cookie name.
+
+	maxAge         int  // Session cookie max age, in seconds.
+	rememberMaxAge int  // Remembered session cookie max age, in seconds.
+	secure         bool // Whether session cookies are only sent over HTTPS.
+
+	// idleTimeout is how long a session can be inactive before it's
+	// treated as logged out, or 0 if sessions don't idle out.
+	idleTimeout time.Duration
+
+	// sessionVersion returns the current session version of the user
+	// with the specified id. Sessions aren't checked when it's nil.
+	sessionVersion func(userId int64) (int64, error)
+
+	now func() time.Time
 }
 
-func NewSession(store *sessions.CookieStore) Session {
-	return &session{store}
+// Option configures a Session created with NewSession.
+type Option func(*session)
+
+// WithName sets the name of sessions and their cookies, so that apps
+// sharing a domain don't clash. The default is "user_session".
+func WithName(name string) Option {
+	return func(s *session) {
+		s.name = name
+	}
+}
+
+// WithMaxAge sets the max age of session cookies, in seconds. The
+// default is 7 days.
+func WithMaxAge(maxAge int) Option {
+	return func(s *session) {
+		s.maxAge = maxAge
+	}
+}
+
+// WithRememberMaxAge sets the max age of session cookies for users that
+// are logged in with LogInOptions.Remember, in seconds. The default is
+// 30 days.
+func WithRememberMaxAge(maxAge int) Option {
+	return func(s *session) {
+		s.rememberMaxAge = maxAge
+	}
+}
+
+// WithSecure sets whether session cookies are only sent over HTTPS.
+// They are by default, which can be disabled for plain HTTP during
+// development.
+func WithSecure(secure bool) Option {
+	return func(s *session) {
+		s.secure = secure
+	}
+}
+
+// WithIdleTimeout treats sessions that haven't been active for longer
+// than timeout as logged out. Sessions are active when users log in or
+// Touch is called. Sessions don't idle out by default.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *session) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithSessionVersions checks the session version stored in logged in
+// users' sessions against their current session version, which is
+// returned by current, such as by looking up user.User.SessionVersion.
+// Sessions with an older version are treated as logged out, which lets
+// all of a user's sessions be invalidated by incrementing their version.
+// current should return ErrUserNotSet if the user no longer exists, which
+// also logs them out; any other error is returned by the Session's
+// methods. current is called whenever a session is read. Session
+// versions aren't checked by default.
+func WithSessionVersions(current func(userId int64) (int64, error)) Option {
+	return func(s *session) {
+		s.sessionVersion = current
+	}
+}
+
+// NewSession creates a new Session that stores sessions in a copy of
+// store, so store itself is left unchanged for any other code using it.
+//
+// The copy's cookies are configured to be HttpOnly and SameSite=Lax, with
+// the max age and secure attributes set by opts.
+func NewSession(store *sessions.CookieStore, opts ...Option) Session {
+	s := &session{
+		name:           defaultName,
+		maxAge:         defaultMaxAge,
+		rememberMaxAge: defaultRememberMaxAge,
+		secure:         true,
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// The codecs' max age must be long enough to decode remembered
+	// sessions' cookies.
+	codecMaxAge := s.maxAge
+	if s.rememberMaxAge > codecMaxAge {
+		codecMaxAge = s.rememberMaxAge
+	}
+	s.cookiestore = copyStore(store, codecMaxAge)
+	s.cookiestore.Options.HttpOnly = true
+	s.cookiestore.Options.Secure = s.secure
+	s.cookiestore.Options.SameSite = http.SameSiteLaxMode
+	s.cookiestore.Options.MaxAge = s.maxAge
+	return s
+}
+
+// copyStore returns a copy of store with its own options and codecs,
+// whose max age is set to codecMaxAge.
+func copyStore(store *sessions.CookieStore, codecMaxAge int) *sessions.CookieStore {
+	cs := *store
+	opts := sessions.Options{}
+	if store.Options != nil {
+		opts = *store.Options
+	}
+	cs.Options = &opts
+	cs.Codecs = make([]securecookie.Codec, len(store.Codecs))
+	for i, codec := range store.Codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			sc := *c
+			sc.MaxAge(codecMaxAge)
+			codec = &sc
+		}
+		cs.Codecs[i] = codec
+	}
+	return &cs
 }
 
 func (s *session) LogInUser(w http.ResponseWriter, r *http.Request,
-	username string) error {
-	sess, err := s.cookiestore.Get(r, "user_session")
+	u *user.User) error {
+	return s.logInUser(w, r, u, nil)
+}
+
+func (s *session) LogInUserWithOptions(w http.ResponseWriter, r *http.Request,
+	u *user.User, opts LogInOptions) error {
+	return s.logInUser(w, r, u, &opts)
+}
+
+// logInUser logs u in. If opts isn't nil, it sets the session cookie's
+// lifetime, which is otherwise the default max age.
+func (s *session) logInUser(w http.ResponseWriter, r *http.Request,
+	u *user.User, opts *LogInOptions) error {
+	sess, err := s.cookiestore.Get(r, s.name)
 	if err != nil {
 		return err
 	}
-	sess.Values["loggedin"] = true
-	sess.Values["username"] = username
+	sess.Values[loggedInKey] = true
+	sess.Values[userIdKey] = u.Id
+	sess.Values[sessionVersionKey] = u.SessionVersion
+	sess.Values[usernameKey] = u.Username
+	sess.Values[roleKey] = u.Role
+	sess.Values[lastActiveKey] = s.now().UnixNano()
+	// Don't keep the active tenant of a previously logged in user.
+	if u.TenantId != "" {
+		sess.Values[tenantIdKey] = u.TenantId
+	} else {
+		delete(sess.Values, tenantIdKey)
+	}
+	deleteTOTPLogin(sess)
+	if opts != nil {
+		sess.Values[rememberKey] = opts.Remember
+	} else {
+		delete(sess.Values, rememberKey)
+	}
+	return s.save(w, r, sess)
+}
+
+// save saves sess, keeping the cookie lifetime that was chosen with
+// LogInUserWithOptions, if any.
+func (s *session) save(w http.ResponseWriter, r *http.Request,
+	sess *sessions.Session) error {
+	remember, ok := sess.Values[rememberKey].(bool)
+	switch {
+	case !ok:
+		sess.Options.MaxAge = s.maxAge
+	case remember:
+		sess.Options.MaxAge = s.rememberMaxAge
+	default:
+		sess.Options.MaxAge = 0
+	}
 	return sess.Save(r, w)
 }
 
+// expired checks whether sess has idled out or been invalidated.
+func (s *session) expired(sess *sessions.Session) (bool, error) {
+	if s.idle(sess) {
+		return true, nil
+	}
+	return s.invalidated(sess)
+}
+
+// invalidated checks whether sess's session version is older than its
+// user's current session version.
+func (s *session) invalidated(sess *sessions.Session) (bool, error) {
+	if s.sessionVersion == nil {
+		return false, nil
+	}
+	id, ok := sess.Values[userIdKey].(int64)
+	if !ok {
+		return true, nil
+	}
+	version, _ := sess.Values[sessionVersionKey].(int64)
+	current, err := s.sessionVersion(id)
+	if errors.Is(err, ErrUserNotSet) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return version < current, nil
+}
+
+// idle checks whether sess has been inactive for longer than the
+// idle timeout.
+func (s *session) idle(sess *sessions.Session) bool {
+	if s.idleTimeout <= 0 {
+		return false
+	}
+	lastActive, ok := sess.Values[lastActiveKey].(int64)
+	if !ok {
+		return true
+	}
+	return s.now().Sub(time.Unix(0, lastActive)) > s.idleTimeout
+}
+
+func (s *session) Touch(w http.ResponseWriter, r *http.Request) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	if sess.Values[loggedInKey] != true {
+		return ErrUserNotLoggedIn
+	}
+	if expired, err := s.expired(sess); err != nil {
+		return err
+	} else if expired {
+		return ErrUserNotLoggedIn
+	}
+	sess.Values[lastActiveKey] = s.now().UnixNano()
+	return s.save(w, r, sess)
+}
+
+func (s *session) RefreshUser(w http.ResponseWriter, r *http.Request, u *user.User) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	// The session isn't checked for expiry, since an older session
+	// version is what's being refreshed.
+	if id, _ := sess.Values[userIdKey].(int64); sess.Values[loggedInKey] != true || id != u.Id {
+		return ErrUserNotLoggedIn
+	}
+	sess.Values[sessionVersionKey] = u.SessionVersion
+	sess.Values[usernameKey] = u.Username
+	sess.Values[roleKey] = u.Role
+	return s.save(w, r, sess)
+}
+
 func (s *session) LogOutUser(w http.ResponseWriter, r *http.Request) error {
-	sess, err := s.cookiestore.Get(r, "user_session")
+	sess, err := s.cookiestore.Get(r, s.name)
 	if err != nil {
 		return err
 	}
-	if sess.Values["loggedin"] != true {
+	if sess.Values[loggedInKey] != true {
 		return ErrUserNotLoggedIn
 	}
 	for key := range sess.Values {
 		delete(sess.Values, key)
 	}
-	return sess.Save(r, w)
+	return s.save(w, r, sess)
 }
 
 func (s *session) UserLoggedIn(r *http.Request) bool {
-	sess, err := s.cookiestore.Get(r, "user_session")
-	if err == nil && (sess.Values["loggedin"] == true) {
-		return true
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil || sess.Values[loggedInKey] != true {
+		return false
 	}
-	return false
+	expired, err := s.expired(sess)
+	return err == nil && !expired
 }
 
 func (s *session) CurrentUser(r *http.Request) (string, error) {
-	sess, err := s.cookiestore.Get(r, "user_session")
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return "", err
+	}
+	username, ok := sess.Values[usernameKey]
+	if !ok {
+		return "", ErrUserNotSet
+	}
+	if expired, err := s.expired(sess); err != nil {
+		return "", err
+	} else if expired {
+		return "", ErrUserNotSet
+	}
+	name, ok := username.(string)
+	if !ok {
+		return "", ErrInvalidValue
+	}
+	return name, nil
+}
+
+func (s *session) CurrentUserId(r *http.Request) (int64, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := sess.Values[userIdKey].(int64)
+	if !ok {
+		return 0, ErrUserNotSet
+	}
+	if expired, err := s.expired(sess); err != nil {
+		return 0, err
+	} else if expired {
+		return 0, ErrUserNotSet
+	}
+	return id, nil
+}
+
+func (s *session) CurrentRole(r *http.Request) (string, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
 	if err != nil {
 		return "", err
 	}
-	username, ok := sess.Values["username"]
+	role, ok := sess.Values[roleKey]
 	if !ok {
 		return "", ErrUserNotSet
 	}
-	return username.(string), nil
+	if expired, err := s.expired(sess); err != nil {
+		return "", err
+	} else if expired {
+		return "", ErrUserNotSet
+	}
+	name, ok := role.(string)
+	if !ok {
+		return "", ErrInvalidValue
+	}
+	return name, nil
+}
+
+func (s *session) SetActiveTenant(w http.ResponseWriter, r *http.Request,
+	tenantId string) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	if sess.Values[loggedInKey] != true {
+		return ErrUserNotLoggedIn
+	}
+	sess.Values[tenantIdKey] = tenantId
+	return s.save(w, r, sess)
+}
+
+func (s *session) ActiveTenant(r *http.Request) (string, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return "", err
+	}
+	tenantId, _ := sess.Values[tenantIdKey].(string)
+	return tenantId, nil
+}
+
+func (s *session) SetPasswordExpired(w http.ResponseWriter, r *http.Request,
+	expired bool) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	if sess.Values[loggedInKey] != true {
+		return ErrUserNotLoggedIn
+	}
+	sess.Values[passwordExpiredKey] = expired
+	return s.save(w, r, sess)
+}
+
+func (s *session) PasswordExpired(r *http.Request) bool {
+	sess, err := s.cookiestore.Get(r, s.name)
+	return err == nil && sess.Values[passwordExpiredKey] == true
+}
+
+func (s *session) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return "", err
+	}
+	if token, ok := sess.Values[csrfTokenKey].(string); ok && token != "" {
+		return token, nil
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	sess.Values[csrfTokenKey] = token
+	return token, s.save(w, r, sess)
+}
+
+func (s *session) VerifyCSRF(r *http.Request, token string) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	want, _ := sess.Values[csrfTokenKey].(string)
+	if want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return ErrInvalidCSRF
+	}
+	return nil
+}
+
+func (s *session) AddFlash(w http.ResponseWriter, r *http.Request,
+	message string) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	sess.AddFlash(message)
+	return s.save(w, r, sess)
+}
+
+func (s *session) Flashes(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return nil, err
+	}
+	flashes := sess.Flashes()
+	if len(flashes) == 0 {
+		return nil, nil
+	}
+	messages := make([]string, 0, len(flashes))
+	for _, flash := range flashes {
+		if message, ok := flash.(string); ok {
+			messages = append(messages, message)
+		}
+	}
+	return messages, s.save(w, r, sess)
+}
+
+func (s *session) StartTOTPLogin(w http.ResponseWriter, r *http.Request,
+	login TOTPLogin) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	sess.Values[totpUserIdKey] = login.UserId
+	sess.Values[totpNonceKey] = login.Nonce
+	sess.Values[totpRememberKey] = login.Remember
+	sess.Values[totpStartedKey] = s.now().UnixNano()
+	return s.save(w, r, sess)
+}
+
+func (s *session) PendingTOTPLogin(r *http.Request) (TOTPLogin, error) {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return TOTPLogin{}, err
+	}
+	id, ok := sess.Values[totpUserIdKey].(int64)
+	started, _ := sess.Values[totpStartedKey].(int64)
+	if !ok || s.now().Sub(time.Unix(0, started)) > totpLoginTTL {
+		return TOTPLogin{}, ErrUserNotSet
+	}
+	nonce, _ := sess.Values[totpNonceKey].(string)
+	remember, _ := sess.Values[totpRememberKey].(bool)
+	return TOTPLogin{UserId: id, Nonce: nonce, Remember: remember}, nil
+}
+
+func (s *session) EndTOTPLogin(w http.ResponseWriter, r *http.Request) error {
+	sess, err := s.cookiestore.Get(r, s.name)
+	if err != nil {
+		return err
+	}
+	deleteTOTPLogin(sess)
+	return s.save(w, r, sess)
+}
+
+// deleteTOTPLogin removes the login stored by StartTOTPLogin from sess.
+func deleteTOTPLogin(sess *sessions.Session) {
+	delete(sess.Values, totpUserIdKey)
+	delete(sess.Values, totpNonceKey)
+	delete(sess.Values, totpRememberKey)
+	delete(sess.Values, totpStartedKey)
+}
+
+// generateToken generates a random, url safe base64 encoded token.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
 }
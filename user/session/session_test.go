@@ -1,12 +1,16 @@
 package session
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"github.com/radovskyb/services/user"
 )
 
 var server *httptest.Server
@@ -55,7 +59,7 @@ func TestLogInUser(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Log in the user.
-	err = sess.LogInUser(rr, req, testUsername)
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
 	if err != nil {
 		t.Error(err)
 	}
@@ -83,7 +87,7 @@ func TestLogOutUser(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Log in the user.
-	err = sess.LogInUser(rr, req, testUsername)
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
 	if err != nil {
 		t.Error(err)
 	}
@@ -141,7 +145,7 @@ func TestUserLoggedIn(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Log in the user.
-	err = sess.LogInUser(rr, req, testUsername)
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
 	if err != nil {
 		t.Error(err)
 	}
@@ -152,3 +156,692 @@ func TestUserLoggedIn(t *testing.T) {
 		t.Error("expected user to be logged in")
 	}
 }
+
+func TestCSRFToken(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	// Get a new CSRF token for the session.
+	token, err := sess.CSRFToken(rr, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if token == "" {
+		t.Fatal("expected token to not be blank")
+	}
+
+	// The same token should be returned for the same session.
+	token2, err := sess.CSRFToken(rr, req)
+	if err != nil {
+		t.Error(err)
+	}
+	if token2 != token {
+		t.Errorf("expected token to be %s, got %s", token, token2)
+	}
+
+	// A different session should get a different token.
+	req2, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	token3, err := sess.CSRFToken(httptest.NewRecorder(), req2)
+	if err != nil {
+		t.Error(err)
+	}
+	if token3 == token {
+		t.Error("expected tokens for different sessions to be different")
+	}
+}
+
+func TestActiveTenant(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	// Try to set the active tenant when no user is logged in.
+	err = sess.SetActiveTenant(rr, req, "acme")
+	if err != ErrUserNotLoggedIn {
+		t.Errorf("expected err to be ErrUserNotLoggedIn, got %v", err)
+	}
+
+	// Log in the user.
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The active tenant should be the default tenant.
+	tenantId, err := sess.ActiveTenant(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId != "" {
+		t.Errorf("expected tenant to be blank, got %s", tenantId)
+	}
+
+	// Set the active tenant.
+	err = sess.SetActiveTenant(rr, req, "acme")
+	if err != nil {
+		t.Error(err)
+	}
+
+	tenantId, err = sess.ActiveTenant(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId != "acme" {
+		t.Errorf("expected tenant to be acme, got %s", tenantId)
+	}
+
+	// Logging in a user from the default tenant clears the stale tenant.
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId, _ = sess.ActiveTenant(req); tenantId != "" {
+		t.Errorf("expected tenant to be blank, got %s", tenantId)
+	}
+
+	// Logging in a tenant's user makes it the active tenant.
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername, TenantId: "other"})
+	if err != nil {
+		t.Error(err)
+	}
+	if tenantId, _ = sess.ActiveTenant(req); tenantId != "other" {
+		t.Errorf("expected tenant to be other, got %s", tenantId)
+	}
+}
+
+func TestCurrentRole(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := sess.CurrentRole(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{
+		Username: testUsername,
+		Role:     user.RoleAdmin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role, err := sess.CurrentRole(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if role != user.RoleAdmin {
+		t.Errorf("expected role to be %s, got %s", user.RoleAdmin, role)
+	}
+
+	// Logging out removes the role.
+	if err := sess.LogOutUser(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.CurrentRole(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+}
+
+func TestCurrentUserId(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := sess.CurrentUserId(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{Id: 7, Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := sess.CurrentUserId(req)
+	if err != nil {
+		t.Error(err)
+	}
+	if id != 7 {
+		t.Errorf("expected id to be 7, got %d", id)
+	}
+
+	// Logging out removes the id.
+	if err := sess.LogOutUser(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.CurrentUserId(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	testCases := []struct {
+		opts   []Option
+		maxAge string
+		secure bool
+	}{
+		{nil, "Max-Age=604800", true},
+		{[]Option{WithMaxAge(3600), WithSecure(false)}, "Max-Age=3600", false},
+	}
+	for _, tc := range testCases {
+		store := sessions.NewCookieStore([]byte("secret-session"))
+		sess := NewSession(store, tc.opts...)
+
+		// The store that was passed in is left unchanged.
+		want := sessions.NewCookieStore([]byte("secret-session")).Options
+		if *store.Options != *want {
+			t.Errorf("expected store's options to be %+v, got %+v", want, store.Options)
+		}
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cookie := rr.Header().Get("Set-Cookie")
+		for _, attr := range []string{"HttpOnly", tc.maxAge, "SameSite=Lax"} {
+			if !strings.Contains(cookie, attr) {
+				t.Errorf("expected cookie to contain %s, got %s", attr, cookie)
+			}
+		}
+		if strings.Contains(cookie, "Secure") != tc.secure {
+			t.Errorf("expected cookie secure to be %t, got %s", tc.secure, cookie)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sess := NewSession(
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithIdleTimeout(30*time.Minute),
+	)
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess.(*session).now = func() time.Time { return now }
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	// Touching a session without a logged in user fails.
+	if err := sess.Touch(rr, req); err != ErrUserNotLoggedIn {
+		t.Errorf("expected err to be ErrUserNotLoggedIn, got %v", err)
+	}
+
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Activity keeps the session alive past the timeout.
+	now = now.Add(20 * time.Minute)
+	if err := sess.Touch(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(20 * time.Minute)
+
+	if !sess.UserLoggedIn(req) {
+		t.Error("expected user to be logged in")
+	}
+	if _, err := sess.CurrentUser(req); err != nil {
+		t.Errorf("expected current user, got %v", err)
+	}
+
+	// An idle session is logged out.
+	now = now.Add(31 * time.Minute)
+
+	if sess.UserLoggedIn(req) {
+		t.Error("expected idle user to be logged out")
+	}
+	if _, err := sess.CurrentUser(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+	if _, err := sess.CurrentRole(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+	if err := sess.Touch(rr, req); err != ErrUserNotLoggedIn {
+		t.Errorf("expected err to be ErrUserNotLoggedIn, got %v", err)
+	}
+
+	// Logging in again refreshes the session.
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.UserLoggedIn(req) {
+		t.Error("expected user to be logged in")
+	}
+}
+
+func TestReadsDontPreventIdleTimeout(t *testing.T) {
+	sess := NewSession(
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithIdleTimeout(30*time.Minute),
+	)
+
+	// Use a fake clock.
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	sess.(*session).now = func() time.Time { return now }
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frequent reads don't count as activity.
+	for i := 0; i < 4; i++ {
+		now = now.Add(10 * time.Minute)
+		sess.UserLoggedIn(req)
+		sess.CurrentUser(req)
+	}
+	if sess.UserLoggedIn(req) {
+		t.Error("expected idle user to be logged out")
+	}
+
+	// Touching the session on a sensitive action does.
+	err = sess.LogInUser(rr, req, &user.User{Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		now = now.Add(10 * time.Minute)
+		sess.UserLoggedIn(req)
+		if i == 1 {
+			if err := sess.Touch(rr, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !sess.UserLoggedIn(req) {
+		t.Error("expected user to be logged in")
+	}
+}
+
+func TestLogInUserWithOptions(t *testing.T) {
+	testCases := []struct {
+		remember bool
+		maxAge   string
+	}{
+		{true, "Max-Age=2592000"},
+		{false, ""},
+	}
+	for _, tc := range testCases {
+		sess := setup()
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		err = sess.LogInUserWithOptions(rr, req, &user.User{Username: testUsername},
+			LogInOptions{Remember: tc.remember})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The cookie's lifetime is kept when the session is saved again.
+		rr = httptest.NewRecorder()
+
+		if err := sess.SetActiveTenant(rr, req, "acme"); err != nil {
+			t.Fatal(err)
+		}
+
+		cookie := rr.Header().Get("Set-Cookie")
+		if tc.maxAge != "" && !strings.Contains(cookie, tc.maxAge) {
+			t.Errorf("expected cookie to contain %s, got %s", tc.maxAge, cookie)
+		}
+		if tc.maxAge == "" && strings.Contains(cookie, "Max-Age") {
+			t.Errorf("expected a browser session cookie, got %s", cookie)
+		}
+	}
+}
+
+func TestVerifyCSRF(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions without a token can't be verified, even with a blank one.
+	if err := sess.VerifyCSRF(req, ""); err != ErrInvalidCSRF {
+		t.Errorf("expected err to be ErrInvalidCSRF, got %v", err)
+	}
+
+	token, err := sess.CSRFToken(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		token string
+		err   error
+	}{
+		{token, nil},
+		{"", ErrInvalidCSRF},
+		{token + "x", ErrInvalidCSRF},
+		{strings.ToUpper(token), ErrInvalidCSRF},
+	}
+	for _, tc := range testCases {
+		if err := sess.VerifyCSRF(req, tc.token); err != tc.err {
+			t.Errorf("%q: expected err to be %v, got %v", tc.token, tc.err, err)
+		}
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	sess := setup()
+	now := time.Now()
+	sess.(*session).now = func() time.Time { return now }
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	if _, err := sess.PendingTOTPLogin(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+
+	want := TOTPLogin{UserId: 42, Nonce: "nonce", Remember: true}
+	if err := sess.StartTOTPLogin(rr, req, want); err != nil {
+		t.Fatal(err)
+	}
+	login, err := sess.PendingTOTPLogin(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != want {
+		t.Errorf("expected login to be %+v, got %+v", want, login)
+	}
+	if sess.UserLoggedIn(req) {
+		t.Error("expected user to not be logged in")
+	}
+
+	// Pending logins expire.
+	now = now.Add(totpLoginTTL + time.Second)
+	if _, err := sess.PendingTOTPLogin(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet after expiring, got %v", err)
+	}
+
+	// Ending and logging in both remove the pending login.
+	if err := sess.StartTOTPLogin(rr, req, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.EndTOTPLogin(rr, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.PendingTOTPLogin(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet after ending, got %v", err)
+	}
+	if err := sess.StartTOTPLogin(rr, req, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.LogInUser(rr, req, &user.User{Id: 42, Username: testUsername}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.PendingTOTPLogin(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet after logging in, got %v", err)
+	}
+}
+
+func TestWithName(t *testing.T) {
+	sess := NewSession(
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithName("app_session"),
+	)
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{Id: 1, Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	if cookies[0].Name != "app_session" {
+		t.Errorf("expected cookie name to be app_session, got %s", cookies[0].Name)
+	}
+
+	// The cookie is read back under the same name.
+	req2, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2.AddCookie(cookies[0])
+	if !sess.UserLoggedIn(req2) {
+		t.Error("expected user to be logged in")
+	}
+	if setup().UserLoggedIn(req2) {
+		t.Error("expected user not to be logged in with the default name")
+	}
+}
+
+func TestFlashes(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	for _, message := range []string{"password changed", "welcome back"} {
+		if err := sess.AddFlash(rr, req, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Follow the redirect with the latest session cookie, which every
+	// AddFlash sets.
+	req2, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rr.Result().Cookies()
+	req2.AddCookie(cookies[len(cookies)-1])
+	rr = httptest.NewRecorder()
+
+	flashes, err := sess.Flashes(rr, req2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flashes) != 2 || flashes[0] != "password changed" || flashes[1] != "welcome back" {
+		t.Errorf("expected both flashes in order, got %q", flashes)
+	}
+
+	// Flashes are only returned once.
+	flashes, err = sess.Flashes(rr, req2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flashes) != 0 {
+		t.Errorf("expected no flashes on the second read, got %q", flashes)
+	}
+}
+
+func TestSessionVersions(t *testing.T) {
+	versions := map[int64]int64{1: 2}
+	errStore := errors.New("store is down")
+	var storeErr error
+	sess := NewSession(
+		sessions.NewCookieStore([]byte("secret-session")),
+		WithSessionVersions(func(userId int64) (int64, error) {
+			if storeErr != nil {
+				return 0, storeErr
+			}
+			v, ok := versions[userId]
+			if !ok {
+				return 0, ErrUserNotSet
+			}
+			return v, nil
+		}),
+	)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	u := &user.User{Id: 1, Username: testUsername, SessionVersion: 2}
+	if err := sess.LogInUser(rr, req, u); err != nil {
+		t.Fatal(err)
+	}
+	if !sess.UserLoggedIn(req) {
+		t.Error("expected user to be logged in")
+	}
+
+	// Errors looking up the user's version are returned.
+	storeErr = errStore
+	if _, err := sess.CurrentUserId(req); err != errStore {
+		t.Errorf("expected err to be errStore, got %v", err)
+	}
+	if sess.UserLoggedIn(req) {
+		t.Error("expected user not to be logged in when the store is down")
+	}
+	storeErr = nil
+
+	// Bumping the user's version invalidates the session.
+	versions[1] = 3
+	if sess.UserLoggedIn(req) {
+		t.Error("expected invalidated user to be logged out")
+	}
+	if _, err := sess.CurrentUser(req); err != ErrUserNotSet {
+		t.Errorf("expected err to be ErrUserNotSet, got %v", err)
+	}
+
+	// Refreshing the session with the user's version makes it valid again.
+	u.SessionVersion = 3
+	u.Username = "renamed"
+	if err := sess.RefreshUser(rr, req, u); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := sess.CurrentUser(req); err != nil || cur != "renamed" {
+		t.Errorf("expected refreshed user to be logged in as renamed, got %q, %v", cur, err)
+	}
+	if err := sess.RefreshUser(rr, req, &user.User{Id: 2}); err != ErrUserNotLoggedIn {
+		t.Errorf("expected err to be ErrUserNotLoggedIn, got %v", err)
+	}
+
+	// So does the user no longer existing.
+	delete(versions, 1)
+	if sess.UserLoggedIn(req) {
+		t.Error("expected deleted user to be logged out")
+	}
+}
+
+func TestCurrentUserInvalidValue(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("secret-session"))
+	sess := NewSession(store)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{Id: 1, Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Get(req, defaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other code's values don't collide with the session's.
+	s.Values["username"] = "someone"
+	if username, err := sess.CurrentUser(req); err != nil || username != testUsername {
+		t.Errorf("expected username to be %s, got %q (%v)", testUsername, username, err)
+	}
+
+	// A value with the wrong type is an error rather than a panic.
+	s.Values[usernameKey] = 42
+	if _, err := sess.CurrentUser(req); err != ErrInvalidValue {
+		t.Errorf("expected err to be ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestSessionCookieRoundTrip(t *testing.T) {
+	sess := setup()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	err = sess.LogInUser(rr, req, &user.User{Id: 1, Username: testUsername})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the session back from its cookie, which requires its keys
+	// to be gob encodable.
+	req, err = http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if username, err := sess.CurrentUser(req); err != nil || username != testUsername {
+		t.Errorf("expected username to be %s, got %q (%v)", testUsername, username, err)
+	}
+}
@@ -1,9 +1,139 @@
 package user
 
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Roles that can be assigned to a user.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Statuses that a user's account can have.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
 // User defines a user.
 type User struct {
-	Id       int64
-	Email    string
-	Username string
-	Password string
+	Id       int64  `json:"id"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+
+	// TenantId is the tenant the user belongs to. Emails and usernames
+	// only need to be unique within a tenant. An empty TenantId is the
+	// default tenant, used by single tenant applications.
+	TenantId string `json:"tenantId"`
+
+	// FailedAttempts is the number of consecutive failed login attempts
+	// and LockedUntil is when the user's account stops being locked out,
+	// or nil if it has never been locked.
+	FailedAttempts int        `json:"failedAttempts"`
+	LockedUntil    *time.Time `json:"lockedUntil"`
+
+	// FirstFailedAt is when the first of FailedAttempts was made, so that
+	// attempts from before the lockout window aren't counted. It's only
+	// changed by the user repository's RecordFailedLogin and
+	// ResetFailedLogins.
+	FirstFailedAt *time.Time `json:"-"`
+
+	// EmailVerified is whether the user has confirmed they own Email.
+	EmailVerified bool `json:"emailVerified"`
+
+	// CanonicalEmail is an optional canonical form of Email, such as
+	// with plus addressing removed, which is unique per tenant so that
+	// different addresses for the same inbox can't be registered twice.
+	// An empty CanonicalEmail isn't checked for uniqueness.
+	CanonicalEmail string `json:"-"`
+
+	// Role is the user's role, such as RoleUser or RoleAdmin, which
+	// handlers can use to authorize requests.
+	Role string `json:"role"`
+
+	// Status is the status of the user's account, such as StatusActive
+	// or StatusDisabled. Disabled users can't log in.
+	Status string `json:"status"`
+
+	// PasswordChangedAt is when Password was last set, or nil if
+	// it isn't known.
+	PasswordChangedAt *time.Time `json:"passwordChangedAt"`
+
+	// LastLoginAt is when the user last logged in, or nil if they
+	// never have.
+	LastLoginAt *time.Time `json:"lastLoginAt"`
+
+	// CreatedAt is when the user was created and UpdatedAt is when they
+	// were last updated. They're set by the user repository.
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// TOTPSecret is the base32 encoded secret for the user's time-based
+	// one-time passwords, and TOTPEnabled is whether they must enter one
+	// to log in. The secret is set up before it's enabled, once the user
+	// has confirmed their authenticator app works.
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+
+	// TOTPCounter is the time step of the last one-time password the user
+	// entered, so that it can't be used again. It's only changed by the
+	// user repository's AdvanceTOTPCounter.
+	TOTPCounter int64 `json:"-"`
+
+	// SessionVersion is stored in the user's sessions when they log in.
+	// Incrementing it invalidates all of their existing sessions.
+	SessionVersion int64 `json:"-"`
+}
+
+// NormalizeEmail trims the whitespace around email and lowercases it, so
+// differently cased versions of the same email are treated as one.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// gmailDomains are the domains that ignore dots in an email's local part.
+var gmailDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+}
+
+// CanonicalizeEmail returns the canonical form of email, which is the
+// same for addresses that deliver to the same inbox. It normalizes email,
+// removes a trailing dot from the domain and any +tag from the local part
+// and, for gmail addresses, removes the dots from the local part.
+//
+// It's what CanonicalEmail is set to, and user repositories keep it up
+// to date when a user's email changes.
+func CanonicalizeEmail(email string) string {
+	email = NormalizeEmail(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], strings.TrimSuffix(email[at+1:], ".")
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if gmailDomains[domain] {
+		local = strings.Replace(local, ".", "", -1)
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+// MarshalJSON marshals u without its password, so that password hashes
+// are never exposed. A password is still unmarshaled, so it can be set
+// from JSON input such as registration requests.
+func (u User) MarshalJSON() ([]byte, error) {
+	// alias doesn't have User's methods, so marshaling it doesn't
+	// recurse into MarshalJSON.
+	type alias User
+	return json.Marshal(struct {
+		alias
+		Password string `json:"password,omitempty"`
+	}{alias: alias(u)})
 }
@@ -0,0 +1,62 @@
+package user
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSONOmitsPassword(t *testing.T) {
+	u := &User{
+		Id:       1,
+		Email:    "radovskyb@gmail.com",
+		Username: "radovskyb",
+		Password: "$2a$10$hashedpassword",
+		Role:     RoleUser,
+	}
+
+	// Both users and pointers to users should omit the password.
+	for _, v := range []interface{}{u, *u} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), u.Password) {
+			t.Errorf("expected json not to contain the password hash, got %s", b)
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := fields["password"]; found {
+			t.Errorf("expected json not to contain a password key, got %s", b)
+		}
+		if fields["username"] != u.Username {
+			t.Errorf("expected username to be %s, got %v", u.Username, fields["username"])
+		}
+	}
+
+	// The password is still set on the user.
+	if u.Password == "" {
+		t.Error("expected password to still be set")
+	}
+}
+
+func TestUnmarshalJSONBindsPassword(t *testing.T) {
+	var u User
+	err := json.Unmarshal([]byte(`{
+		"email": "radovskyb@gmail.com",
+		"username": "radovskyb",
+		"password": "password123"
+	}`), &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Password != "password123" {
+		t.Errorf("expected password to be password123, got %s", u.Password)
+	}
+	if u.Username != "radovskyb" {
+		t.Errorf("expected username to be radovskyb, got %s", u.Username)
+	}
+}